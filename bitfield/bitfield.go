@@ -1,5 +1,7 @@
 package bitfield
 
+import "math/bits"
+
 // "bitfield" is one type of message,
 // which is a data structure that peers use to efficiently encode which pieces they are able to send.
 // A bitfield looks like a byte array, and to check which pieces they have,
@@ -30,3 +32,12 @@ func (bf Bitfield) SetPiece(index int) {
 	offset := index % 8
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+// Count returns the number of bits set in the bitfield
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		count += bits.OnesCount8(b)
+	}
+	return count
+}
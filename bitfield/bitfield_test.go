@@ -50,3 +50,10 @@ func TestBitfield_SetPiece(t *testing.T) {
 		assert.Equal(t, test.output, bf)
 	}
 }
+
+func TestBitfield_Count(t *testing.T) {
+	assert.Equal(t, 0, Bitfield{}.Count())
+	assert.Equal(t, 0, Bitfield{0, 0}.Count())
+	assert.Equal(t, 6, Bitfield{0b01010100, 0b01010100}.Count())
+	assert.Equal(t, 16, Bitfield{0xff, 0xff}.Count())
+}
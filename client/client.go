@@ -6,14 +6,22 @@ import (
 	"bittorrent-client-go/message"
 	"bittorrent-client-go/peers"
 	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 // Unless specified otherwise, all integers in the peer wire protocol are encoded as four byte big-endian values.
 // This includes the length prefix on all messages that come after the handshake.
 
+// reserved are the reserved bytes of our handshake, announcing the extensions we support
+var reserved = handshake.Reserved(handshake.FastExtension, handshake.ExtensionProtocol)
+
+// writeTimeout is how long a peer may take to accept a message before the connection is considered dead
+var writeTimeout = 30 * time.Second
+
 // clientInfo maintains state information for each connection that it has with a remote peer
 type clientInfo struct {
 	AmChoking      bool
@@ -30,19 +38,38 @@ type Client struct {
 	Peer       peers.Peer
 	InfoHash   [20]byte
 	PeerID     [20]byte
+	Reserved   [8]byte // reserved bytes of the peer's handshake
+	HaveAll    bool    // the peer sent `have all` instead of a bitfield, and Bitfield is empty until sized by the caller
+
+	writeMu       sync.Mutex // serializes writes, apart from mu so that a peer slow to read does not block Info
+	mu            sync.Mutex // guards ClientInfo, which the choker updates from its own goroutine
+	extensions    []extension
+	peerHandshake *ExtendedHandshake
 }
 
-// New connects with a peer, completes a handshake, and receives a handshake
-func New(peer peers.Peer, peerID [20]byte, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*5) // TODO: currently only TCP is supported
+// New connects with a peer, completes a handshake, and receives a handshake.
+// Cancelling `ctx` aborts the dial and the handshake, but not the connection once New returns
+func New(ctx context.Context, peer peers.Peer, peerID [20]byte, infoHash [20]byte) (*Client, error) {
+	dialer := net.Dialer{Timeout: time.Second * 5}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String()) // TODO: currently only TCP is supported
 	if err != nil {
 		return nil, err
 	}
-	_, err = completeHandShake(conn, infoHash, peerID)
-	if err != nil {
-		return nil, err
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close() // unblocks the handshake
+	})
+	res, err := completeHandShake(conn, infoHash, peerID)
+	if err == nil && peer.ID != [20]byte{} && res.PeerID != peer.ID { // the tracker told us who to expect
+		err = fmt.Errorf("expected <peer_id> %x, got %x", peer.ID, res.PeerID)
+	}
+	var bf bitfield.Bitfield
+	var haveAll bool
+	if err == nil {
+		bf, haveAll, err = recvBitfield(conn, handshake.FastExtension.IsSet(res.Reserved))
+	}
+	if !stop() { // cancelled, the connection is closed
+		return nil, ctx.Err()
 	}
-	bf, err := recvBitfield(conn)
 	if err != nil { // ask another peer later
 		_ = conn.Close()
 		return nil, err
@@ -59,6 +86,56 @@ func New(peer peers.Peer, peerID [20]byte, infoHash [20]byte) (*Client, error) {
 		Peer:     peer,
 		InfoHash: infoHash,
 		PeerID:   peerID,
+		Reserved: res.Reserved,
+		HaveAll:  haveAll,
+	}, nil
+}
+
+// Accept completes the handshake of an incoming connection, for a torrent we serve as told by `known`.
+// Unlike New, it does not wait for a bitfield, since a peer that has no pieces may not send any
+func Accept(conn net.Conn, peerID [20]byte, known func(infoHash [20]byte) bool) (*Client, error) {
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	defer func(conn net.Conn, t time.Time) {
+		_ = conn.SetDeadline(t)
+	}(conn, time.Time{}) // disable the deadline
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !known(res.InfoHash) {
+		return nil, fmt.Errorf("unknown <info_hash> %x", res.InfoHash)
+	}
+	req, err := handshake.New(res.InfoHash, peerID, reserved)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := req.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(serialized)
+	if err != nil {
+		return nil, err
+	}
+	var peer peers.Peer
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+		if ip := addr.IP.To4(); ip != nil { // IPv4 peers of a dual-stack listener come as IPv4-mapped IPv6 addresses
+			peer.IP = ip
+		}
+	}
+	return &Client{
+		Conn: conn,
+		ClientInfo: clientInfo{
+			AmChoking:      true,
+			AmInterested:   false,
+			PeerChoking:    true,
+			PeerInterested: false,
+		},
+		Peer:     peer,
+		InfoHash: res.InfoHash,
+		PeerID:   peerID,
+		Reserved: res.Reserved,
 	}, nil
 }
 
@@ -67,7 +144,7 @@ func completeHandShake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*hand
 	defer func(conn net.Conn, t time.Time) {
 		_ = conn.SetDeadline(t)
 	}(conn, time.Time{}) // disable the deadline
-	req, err := handshake.New(infoHash, peerID, [8]byte{0, 0, 0, 0, 0, 0, 0, 0})
+	req, err := handshake.New(infoHash, peerID, reserved)
 	if err != nil {
 		return nil, err
 	}
@@ -89,24 +166,35 @@ func completeHandShake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*hand
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+// recvBitfield receives the pieces the peer has, which peers supporting the Fast extension may send as `have all` or `have none`
+func recvBitfield(conn net.Conn, fast bool) (bf bitfield.Bitfield, haveAll bool, err error) {
 	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
 	defer func(conn net.Conn, t time.Time) {
 		_ = conn.SetDeadline(t)
 	}(conn, time.Time{}) // disable the deadline
 	msg, err := message.Read(conn)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if msg == nil {
 		err := fmt.Errorf("expected message, got %v", msg)
-		return nil, err
+		return nil, false, err
 	}
-	if msg.MessageID != message.MsgBitfield {
-		err := fmt.Errorf("expected bitfield (<id=5>), got <message ID> %v", msg.MessageID)
-		return nil, err
+	switch {
+	case msg.MessageID == message.MsgBitfield:
+		return msg.Payload, false, nil
+	case fast && msg.MessageID == message.MsgHaveAll:
+		return bitfield.Bitfield{}, true, nil
+	case fast && msg.MessageID == message.MsgHaveNone:
+		return bitfield.Bitfield{}, false, nil
 	}
-	return msg.Payload, nil
+	err = fmt.Errorf("expected bitfield (<id=5>), got <message ID> %v", msg.MessageID)
+	return nil, false, err
+}
+
+// SupportsFast tells if the Fast extension (BEP 6) is enabled on the connection, which we always announce
+func (c *Client) SupportsFast() bool {
+	return handshake.FastExtension.IsSet(c.Reserved)
 }
 
 // Read reads and consumes a message from the connection
@@ -115,37 +203,144 @@ func (c *Client) Read() (msg *message.Message, err error) {
 	return msg, err
 }
 
+// write sends a message, without interleaving it with messages sent from other goroutines
+func (c *Client) write(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeLocked(msg)
+}
+
+// writeLocked sends a message while writeMu is held, failing if the peer does not take it within writeTimeout
+func (c *Client) writeLocked(msg *message.Message) error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// Info returns a snapshot of the connection state
+func (c *Client) Info() clientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ClientInfo
+}
+
+// SetChoking chokes or unchokes the peer, sending a message only when the state changes
+func (c *Client) SetChoking(choking bool) error {
+	c.writeMu.Lock() // held until the state is updated, so that concurrent calls send the messages in order
+	defer c.writeMu.Unlock()
+	if c.Info().AmChoking == choking {
+		return nil
+	}
+	var msg = &message.Message{MessageID: message.MsgUnchoke, Prefix: uint32(1)}
+	if choking {
+		msg.MessageID = message.MsgChoke
+	}
+	err := c.writeLocked(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientInfo.AmChoking = choking
+	return nil
+}
+
+// SetPeerInterested records an `interested` or `not interested` message received from the peer
+func (c *Client) SetPeerInterested(interested bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientInfo.PeerInterested = interested
+}
+
+// SetPeerChoking records a `choke` or `unchoke` message received from the peer
+func (c *Client) SetPeerChoking(choking bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientInfo.PeerChoking = choking
+}
+
 // SendRequest sends a `request` message to a peer
 func (c *Client) SendRequest(index, begin, length int) error {
 	var req = message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
-	return err
+	return c.write(req)
+}
+
+// SendCancel sends a `cancel` message to a peer
+func (c *Client) SendCancel(index, begin, length int) error {
+	var msg = message.FormatCancel(index, begin, length)
+	return c.write(msg)
+}
+
+// SendPiece sends a `piece` message to a peer
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	var msg = message.FormatPiece(index, begin, block)
+	return c.write(msg)
 }
 
-// SendInterested sends an `interested` message to a peer
+// SendBitfield sends a `bitfield` message to a peer
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	var msg = &message.Message{MessageID: message.MsgBitfield, Payload: bf, Prefix: uint32(1 + len(bf))}
+	return c.write(msg)
+}
+
+// SendHaveAll sends a `have all` message to a peer supporting the Fast extension, in place of a full bitfield
+func (c *Client) SendHaveAll() error {
+	var msg = &message.Message{MessageID: message.MsgHaveAll, Prefix: uint32(1)}
+	return c.write(msg)
+}
+
+// SendHaveNone sends a `have none` message to a peer supporting the Fast extension, in place of an empty bitfield
+func (c *Client) SendHaveNone() error {
+	var msg = &message.Message{MessageID: message.MsgHaveNone, Prefix: uint32(1)}
+	return c.write(msg)
+}
+
+// SendReject sends a `reject request` message to a peer supporting the Fast extension, for a request we will not serve
+func (c *Client) SendReject(index, begin, length int) error {
+	var msg = message.FormatReject(index, begin, length)
+	return c.write(msg)
+}
+
+// SendInterested sends an `interested` message to a peer and keeps ClientInfo.AmInterested in sync
 func (c *Client) SendInterested() error {
 	var msg = message.Message{MessageID: message.MsgInterested, Prefix: uint32(1)}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	err := c.write(&msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientInfo.AmInterested = true
+	return nil
 }
 
-// SendNotInterested sends a `not interested` message to a peer
+// SendNotInterested sends a `not interested` message to a peer and keeps ClientInfo.AmInterested in sync
 func (c *Client) SendNotInterested() error {
 	var msg = message.Message{MessageID: message.MsgNotInterested, Prefix: uint32(1)}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	err := c.write(&msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientInfo.AmInterested = false
+	return nil
+}
+
+// SendChoke sends a `choke` message to a peer
+func (c *Client) SendChoke() error {
+	var msg = &message.Message{MessageID: message.MsgChoke, Prefix: uint32(1)}
+	return c.write(msg)
 }
 
 // SendUnchoke sends an `unchoke` message to a peer
 func (c *Client) SendUnchoke() error {
-	var msg = message.Message{MessageID: message.MsgUnchoke, Prefix: uint32(1)}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	var msg = &message.Message{MessageID: message.MsgUnchoke, Prefix: uint32(1)}
+	return c.write(msg)
 }
 
 // SendHave sends a `have` message to a peer
 func (c *Client) SendHave(index int) error {
 	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(msg)
 }
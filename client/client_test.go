@@ -1,12 +1,17 @@
 package client
 
 import (
+	"bittorrent-client-go/bitfield"
 	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/internal/peertest"
 	"bittorrent-client-go/message"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"net"
 	"testing"
+	"time"
 )
 
 // createClientAndServer: helper function
@@ -164,3 +169,227 @@ func TestClient_SendHave(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, buf, expected)
 }
+
+func TestAccept(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerHandshake := []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 45, 83, 89, 48, 48, 49, 48, 45, 192, 125, 147, 203, 136, 32, 59, 180, 253, 168, 193, 19}
+	known := func(h [20]byte) bool {
+		return h == infoHash
+	}
+	peerConn, ourConn := createClientAndServer(t)
+	_, err := peerConn.Write(peerHandshake)
+	require.Nil(t, err)
+	c, err := Accept(ourConn, [20]byte{1, 2, 3}, known)
+	require.Nil(t, err)
+	assert.Equal(t, infoHash, c.InfoHash)
+	assert.True(t, c.SupportsExtensions())
+	assert.True(t, c.ClientInfo.AmChoking)
+	res, err := handshake.Read(peerConn)
+	require.Nil(t, err)
+	assert.Equal(t, infoHash, res.InfoHash)
+	assert.Equal(t, [20]byte{1, 2, 3}, res.PeerID)
+
+	peerConn, ourConn = createClientAndServer(t)
+	peerHandshake[30] = 0 // another torrent
+	_, err = peerConn.Write(peerHandshake)
+	require.Nil(t, err)
+	_, err = Accept(ourConn, [20]byte{1, 2, 3}, known)
+	assert.NotNil(t, err)
+}
+
+func TestClient_SendCancel(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	var err = client.SendCancel(1, 2, 3)
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0d,
+		8,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+	}
+	var buf = make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestClient_SendPiece(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	var err = client.SendPiece(1, 2, []byte{0xaa, 0xbb})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0b,
+		7,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0xaa, 0xbb,
+	}
+	var buf = make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestClient_SendBitfield(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	var err = client.SendBitfield([]byte{0b10100000, 0b00000001})
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x03,
+		5,
+		0b10100000, 0b00000001,
+	}
+	var buf = make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestClient_SendChoke(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	err := client.SendChoke()
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x01,
+		0,
+	}
+	buf := make([]byte, len(expected))
+	_, err = serverConn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, buf, expected)
+}
+
+func TestClient_SetChoking(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn, ClientInfo: clientInfo{AmChoking: true}}
+	assert.Nil(t, client.SetChoking(true)) // already choked, nothing is sent
+	assert.Nil(t, client.SetChoking(false))
+	assert.False(t, client.Info().AmChoking)
+	assert.Nil(t, client.SetChoking(true))
+	assert.True(t, client.Info().AmChoking)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x01, 1,
+		0x00, 0x00, 0x00, 0x01, 0,
+	}
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(serverConn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestClient_SetChoking_stuckPeer(t *testing.T) {
+	timeout := writeTimeout
+	writeTimeout = 100 * time.Millisecond
+	defer func() {
+		writeTimeout = timeout
+	}()
+	ours, theirs := net.Pipe() // writes block until the peer reads, which it never does
+	defer func() {
+		_ = ours.Close()
+		_ = theirs.Close()
+	}()
+	var client = Client{Conn: ours, ClientInfo: clientInfo{AmChoking: true}}
+	failed := make(chan error)
+	go func() {
+		failed <- client.SetChoking(false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, client.Info().AmChoking) // not blocked by the write
+	assert.NotNil(t, <-failed)
+	assert.True(t, client.Info().AmChoking)
+}
+
+func TestRecvBitfield(t *testing.T) {
+	var tests = map[string]struct {
+		input   *message.Message
+		fast    bool
+		output  bitfield.Bitfield
+		haveAll bool
+		failure bool
+	}{
+		"bitfield": {
+			input:  &message.Message{MessageID: message.MsgBitfield, Payload: []byte{0b10100000}, Prefix: 2},
+			output: bitfield.Bitfield{0b10100000},
+		},
+		"have all": {
+			input:   &message.Message{MessageID: message.MsgHaveAll, Prefix: 1},
+			fast:    true,
+			output:  bitfield.Bitfield{},
+			haveAll: true,
+		},
+		"have none": {
+			input:  &message.Message{MessageID: message.MsgHaveNone, Prefix: 1},
+			fast:   true,
+			output: bitfield.Bitfield{},
+		},
+		"have all without the Fast extension": {
+			input:   &message.Message{MessageID: message.MsgHaveAll, Prefix: 1},
+			failure: true,
+		},
+		"another message": {
+			input:   message.FormatHave(1),
+			fast:    true,
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		_, err := serverConn.Write(test.input.Serialize())
+		require.Nil(t, err)
+		bf, haveAll, err := recvBitfield(clientConn, test.fast)
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, bf, name)
+		assert.Equal(t, test.haveAll, haveAll, name)
+	}
+}
+
+func TestClient_SendReject(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	var err = client.SendReject(1, 2, 3)
+	assert.Nil(t, err)
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x0d,
+		16,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x03,
+	}
+	var buf = make([]byte, len(expected))
+	_, err = io.ReadFull(serverConn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, buf)
+}
+
+func TestNew_peerID(t *testing.T) {
+	var tests = map[string]struct {
+		expected [20]byte
+		failure  bool
+	}{
+		"unknown peer id":    {expected: [20]byte{}},
+		"matching peer id":   {expected: peertest.PeerID},
+		"unexpected peer id": {expected: [20]byte{'q'}, failure: true},
+	}
+	infoHash := [20]byte{1, 2, 3}
+	hello := []*message.Message{{MessageID: message.MsgBitfield, Payload: []byte{0xff}, Prefix: 2}}
+	peer := peertest.Serve(t, infoHash, [8]byte{}, hello, nil)
+	for name, test := range tests {
+		peer.ID = test.expected
+		c, err := New(context.Background(), peer, [20]byte{'l'}, infoHash)
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			_ = c.Conn.Close()
+		}
+	}
+}
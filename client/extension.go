@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/message"
+	"bytes"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"net"
+)
+
+// ExtendedHandshakeID is the extended message ID reserved for the extension protocol handshake (BEP 10)
+const ExtendedHandshakeID uint8 = 0
+
+// Version is the client name and version sent as `v` in the extension protocol handshake
+const Version = "btclient 0.1"
+
+// DefaultReqq is the number of outstanding requests we let a peer queue, sent as `reqq` unless set otherwise
+const DefaultReqq int = 250
+
+// ExtendedHandshake is the bencoded payload of the extension protocol handshake
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`                       // extension name to the extended message ID the sender expects for it
+	V            string         `bencode:"v,omitempty"`             // client name and version
+	P            int            `bencode:"p,omitempty"`             // local TCP listen port of the sender
+	YourIP       string         `bencode:"yourip,omitempty"`        // compact IP address of the receiver, as seen by the sender
+	Reqq         int            `bencode:"reqq,omitempty"`          // number of outstanding requests the sender keeps without dropping any
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // size of the info dictionary in bytes (BEP 9)
+}
+
+// ExtensionHandler handles the payload of an extended message received for a registered extension
+type ExtensionHandler func(payload []byte) error
+
+// extension is an extension registered on a connection, its extended message ID being its position in the registry plus one
+type extension struct {
+	name   string
+	handle ExtensionHandler
+}
+
+// SupportsExtensions tells if the peer announced the extension protocol in its handshake
+func (c *Client) SupportsExtensions() bool {
+	return handshake.ExtensionProtocol.IsSet(c.Reserved)
+}
+
+// RegisterExtension adds an extension to those announced in our extension protocol handshake,
+// and returns the extended message ID peers send its messages with. Registering a name again replaces its handler
+func (c *Client) RegisterExtension(name string, handle ExtensionHandler) uint8 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ext := range c.extensions {
+		if ext.name == name {
+			c.extensions[i].handle = handle
+			return uint8(i + 1)
+		}
+	}
+	c.extensions = append(c.extensions, extension{name: name, handle: handle})
+	return uint8(len(c.extensions))
+}
+
+// SendExtended sends an `extended` message to a peer, with the extended message ID the peer expects
+func (c *Client) SendExtended(extendedID uint8, payload []byte) error {
+	msg := message.FormatExtended(extendedID, payload)
+	return c.write(msg)
+}
+
+// SendExtendedHandshake sends the extension protocol handshake to a peer.
+// The `m` dictionary lists the registered extensions, and `v`, `reqq` and `yourip` are filled in when unset
+func (c *Client) SendExtendedHandshake(h ExtendedHandshake) error {
+	if h.M == nil {
+		h.M = map[string]int{}
+	}
+	c.mu.Lock()
+	for i, ext := range c.extensions {
+		h.M[ext.name] = i + 1
+	}
+	c.mu.Unlock()
+	if h.V == "" {
+		h.V = Version
+	}
+	if h.Reqq == 0 {
+		h.Reqq = DefaultReqq
+	}
+	if addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok && h.YourIP == "" {
+		if ip := addr.IP.To4(); ip != nil {
+			h.YourIP = string(ip)
+		} else {
+			h.YourIP = string(addr.IP.To16())
+		}
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, h)
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(ExtendedHandshakeID, buf.Bytes())
+}
+
+// ParseExtendedHandshake parses the payload of an extension protocol handshake
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	var h ExtendedHandshake
+	err := bencode.Unmarshal(bytes.NewReader(payload), &h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// HandleExtendedHandshake parses the extension protocol handshake of the peer and keeps it for PeerExtensionID
+func (c *Client) HandleExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	h, err := ParseExtendedHandshake(payload)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerHandshake != nil && h.M != nil { // later handshakes only update the extensions they list
+		for name, id := range c.peerHandshake.M {
+			if _, ok := h.M[name]; !ok {
+				h.M[name] = id
+			}
+		}
+	}
+	c.peerHandshake = h
+	return h, nil
+}
+
+// HandleExtended dispatches an `extended` message to the handler of its extension, by the extended message ID we assigned.
+// Messages of unknown extensions are ignored
+func (c *Client) HandleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	if id == ExtendedHandshakeID {
+		_, err = c.HandleExtendedHandshake(payload)
+		return err
+	}
+	c.mu.Lock()
+	var handle ExtensionHandler
+	if int(id) <= len(c.extensions) {
+		handle = c.extensions[id-1].handle
+	}
+	c.mu.Unlock()
+	if handle == nil {
+		return nil
+	}
+	return handle(payload)
+}
+
+// PeerHandshake returns the extension protocol handshake of the peer, nil until it is received
+func (c *Client) PeerHandshake() *ExtendedHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerHandshake
+}
+
+// PeerExtensionID returns the extended message ID the peer expects for an extension, false if it does not support it
+func (c *Client) PeerExtensionID(name string) (uint8, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerHandshake == nil {
+		return 0, false
+	}
+	id, ok := c.peerHandshake.M[name]
+	if !ok || id <= 0 || id > 255 { // 0 disables an extension
+		return 0, false
+	}
+	return uint8(id), true
+}
+
+// SendExtension sends an extended message of an extension the peer supports, by name
+func (c *Client) SendExtension(name string, payload []byte) error {
+	id, ok := c.PeerExtensionID(name)
+	if !ok {
+		return fmt.Errorf("peer %s does not support %s", c.Peer, name)
+	}
+	return c.SendExtended(id, payload)
+}
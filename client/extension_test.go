@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bittorrent-client-go/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestClient_SendExtendedHandshake(t *testing.T) {
+	var clientConn, serverConn net.Conn = createClientAndServer(t)
+	var client = Client{Conn: clientConn}
+	assert.Equal(t, uint8(1), client.RegisterExtension("ut_metadata", nil))
+	assert.Equal(t, uint8(2), client.RegisterExtension("ut_pex", nil))
+	assert.Equal(t, uint8(1), client.RegisterExtension("ut_metadata", nil)) // registered already
+	err := client.SendExtendedHandshake(ExtendedHandshake{P: 6881})
+	require.Nil(t, err)
+	msg, err := message.Read(serverConn)
+	require.Nil(t, err)
+	id, payload, err := message.ParseExtended(msg)
+	require.Nil(t, err)
+	assert.Equal(t, ExtendedHandshakeID, id)
+	h, err := ParseExtendedHandshake(payload)
+	require.Nil(t, err)
+	expected := &ExtendedHandshake{
+		M:      map[string]int{"ut_metadata": 1, "ut_pex": 2},
+		V:      Version,
+		P:      6881,
+		YourIP: string([]byte{127, 0, 0, 1}),
+		Reqq:   DefaultReqq,
+	}
+	assert.Equal(t, expected, h)
+}
+
+func TestClient_HandleExtended(t *testing.T) {
+	var client = Client{}
+	var received []byte
+	id := client.RegisterExtension("ut_pex", func(payload []byte) error {
+		received = payload
+		return nil
+	})
+	_, ok := client.PeerExtensionID("ut_pex")
+	assert.False(t, ok) // no handshake yet
+
+	err := client.HandleExtended(message.FormatExtended(ExtendedHandshakeID, []byte("d1:md11:ut_metadatai3e6:ut_pexi4ee1:v4:teste")))
+	require.Nil(t, err)
+	peerID, ok := client.PeerExtensionID("ut_pex")
+	assert.True(t, ok)
+	assert.Equal(t, uint8(4), peerID)
+	assert.Equal(t, "test", client.PeerHandshake().V)
+
+	err = client.HandleExtended(message.FormatExtended(ExtendedHandshakeID, []byte("d1:md6:ut_pexi0eee"))) // disables ut_pex only
+	require.Nil(t, err)
+	_, ok = client.PeerExtensionID("ut_pex")
+	assert.False(t, ok)
+	_, ok = client.PeerExtensionID("ut_metadata")
+	assert.True(t, ok)
+
+	err = client.HandleExtended(message.FormatExtended(id, []byte("de")))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("de"), received)
+	err = client.HandleExtended(message.FormatExtended(7, []byte("de"))) // unknown extensions are ignored
+	assert.Nil(t, err)
+}
@@ -0,0 +1,619 @@
+package dht
+
+import (
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// alpha is the number of queries a lookup keeps in flight
+const alpha = 3
+
+// maxValues is the largest number of peers returned for a get_peers query
+const maxValues = 50
+
+// values of `want`, asking for IPv4 and IPv6 nodes (BEP 32)
+const (
+	wantIPv4 = "n4"
+	wantIPv6 = "n6"
+)
+
+// queryTimeout is how long to wait for the response of a query
+var queryTimeout = 2 * time.Second
+
+// tokenInterval is how often the secret used to generate tokens is rotated, tokens stay valid for two intervals
+var tokenInterval = 5 * time.Minute
+
+// peerTTL is how long an announced peer is kept without being announced again
+var peerTTL = 30 * time.Minute
+
+// maintenanceInterval is how often buckets, tokens and announced peers are looked after
+var maintenanceInterval = time.Minute
+
+// Config holds the settings of a DHT node
+type Config struct {
+	Addr      string   // UDP address to listen on, e.g. ":6881" for both IPv4 and IPv6
+	Bootstrap []string // addresses (host:port) of nodes used to join the network
+}
+
+// Node is a Mainline DHT node (BEP 5), it answers queries from other nodes and looks up peers for info hashes
+type Node struct {
+	ID     [20]byte
+	conn   *net.UDPConn
+	table  *table
+	config Config
+
+	mu      sync.Mutex
+	pending map[string]pendingQuery // by transaction ID
+	nextTID uint16
+	secrets [2][]byte                      // current and previous token secrets
+	store   map[[20]byte]map[string]stored // announced peers by info hash, then by address
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// pendingQuery is a query waiting for its response
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan *krpcMessage
+}
+
+// stored is a peer announced to us
+type stored struct {
+	peer    peers.Peer
+	expires time.Time
+}
+
+// New starts a DHT node with a random ID listening on `config.Addr`, call Bootstrap to join the network
+func New(config Config) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		conn:    conn,
+		config:  config,
+		pending: make(map[string]pendingQuery),
+		store:   make(map[[20]byte]map[string]stored),
+		closed:  make(chan struct{}),
+	}
+	_, err = rand.Read(n.ID[:])
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	n.table = newTable(n.ID)
+	n.secrets[0], n.secrets[1] = newSecret(), newSecret()
+	n.wg.Add(2)
+	go n.readLoop()
+	go n.maintain()
+	return n, nil
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 20)
+	_, _ = rand.Read(secret)
+	return secret
+}
+
+// Addr returns the local address the node listens on
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the node
+func (n *Node) Close() error {
+	select {
+	case <-n.closed:
+		return nil
+	default:
+	}
+	close(n.closed)
+	err := n.conn.Close()
+	n.wg.Wait()
+	return err
+}
+
+// Nodes returns the number of nodes in the routing table
+func (n *Node) Nodes() int {
+	return n.table.size()
+}
+
+// Bootstrap joins the network through the configured bootstrap nodes, by looking up our own ID
+func (n *Node) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, addr := range n.config.Bootstrap {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			udpAddr, err := resolve(ctx, addr)
+			if err != nil {
+				log.Printf("could not resolve DHT bootstrap node %s: %v\n", addr, err)
+				return
+			}
+			_, _ = n.Ping(ctx, udpAddr) // answering nodes are added to the routing table
+		}(addr)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if n.table.size() == 0 {
+		return fmt.Errorf("no DHT bootstrap node answered")
+	}
+	n.lookup(ctx, n.ID, queryFindNode)
+	return ctx.Err()
+}
+
+// resolve resolves the `host:port` address of a node, until `ctx` is done
+func resolve(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: portNum, Zone: ips[0].Zone}, nil
+}
+
+// Ping pings a node and returns its ID
+func (n *Node) Ping(ctx context.Context, addr *net.UDPAddr) ([20]byte, error) {
+	resp, err := n.query(ctx, addr, queryPing, krpcArgs{})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	var id [20]byte
+	copy(id[:], resp.ID)
+	return id, nil
+}
+
+// GetPeers looks up peers for an info hash
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]peers.Peer, error) {
+	result := n.lookup(ctx, infoHash, queryGetPeers)
+	if ctx.Err() != nil {
+		return result.peers, ctx.Err()
+	}
+	if len(result.peers) == 0 {
+		return nil, fmt.Errorf("no peer found in the DHT for %x", infoHash)
+	}
+	return result.peers, nil
+}
+
+// Announce looks up the nodes closest to an info hash and tells them we have peers on `port`,
+// returning the peers found along the way
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]peers.Peer, error) {
+	result := n.lookup(ctx, infoHash, queryGetPeers)
+	announced := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range result.closest {
+		token, ok := result.tokens[node.ID]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(node nodeInfo, token string) {
+			defer wg.Done()
+			args := krpcArgs{InfoHash: string(infoHash[:]), Port: int(port), Token: token}
+			if _, err := n.query(ctx, node.Addr, queryAnnouncePeer, args); err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(node, token)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return result.peers, ctx.Err()
+	}
+	if announced == 0 {
+		return result.peers, fmt.Errorf("could not announce %x to any node", infoHash)
+	}
+	return result.peers, nil
+}
+
+// lookupResult is the outcome of an iterative lookup
+type lookupResult struct {
+	closest []nodeInfo          // the K closest nodes that answered
+	tokens  map[[20]byte]string // tokens handed out by the nodes that answered get_peers
+	peers   []peers.Peer
+}
+
+// lookup iteratively queries the nodes closest to `target` with find_node or get_peers,
+// keeping `alpha` queries in flight, until the K closest nodes known have all answered or failed, or `ctx` is done
+func (n *Node) lookup(ctx context.Context, target [20]byte, method string) *lookupResult {
+	type reply struct {
+		node nodeInfo
+		resp *krpcReturn
+	}
+	result := &lookupResult{tokens: make(map[[20]byte]string)}
+	candidates := n.table.closest(target, K)
+	for _, addr := range n.config.Bootstrap { // useful when the table is empty, e.g. when bootstrapping
+		if len(candidates) > 0 {
+			break
+		}
+		if udpAddr, err := resolve(ctx, addr); err == nil {
+			candidates = append(candidates, nodeInfo{Addr: udpAddr})
+		}
+	}
+	queried := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+	replies := make(chan reply)
+	inFlight := 0
+	var answered []nodeInfo
+	for {
+		sortByDistance(candidates, target)
+		if len(candidates) > K {
+			candidates = candidates[:K]
+		}
+		for _, c := range candidates {
+			if inFlight >= alpha || ctx.Err() != nil { // the queries in flight return early once cancelled
+				break
+			}
+			if queried[c.Addr.String()] {
+				continue
+			}
+			queried[c.Addr.String()] = true
+			inFlight++
+			go func(c nodeInfo) {
+				args := krpcArgs{Target: string(target[:]), Want: []string{wantIPv4, wantIPv6}}
+				if method == queryGetPeers {
+					args = krpcArgs{InfoHash: string(target[:]), Want: []string{wantIPv4, wantIPv6}}
+				}
+				resp, err := n.query(ctx, c.Addr, method, args)
+				if err != nil {
+					resp = nil
+				}
+				replies <- reply{node: c, resp: resp}
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+		r := <-replies
+		inFlight--
+		if r.resp == nil {
+			for i, c := range candidates { // drop unresponsive nodes so that farther ones get a chance
+				if sameAddr(c.Addr, r.node.Addr) {
+					candidates = append(candidates[:i], candidates[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+		copy(r.node.ID[:], r.resp.ID)
+		answered = append(answered, r.node)
+		if r.resp.Token != "" {
+			result.tokens[r.node.ID] = r.resp.Token
+		}
+		for _, p := range decodePeers(r.resp.Values) {
+			if !seenPeers[p.String()] {
+				seenPeers[p.String()] = true
+				result.peers = append(result.peers, p)
+			}
+		}
+		nodes, _ := decodeNodes(r.resp.Nodes) // either family is kept when the other is malformed
+		nodes6, _ := decodeNodes6(r.resp.Nodes6)
+		for _, node := range append(nodes, nodes6...) {
+			if node.ID != n.ID && !queried[node.Addr.String()] {
+				candidates = append(candidates, node)
+			}
+		}
+		candidates = dedup(candidates)
+	}
+	sortByDistance(answered, target)
+	if len(answered) > K {
+		answered = answered[:K]
+	}
+	result.closest = answered
+	return result
+}
+
+// dedup removes nodes with the same address
+func dedup(nodes []nodeInfo) []nodeInfo {
+	seen := make(map[string]bool)
+	out := nodes[:0]
+	for _, node := range nodes {
+		if !seen[node.Addr.String()] {
+			seen[node.Addr.String()] = true
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// query sends a query and waits for its response, the responding node is added to the routing table
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args krpcArgs) (*krpcReturn, error) {
+	args.ID = string(n.ID[:])
+	n.mu.Lock()
+	n.nextTID++
+	tid := string(binary.BigEndian.AppendUint16(nil, n.nextTID))
+	ch := make(chan *krpcMessage, 1)
+	n.pending[tid] = pendingQuery{addr: addr, response: ch}
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, tid)
+		n.mu.Unlock()
+	}()
+	buf, err := encode(krpcQuery{T: tid, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+	_, err = n.conn.WriteToUDP(buf, addr)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		if msg.Y == "e" {
+			return nil, msg.remoteError()
+		}
+		if len(msg.R.ID) != 20 {
+			return nil, fmt.Errorf("response without a valid node ID")
+		}
+		var id [20]byte
+		copy(id[:], msg.R.ID)
+		n.table.insert(nodeInfo{ID: id, Addr: addr})
+		return &msg.R, nil
+	case <-timer.C:
+		n.failedAddr(addr)
+		return nil, fmt.Errorf("query %s to %s timed out", method, addr)
+	case <-n.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// failedAddr records a failed query to whichever contact has this address
+func (n *Node) failedAddr(addr *net.UDPAddr) {
+	for _, c := range n.table.closest(n.ID, 160*K) {
+		if sameAddr(c.Addr, addr) {
+			n.table.failed(c.ID)
+			return
+		}
+	}
+}
+
+// readLoop dispatches incoming packets, responses to their pending query and queries to their handler
+func (n *Node) readLoop() {
+	defer n.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg, err := decode(buf[:size])
+		if err != nil {
+			continue // not worth an answer
+		}
+		switch msg.Y {
+		case "q":
+			n.handleQuery(msg, addr)
+		case "r", "e":
+			n.mu.Lock()
+			pending, ok := n.pending[msg.T]
+			n.mu.Unlock()
+			if ok && sameAddr(pending.addr, addr) {
+				select {
+				case pending.response <- msg:
+				default: // duplicate response
+				}
+			}
+		}
+	}
+}
+
+// handleQuery answers a query from another node
+func (n *Node) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if len(msg.A.ID) != 20 {
+		n.sendError(msg.T, addr, errProtocol, "invalid id")
+		return
+	}
+	var id [20]byte
+	copy(id[:], msg.A.ID)
+	r := krpcReturn{ID: string(n.ID[:])}
+	switch msg.Q {
+	case queryPing:
+	case queryFindNode:
+		if len(msg.A.Target) != 20 {
+			n.sendError(msg.T, addr, errProtocol, "invalid target")
+			return
+		}
+		var target [20]byte
+		copy(target[:], msg.A.Target)
+		r.Nodes, r.Nodes6 = n.closestNodes(target, addr, msg.A.Want)
+	case queryGetPeers:
+		if len(msg.A.InfoHash) != 20 {
+			n.sendError(msg.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		r.Token = n.token(addr.IP, 0)
+		r.Values = n.storedPeers(infoHash, addr.IP.To4() == nil)
+		r.Nodes, r.Nodes6 = n.closestNodes(infoHash, addr, msg.A.Want)
+	case queryAnnouncePeer:
+		if len(msg.A.InfoHash) != 20 {
+			n.sendError(msg.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		if msg.A.Token != n.token(addr.IP, 0) && msg.A.Token != n.token(addr.IP, 1) {
+			n.sendError(msg.T, addr, errProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.sendError(msg.T, addr, errProtocol, "invalid port")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		n.storePeer(infoHash, peers.Peer{IP: unmap(addr.IP), Port: uint16(port)})
+	default:
+		n.sendError(msg.T, addr, errMethodUnknown, "Method Unknown")
+		return
+	}
+	n.table.insert(nodeInfo{ID: id, Addr: addr})
+	buf, err := encode(krpcResponse{T: msg.T, Y: "r", R: r})
+	if err != nil {
+		return
+	}
+	_, _ = n.conn.WriteToUDP(buf, addr)
+}
+
+// closestNodes returns the nodes closest to `target` in compact node info, of the families in `want`,
+// or of the family of the querying node `addr` when it does not say
+func (n *Node) closestNodes(target [20]byte, addr *net.UDPAddr, want []string) (nodes string, nodes6 string) {
+	if len(want) == 0 {
+		want = []string{wantIPv4}
+		if addr.IP.To4() == nil {
+			want = []string{wantIPv6}
+		}
+	}
+	closest := n.table.closest(target, 160*K)
+	for _, w := range want {
+		switch w {
+		case wantIPv4:
+			nodes = encodeNodes(closestOf(closest, false))
+		case wantIPv6:
+			nodes6 = encodeNodes6(closestOf(closest, true))
+		}
+	}
+	return nodes, nodes6
+}
+
+// closestOf keeps the first K nodes of a family from nodes sorted by distance
+func closestOf(nodes []nodeInfo, ipv6 bool) []nodeInfo {
+	var out []nodeInfo
+	for _, node := range nodes {
+		if len(out) == K {
+			break
+		}
+		if (node.Addr.IP.To4() == nil) == ipv6 {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// unmap returns IPv4 addresses received on a dual-stack socket in their 4-byte form
+func unmap(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (n *Node) sendError(tid string, addr *net.UDPAddr, code int, message string) {
+	buf, err := encode(krpcError{T: tid, Y: "e", E: []interface{}{code, message}})
+	if err != nil {
+		return
+	}
+	_, _ = n.conn.WriteToUDP(buf, addr)
+}
+
+// token returns the token handed out to an IP address, from the current (0) or previous (1) secret
+func (n *Node) token(ip net.IP, generation int) string {
+	n.mu.Lock()
+	secret := n.secrets[generation]
+	n.mu.Unlock()
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip)
+	return string(h.Sum(nil)[:8])
+}
+
+// storePeer remembers a peer announced for an info hash
+func (n *Node) storePeer(infoHash [20]byte, p peers.Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.store[infoHash] == nil {
+		n.store[infoHash] = make(map[string]stored)
+	}
+	n.store[infoHash][p.String()] = stored{peer: p, expires: time.Now().Add(peerTTL)}
+}
+
+// storedPeers returns up to maxValues peers announced for an info hash, in compact peer info,
+// only the IPv6 ones for a query received over IPv6 and the IPv4 ones otherwise
+func (n *Node) storedPeers(infoHash [20]byte, ipv6 bool) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var values []string
+	for _, s := range n.store[infoHash] {
+		if len(values) >= maxValues {
+			break
+		}
+		if (s.peer.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if v, ok := encodePeer(s.peer); ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// maintain periodically rotates token secrets, expires announced peers and refreshes stale buckets
+func (n *Node) maintain() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	lastRotation := time.Now()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			if now.Sub(lastRotation) >= tokenInterval {
+				n.secrets[1], n.secrets[0] = n.secrets[0], newSecret()
+				lastRotation = now
+			}
+			for infoHash, byAddr := range n.store {
+				for addr, s := range byAddr {
+					if now.After(s.expires) {
+						delete(byAddr, addr)
+					}
+				}
+				if len(byAddr) == 0 {
+					delete(n.store, infoHash)
+				}
+			}
+			n.mu.Unlock()
+			for _, i := range n.table.stale() {
+				n.lookup(context.Background(), randomID(n.ID, i), queryFindNode) // Close interrupts its queries
+				n.table.touch(i)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package dht
+
+import (
+	"bittorrent-client-go/peers"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestNode starts a node on loopback, bootstrapping from `bootstrap` if any
+func newTestNode(t *testing.T, bootstrap ...*Node) *Node {
+	return newTestNodeOn(t, "127.0.0.1:0", bootstrap...)
+}
+
+// newTestNodeOn starts a node on the given address, bootstrapping from `bootstrap` if any
+func newTestNodeOn(t *testing.T, addr string, bootstrap ...*Node) *Node {
+	config := Config{Addr: addr}
+	for _, b := range bootstrap {
+		config.Bootstrap = append(config.Bootstrap, b.Addr().String())
+	}
+	n, err := New(config)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = n.Close()
+	})
+	if len(bootstrap) > 0 {
+		require.Nil(t, n.Bootstrap(context.Background()))
+	}
+	return n
+}
+
+func TestNode_Ping(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	id, err := a.Ping(context.Background(), b.Addr())
+	require.Nil(t, err)
+	assert.Equal(t, b.ID, id)
+	assert.Equal(t, 1, a.Nodes()) // both learn about each other
+	assert.Equal(t, 1, b.Nodes())
+}
+
+func TestNode_Ping_timeout(t *testing.T) {
+	timeout := queryTimeout
+	queryTimeout = 50 * time.Millisecond
+	defer func() {
+		queryTimeout = timeout
+	}()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) // never answers
+	require.Nil(t, err)
+	defer func(conn *net.UDPConn) {
+		_ = conn.Close()
+	}(conn)
+	a := newTestNode(t)
+	_, err = a.Ping(context.Background(), conn.LocalAddr().(*net.UDPAddr))
+	assert.NotNil(t, err)
+}
+
+func TestNode_Bootstrap(t *testing.T) {
+	root := newTestNode(t)
+	nodes := []*Node{root}
+	for i := 0; i < 6; i++ {
+		nodes = append(nodes, newTestNode(t, root))
+	}
+	last := nodes[len(nodes)-1]
+	assert.Equal(t, len(nodes)-1, last.Nodes()) // found every other node through the root
+	n, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer func(n *Node) {
+		_ = n.Close()
+	}(n)
+	assert.NotNil(t, n.Bootstrap(context.Background())) // nothing to bootstrap from
+}
+
+func TestNode_Bootstrap_cancel(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) // never answers
+	require.Nil(t, err)
+	defer func(conn *net.UDPConn) {
+		_ = conn.Close()
+	}(conn)
+	n, err := New(Config{Addr: "127.0.0.1:0", Bootstrap: []string{conn.LocalAddr().String()}})
+	require.Nil(t, err)
+	defer func(n *Node) {
+		_ = n.Close()
+	}(n)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, n.Bootstrap(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), queryTimeout) // rather than waiting for the query to time out
+}
+
+func TestNode_AnnounceGetPeers(t *testing.T) {
+	tests := map[string]struct {
+		addr string
+		peer peers.Peer
+	}{
+		"IPv4": {addr: "127.0.0.1:0", peer: peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+		"IPv6": {addr: "[::1]:0", peer: peers.Peer{IP: net.IPv6loopback, Port: 6881}}, // nodes and peers come as `nodes6` and 18-byte values
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			root := newTestNodeOn(t, test.addr)
+			var nodes []*Node
+			for i := 0; i < 10; i++ {
+				nodes = append(nodes, newTestNodeOn(t, test.addr, root))
+			}
+			infoHash := [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+			_, err := nodes[0].GetPeers(context.Background(), infoHash)
+			assert.NotNil(t, err) // nobody announced yet
+			_, err = nodes[1].Announce(context.Background(), infoHash, 6881)
+			require.Nil(t, err)
+			found, err := nodes[9].GetPeers(context.Background(), infoHash)
+			require.Nil(t, err)
+			assert.Equal(t, []peers.Peer{test.peer}, normalize(found))
+		})
+	}
+}
+
+func TestNode_lookup_malformedNodes(t *testing.T) {
+	real := newTestNodeOn(t, "[::1]:0")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback}) // answers with malformed `nodes` but valid `nodes6`
+	require.Nil(t, err)
+	defer func(conn *net.UDPConn) {
+		_ = conn.Close()
+	}(conn)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := decode(buf[:n])
+			if err != nil {
+				continue
+			}
+			resp, _ := encode(krpcResponse{T: msg.T, Y: "r", R: krpcReturn{
+				ID:     string(make([]byte, 20)),
+				Nodes:  "malformed",
+				Nodes6: encodeNodes6([]nodeInfo{{ID: real.ID, Addr: real.Addr()}}),
+			}})
+			_, _ = conn.WriteToUDP(resp, addr)
+		}
+	}()
+	a, err := New(Config{Addr: "[::1]:0", Bootstrap: []string{conn.LocalAddr().String()}})
+	require.Nil(t, err)
+	defer func(a *Node) {
+		_ = a.Close()
+	}(a)
+	require.Nil(t, a.Bootstrap(context.Background()))
+	assert.Equal(t, 1, real.Nodes()) // found through `nodes6`
+}
+
+func TestNode_handleQuery_errors(t *testing.T) {
+	a := newTestNode(t)
+	b := newTestNode(t)
+	_, err := a.query(context.Background(), b.Addr(), "vote", krpcArgs{})
+	assert.Equal(t, &Error{Code: errMethodUnknown, Message: "Method Unknown"}, err)
+	_, err = a.query(context.Background(), b.Addr(), queryAnnouncePeer, krpcArgs{InfoHash: string(make([]byte, 20)), Port: 6881, Token: "forged"})
+	assert.Equal(t, &Error{Code: errProtocol, Message: "bad token"}, err)
+	_, err = a.query(context.Background(), b.Addr(), queryFindNode, krpcArgs{Target: "short"})
+	assert.Equal(t, &Error{Code: errProtocol, Message: "invalid target"}, err)
+}
+
+// normalize makes IPv4 addresses 4 bytes long, to compare them with assert.Equal
+func normalize(ps []peers.Peer) []peers.Peer {
+	for i := range ps {
+		if ip := ps[i].IP.To4(); ip != nil {
+			ps[i].IP = ip
+		}
+	}
+	return ps
+}
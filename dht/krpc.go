@@ -0,0 +1,233 @@
+package dht
+
+import (
+	"bittorrent-client-go/peers"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"net"
+)
+
+// KRPC is a simple RPC mechanism of bencoded dictionaries sent over UDP (BEP 5), every message has
+// a transaction ID `t` echoed in the response, and a type `y` which is `q` (query), `r` (response) or `e` (error)
+// ping query:          d1:ad2:id20:<id>e1:q4:ping1:t2:aa1:y1:qe
+// find_node query:     d1:ad2:id20:<id>6:target20:<target>e1:q9:find_node1:t2:aa1:y1:qe
+// get_peers query:     d1:ad2:id20:<id>9:info_hash20:<info_hash>e1:q9:get_peers1:t2:aa1:y1:qe
+// announce_peer query: d1:ad2:id20:<id>12:implied_porti1e9:info_hash20:<info_hash>4:porti6881e5:token8:<token>e1:q13:announce_peer1:t2:aa1:y1:qe
+// response:            d1:rd2:id20:<id>5:nodes26N:<compact node info>5:token8:<token>6:valuesl6:<peer>ee1:t2:aa1:y1:re
+// error:               d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee
+// Over IPv6 (BEP 32), nodes come as `nodes6` with 38 bytes each and peers in `values` take 18 bytes.
+// find_node and get_peers queries may list the families they want in `want`, as `n4` and `n6`:
+// find_node query:     d1:ad2:id20:<id>6:target20:<target>4:wantl2:n42:n6ee1:q9:find_node1:t2:aa1:y1:qe
+
+const (
+	queryPing         = "ping"
+	queryFindNode     = "find_node"
+	queryGetPeers     = "get_peers"
+	queryAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203 // such as a malformed packet, invalid arguments, or bad token
+	errMethodUnknown = 204
+)
+
+// krpcArgs are the arguments `a` of a query
+type krpcArgs struct {
+	ID          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"` // if 1, the source port of the UDP packet is used instead of `port`
+	Token       string   `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"` // families of the nodes wanted, `n4` and/or `n6`, by default the one of the query
+}
+
+// krpcReturn are the return values `r` of a response
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node info
+	Nodes6 string   `bencode:"nodes6,omitempty"` // compact node info of IPv6 nodes
+	Values []string `bencode:"values,omitempty"` // compact peer info
+	Token  string   `bencode:"token,omitempty"`
+}
+
+type krpcQuery struct {
+	T string   `bencode:"t"`
+	Y string   `bencode:"y"`
+	Q string   `bencode:"q"`
+	A krpcArgs `bencode:"a"`
+}
+
+type krpcResponse struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	R krpcReturn `bencode:"r"`
+}
+
+type krpcError struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"` // error code followed by error message
+}
+
+// krpcMessage is any KRPC message as decoded, only the fields matching `y` are set
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q"`
+	A krpcArgs      `bencode:"a"`
+	R krpcReturn    `bencode:"r"`
+	E []interface{} `bencode:"e"`
+}
+
+// Error is an error response of a remote node
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// encode bencodes any of krpcQuery, krpcResponse or krpcError
+func encode(msg interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decode parses a KRPC message
+func decode(buf []byte) (*krpcMessage, error) {
+	var msg krpcMessage
+	err := bencode.Unmarshal(bytes.NewReader(buf), &msg)
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Y {
+	case "q", "r", "e":
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Y)
+	}
+	return &msg, nil
+}
+
+// remoteError extracts the error of an error message
+func (m *krpcMessage) remoteError() *Error {
+	e := &Error{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(m.E) > 1 {
+		if message, ok := m.E[1].(string); ok {
+			e.Message = message
+		}
+	}
+	return e
+}
+
+// nodeInfo is the contact information of a node
+type nodeInfo struct {
+	ID   [20]byte
+	Addr *net.UDPAddr
+}
+
+// compact node info: <node ID 20><IPv4 address 4><port 2>, or <node ID 20><IPv6 address 16><port 2> in `nodes6`
+const (
+	compactNodeSize  = 26
+	compactNode6Size = 38
+)
+
+// encodeNodes encodes nodes into compact node info, skipping the ones without an IPv4 address
+func encodeNodes(nodes []nodeInfo) string {
+	return encodeNodesOf(nodes, net.IPv4len)
+}
+
+// encodeNodes6 encodes nodes into the compact node info of `nodes6`, skipping the ones with an IPv4 address
+func encodeNodes6(nodes []nodeInfo) string {
+	return encodeNodesOf(nodes, net.IPv6len)
+}
+
+func encodeNodesOf(nodes []nodeInfo, ipSize int) string {
+	buf := make([]byte, 0, (20+ipSize+2)*len(nodes))
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ipSize == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = n.Addr.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return string(buf)
+}
+
+// decodeNodes decodes compact node info
+func decodeNodes(s string) ([]nodeInfo, error) {
+	return decodeNodesOf(s, net.IPv4len)
+}
+
+// decodeNodes6 decodes the compact node info of `nodes6`
+func decodeNodes6(s string) ([]nodeInfo, error) {
+	return decodeNodesOf(s, net.IPv6len)
+}
+
+func decodeNodesOf(s string, ipSize int) ([]nodeInfo, error) {
+	size := 20 + ipSize + 2
+	if len(s)%size != 0 {
+		return nil, fmt.Errorf("received malformed nodes of length %d", len(s))
+	}
+	nodes := make([]nodeInfo, 0, len(s)/size)
+	for offset := 0; offset < len(s); offset += size {
+		var n nodeInfo
+		copy(n.ID[:], s[offset:offset+20])
+		n.Addr = &net.UDPAddr{
+			IP:   net.IP([]byte(s[offset+20 : offset+20+ipSize])),
+			Port: int(binary.BigEndian.Uint16([]byte(s[offset+20+ipSize : offset+size]))),
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// encodePeer encodes a peer into compact peer info, of 6 bytes for IPv4 or 18 bytes for IPv6
+func encodePeer(p peers.Peer) (string, bool) {
+	v4, v6 := peers.Marshal([]peers.Peer{p})
+	if v4 != nil {
+		return string(v4), true
+	}
+	return string(v6), v6 != nil
+}
+
+// decodePeers decodes the compact peer info of `values`, of either family, ignoring malformed entries
+func decodePeers(values []string) []peers.Peer {
+	var found []peers.Peer
+	for _, v := range values {
+		unmarshal := peers.Unmarshal
+		if len(v) == net.IPv6len+2 {
+			unmarshal = peers.Unmarshal6
+		}
+		p, err := unmarshal([]byte(v))
+		if err != nil {
+			continue
+		}
+		found = append(found, p...)
+	}
+	return found
+}
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"bittorrent-client-go/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	var tests = map[string]struct {
+		input  interface{}
+		output string
+	}{
+		"ping query": {
+			input:  krpcQuery{T: "aa", Y: "q", Q: queryPing, A: krpcArgs{ID: "abcdefghij0123456789"}},
+			output: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		"get_peers response": {
+			input:  krpcResponse{T: "aa", Y: "r", R: krpcReturn{ID: "abcdefghij0123456789", Token: "aoeusnth", Values: []string{"axje.u", "idhtnm"}}},
+			output: "d1:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+		},
+		"error": {
+			input:  krpcError{T: "aa", Y: "e", E: []interface{}{errGeneric, "A Generic Error Ocurred"}},
+			output: "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+	for name, test := range tests {
+		buf, err := encode(test.input)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, string(buf), name)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	msg, err := decode([]byte("d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz123456e1:q9:find_node1:t2:aa1:y1:qe"))
+	require.Nil(t, err)
+	assert.Equal(t, "q", msg.Y)
+	assert.Equal(t, queryFindNode, msg.Q)
+	assert.Equal(t, "mnopqrstuvwxyz123456", msg.A.Target)
+	msg, err = decode([]byte("d1:eli203e11:Bad Requeste1:t2:aa1:y1:ee"))
+	require.Nil(t, err)
+	assert.Equal(t, &Error{Code: errProtocol, Message: "Bad Request"}, msg.remoteError())
+	_, err = decode([]byte("d1:t2:aa1:y1:xe"))
+	assert.NotNil(t, err)
+	_, err = decode([]byte("garbage"))
+	assert.NotNil(t, err)
+}
+
+func TestNodes(t *testing.T) {
+	nodes := []nodeInfo{
+		{ID: [20]byte{1}, Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 6881}},
+		{ID: [20]byte{2}, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}, // only in nodes6
+		{ID: [20]byte{3}, Addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 80}},
+	}
+	encoded := encodeNodes(nodes)
+	assert.Len(t, encoded, 2*compactNodeSize)
+	decoded, err := decodeNodes(encoded)
+	require.Nil(t, err)
+	assert.Equal(t, []nodeInfo{nodes[0], nodes[2]}, decoded)
+	_, err = decodeNodes(encoded[1:])
+	assert.NotNil(t, err)
+
+	encoded = encodeNodes6(nodes)
+	assert.Len(t, encoded, compactNode6Size)
+	decoded, err = decodeNodes6(encoded)
+	require.Nil(t, err)
+	assert.Equal(t, []nodeInfo{nodes[1]}, decoded)
+}
+
+func TestPeers(t *testing.T) {
+	v, ok := encodePeer(peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 80})
+	assert.True(t, ok)
+	assert.Equal(t, string([]byte{127, 0, 0, 1, 0x00, 0x50}), v)
+	v6, ok := encodePeer(peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 80})
+	assert.True(t, ok)
+	assert.Len(t, v6, 18)
+	assert.Equal(t, []peers.Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 80},
+	}, decodePeers([]string{v, "short", v6}))
+}
@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the number of contacts in a bucket, and the number of closest nodes a lookup converges to
+const K = 8
+
+// maxFailures is the number of consecutive failed queries after which a contact is considered bad
+const maxFailures = 2
+
+// refreshInterval is how long a bucket may go unchanged before it is refreshed with a lookup
+var refreshInterval = 15 * time.Minute
+
+// contact is an entry of the routing table
+type contact struct {
+	nodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+// bucket holds up to K contacts sorted from least to most recently seen
+type bucket struct {
+	contacts    []*contact
+	lastChanged time.Time
+}
+
+// table is a Kademlia routing table, bucket `i` holds the contacts whose ID shares exactly `i` leading bits with ours
+type table struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160]bucket
+}
+
+func newTable(self [20]byte) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].lastChanged = now
+	}
+	return t
+}
+
+// distance returns the XOR distance between two IDs
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// commonPrefix returns the number of leading bits shared by two IDs
+func commonPrefix(a, b [20]byte) int {
+	d := distance(a, b)
+	for i, x := range d {
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// randomID returns a random ID sharing exactly `prefix` leading bits with `id`, for bucket refreshes
+func randomID(id [20]byte, prefix int) [20]byte {
+	var r [20]byte
+	_, _ = rand.Read(r[:])
+	for i := 0; i < prefix && i < 160; i++ { // copy the common prefix
+		mask := byte(1) << uint(7-i%8)
+		r[i/8] = r[i/8]&^mask | id[i/8]&mask
+	}
+	if prefix < 160 { // then differ on the next bit
+		mask := byte(1) << uint(7-prefix%8)
+		r[prefix/8] = r[prefix/8]&^mask | ^id[prefix/8]&mask
+	}
+	return r
+}
+
+// insert adds or refreshes a contact that just answered or queried us.
+// A full bucket only makes room by evicting a bad contact, since long-lived nodes are the most likely to stay
+func (t *table) insert(n nodeInfo) {
+	if n.ID == t.self || n.Addr == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[commonPrefix(t.self, n.ID)]
+	now := time.Now()
+	for i, c := range b.contacts {
+		if c.ID == n.ID {
+			c.Addr, c.lastSeen, c.failures = n.Addr, now, 0
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), c) // move to the tail
+			b.lastChanged = now
+			return
+		}
+	}
+	if len(b.contacts) >= K {
+		bad := -1
+		for i, c := range b.contacts {
+			if c.failures >= maxFailures {
+				bad = i
+				break
+			}
+		}
+		if bad < 0 {
+			return
+		}
+		b.contacts = append(b.contacts[:bad], b.contacts[bad+1:]...)
+	}
+	b.contacts = append(b.contacts, &contact{nodeInfo: n, lastSeen: now})
+	b.lastChanged = now
+}
+
+// failed records a query to a contact that went unanswered
+func (t *table) failed(id [20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.buckets[commonPrefix(t.self, id)].contacts {
+		if c.ID == id {
+			c.failures++
+			return
+		}
+	}
+}
+
+// closest returns up to `n` good contacts closest to `target`
+func (t *table) closest(target [20]byte, n int) []nodeInfo {
+	t.mu.Lock()
+	var all []nodeInfo
+	for i := range t.buckets {
+		for _, c := range t.buckets[i].contacts {
+			if c.failures < maxFailures {
+				all = append(all, c.nodeInfo)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// size returns the number of contacts in the table
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	size := 0
+	for i := range t.buckets {
+		size += len(t.buckets[i].contacts)
+	}
+	return size
+}
+
+// stale returns the indexes of the non-empty buckets that have not changed within refreshInterval
+func (t *table) stale() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var indexes []int
+	deadline := time.Now().Add(-refreshInterval)
+	for i := range t.buckets {
+		if len(t.buckets[i].contacts) > 0 && t.buckets[i].lastChanged.Before(deadline) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// touch marks a bucket as changed, after it has been refreshed
+func (t *table) touch(i int) {
+	t.mu.Lock()
+	t.buckets[i].lastChanged = time.Now()
+	t.mu.Unlock()
+}
+
+func sortByDistance(nodes []nodeInfo, target [20]byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di, dj := distance(nodes[i].ID, target), distance(nodes[j].ID, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// sameAddr tells if two UDP addresses are equal
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestCommonPrefix(t *testing.T) {
+	a := [20]byte{0b10110000}
+	assert.Equal(t, 160, commonPrefix(a, a))
+	assert.Equal(t, 0, commonPrefix(a, [20]byte{0b00110000}))
+	assert.Equal(t, 3, commonPrefix(a, [20]byte{0b10100000}))
+	b := a
+	b[19] = 1
+	assert.Equal(t, 159, commonPrefix(a, b))
+}
+
+func TestRandomID(t *testing.T) {
+	id := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	for prefix := 0; prefix < 160; prefix += 7 {
+		assert.Equal(t, prefix, commonPrefix(id, randomID(id, prefix)))
+	}
+}
+
+func TestTable_insert(t *testing.T) {
+	self := [20]byte{}
+	tb := newTable(self)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	tb.insert(nodeInfo{ID: self, Addr: addr}) // ourselves
+	assert.Equal(t, 0, tb.size())
+	for i := 0; i < K+2; i++ { // all share no prefix with us, so they go to bucket 0
+		tb.insert(nodeInfo{ID: [20]byte{0x80, byte(i)}, Addr: addr})
+	}
+	assert.Equal(t, K, tb.size()) // the bucket is full, newcomers are dropped
+	tb.failed([20]byte{0x80, 3})
+	tb.failed([20]byte{0x80, 3})
+	tb.insert(nodeInfo{ID: [20]byte{0x80, 0xff}, Addr: addr}) // replaces the bad contact
+	assert.Equal(t, K, tb.size())
+	ids := map[[20]byte]bool{}
+	for _, c := range tb.buckets[0].contacts {
+		ids[c.ID] = true
+	}
+	assert.False(t, ids[[20]byte{0x80, 3}])
+	assert.True(t, ids[[20]byte{0x80, 0xff}])
+	tb.insert(nodeInfo{ID: [20]byte{0x80, 0}, Addr: addr}) // seen again, moves to the tail
+	assert.Equal(t, [20]byte{0x80, 0}, tb.buckets[0].contacts[K-1].ID)
+}
+
+func TestTable_closest(t *testing.T) {
+	tb := newTable([20]byte{})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	for _, first := range []byte{0x01, 0x02, 0x10, 0x20, 0x80} {
+		tb.insert(nodeInfo{ID: [20]byte{first}, Addr: addr})
+	}
+	closest := tb.closest([20]byte{0x03}, 3)
+	assert.Equal(t, [][20]byte{{0x02}, {0x01}, {0x10}}, []([20]byte){closest[0].ID, closest[1].ID, closest[2].ID})
+	assert.Len(t, tb.closest([20]byte{}, 100), 5)
+}
+
+func TestTable_stale(t *testing.T) {
+	tb := newTable([20]byte{})
+	assert.Empty(t, tb.stale())
+	tb.insert(nodeInfo{ID: [20]byte{0x01}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}})
+	interval := refreshInterval
+	refreshInterval = 0
+	defer func() {
+		refreshInterval = interval
+	}()
+	assert.Equal(t, []int{7}, tb.stale())
+	tb.touch(7)
+}
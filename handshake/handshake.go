@@ -14,6 +14,38 @@ type Handshake struct { // handshake: <pstrlen><pstr><reserved><info_hash><peer_
 	PeerID     [20]byte
 }
 
+// Capability is a bit of the reserved bytes, set in the handshake to announce support for a protocol extension.
+// An extension is used on a connection only when both handshakes announce it
+type Capability struct {
+	index int  // byte of the reserved bytes
+	mask  byte // bit within that byte
+}
+
+var (
+	DHT               = Capability{index: 7, mask: 0x01} // DHT port message (BEP 5)
+	FastExtension     = Capability{index: 7, mask: 0x04} // Fast extension (BEP 6)
+	ExtensionProtocol = Capability{index: 5, mask: 0x10} // Extension protocol (BEP 10)
+)
+
+// Reserved returns the reserved bytes announcing the given capabilities
+func Reserved(capabilities ...Capability) [8]byte {
+	var reserved [8]byte
+	for _, c := range capabilities {
+		reserved[c.index] |= c.mask
+	}
+	return reserved
+}
+
+// IsSet tells if the capability is announced by the given reserved bytes
+func (c Capability) IsSet(reserved [8]byte) bool {
+	return reserved[c.index]&c.mask != 0
+}
+
+// Supports tells if the handshake announces a capability
+func (h *Handshake) Supports(c Capability) bool {
+	return c.IsSet(h.Reserved)
+}
+
 // Serialize serializes the handshake to a buffer
 func (h *Handshake) Serialize() ([]byte, error) {
 	length := 1 + len(h.Pstr) + 8 + 20 + 20
@@ -63,13 +95,16 @@ func Read(r io.Reader) (*Handshake, error) {
 	if err != nil {
 		return nil, err
 	}
+	var reserved [8]byte
 	var infoHash [20]byte
 	var peerID [20]byte
+	_ = copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	_ = copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	_ = copy(peerID[:], handshakeBuf[pstrLen+8+20:])
 	h := &Handshake{
 		PstrLength: lengthBuf[0],
 		Pstr:       string(handshakeBuf[0:pstrLen]),
+		Reserved:   reserved,
 		InfoHash:   infoHash,
 		PeerID:     peerID,
 	}
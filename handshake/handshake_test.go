@@ -66,6 +66,17 @@ func TestRead(t *testing.T) {
 			},
 			failure: false,
 		},
+		"reserved bytes are kept": {
+			input: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x05, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			output: &Handshake{
+				Pstr:       "BitTorrent protocol",
+				Reserved:   [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+				InfoHash:   [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:     [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+				PstrLength: byte(19),
+			},
+			failure: false,
+		},
 		"empty": {
 			input:   []byte{},
 			output:  nil,
@@ -94,3 +105,33 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, m)
 	}
 }
+
+func TestReserved(t *testing.T) {
+	var tests = map[string]struct {
+		input  []Capability
+		output [8]byte
+	}{
+		"none": {
+			input:  nil,
+			output: [8]byte{0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		"extension protocol": {
+			input:  []Capability{ExtensionProtocol},
+			output: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0},
+		},
+		"several in the same byte": {
+			input:  []Capability{DHT, FastExtension, ExtensionProtocol},
+			output: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.output, Reserved(test.input...))
+	}
+}
+
+func TestHandshake_Supports(t *testing.T) {
+	h := &Handshake{Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x01}}
+	assert.True(t, h.Supports(ExtensionProtocol))
+	assert.True(t, h.Supports(DHT))
+	assert.False(t, h.Supports(FastExtension))
+}
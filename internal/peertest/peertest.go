@@ -0,0 +1,67 @@
+// Package peertest provides a fake peer for the tests of the packages talking to peers
+package peertest
+
+import (
+	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/message"
+	"bittorrent-client-go/peers"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// PeerID is the peer id of every fake peer
+var PeerID = [20]byte{'p'}
+
+// Serve accepts connections of peers of the torrent `infoHash` on a loopback port until the test ends.
+// It completes the handshake with the `reserved` bits, sends the `hello` messages, e.g. a bitfield,
+// then calls `onMessage` with every message but keep-alives, from one goroutine per connection,
+// until it returns an error or the connection fails. Messages are read and dropped when `onMessage` is nil
+func Serve(t *testing.T, infoHash [20]byte, reserved [8]byte, hello []*message.Message, onMessage func(conn net.Conn, msg *message.Message) error) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	var greeting []byte
+	for _, msg := range hello {
+		greeting = append(greeting, msg.Serialize()...)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, infoHash, reserved, greeting, onMessage)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveConn(conn net.Conn, infoHash [20]byte, reserved [8]byte, greeting []byte, onMessage func(conn net.Conn, msg *message.Message) error) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+	if _, err := handshake.Read(conn); err != nil {
+		return
+	}
+	h, _ := handshake.New(infoHash, PeerID, reserved)
+	buf, _ := h.Serialize()
+	if _, err := conn.Write(append(buf, greeting...)); err != nil {
+		return
+	}
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg.Prefix == 0 || onMessage == nil {
+			continue
+		}
+		if onMessage(conn, msg) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A magnet link identifies a torrent by its info hash only (BEP 9), e.g.
+// magnet:?xt=urn:btih:<info-hash>&dn=<name>&tr=<tracker-url>&x.pe=<peer-address>&ws=<web-seed-url>
+
+// Magnet holds the parameters of a magnet link
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // display name, only a hint until the metadata is fetched
+	Trackers []string // tracker URLs
+	Peers    []string // peer addresses in the form host:port
+	WebSeeds []string // web seed URLs (BEP 19), parsed but not used for downloading
+}
+
+// Parse parses a magnet link, only `urn:btih:` (BitTorrent v1) info hashes are supported
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected scheme magnet, got %q", u.Scheme)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	m := &Magnet{}
+	found := false
+	for _, xt := range params["xt"] { // there may be other exact topics, e.g. `urn:btmh:` for BitTorrent v2
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("no urn:btih: exact topic in magnet link")
+	}
+	m.Name = params.Get("dn")
+	m.Trackers = params["tr"]
+	m.WebSeeds = params["ws"]
+	for _, peer := range params["x.pe"] {
+		_, port, err := net.SplitHostPort(peer)
+		if err != nil || port == "" {
+			return nil, fmt.Errorf("invalid peer address %q", peer)
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	return m, nil
+}
+
+// parseInfoHash decodes an info hash in hex (40 characters) or base32 (32 characters)
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("expected info hash of 40 hex or 32 base32 characters, got %d", len(s))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("malformed info hash %q: %w", s, err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// String formats the magnet link back into a URI
+func (m *Magnet) String() string {
+	params := url.Values{}
+	params.Set("xt", "urn:btih:"+hex.EncodeToString(m.InfoHash[:]))
+	if m.Name != "" {
+		params.Set("dn", m.Name)
+	}
+	params["tr"] = m.Trackers
+	params["x.pe"] = m.Peers
+	params["ws"] = m.WebSeeds
+	return "magnet:?" + params.Encode()
+}
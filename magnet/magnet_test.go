@@ -0,0 +1,72 @@
+package magnet
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{0x12, 0xd8, 0xf5, 0xed, 0x6a, 0xe7, 0x6e, 0x10, 0x53, 0x92, 0x87, 0x1f, 0x2f, 0x40, 0x46, 0xff, 0xea, 0x8b, 0x9e, 0x0d}
+	var tests = map[string]struct {
+		input   string
+		output  *Magnet
+		failure bool
+	}{
+		"hex info hash with every parameter": {
+			input: "magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0d&dn=debian-edu-12.6.0-amd64-netinst.iso" +
+				"&tr=http%3A%2F%2Fbttracker.debian.org%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.example.org%3A1337" +
+				"&x.pe=192.0.2.123:6881&x.pe=[2001:db8::1]:6889&ws=https%3A%2F%2Fcdimage.debian.org%2F",
+			output: &Magnet{
+				InfoHash: infoHash,
+				Name:     "debian-edu-12.6.0-amd64-netinst.iso",
+				Trackers: []string{"http://bttracker.debian.org:6969/announce", "udp://tracker.example.org:1337"},
+				Peers:    []string{"192.0.2.123:6881", "[2001:db8::1]:6889"},
+				WebSeeds: []string{"https://cdimage.debian.org/"},
+			},
+		},
+		"base32 info hash": {
+			input:  "magnet:?xt=urn:btih:CLMPL3LK45XBAU4SQ4PS6QCG77VIXHQN",
+			output: &Magnet{InfoHash: infoHash},
+		},
+		"lowercase base32 info hash among other exact topics": {
+			input:  "magnet:?xt=urn:btmh:1220abcd&xt=urn:btih:clmpl3lk45xbau4sq4ps6qcg77vixhqn",
+			output: &Magnet{InfoHash: infoHash},
+		},
+		"not a magnet link": {
+			input:   "http://bttracker.debian.org:6969/announce",
+			failure: true,
+		},
+		"no info hash": {
+			input:   "magnet:?dn=debian",
+			failure: true,
+		},
+		"malformed info hash": {
+			input:   "magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0z",
+			failure: true,
+		},
+		"info hash of wrong length": {
+			input:   "magnet:?xt=urn:btih:12d8f5",
+			failure: true,
+		},
+		"peer without port": {
+			input:   "magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0d&x.pe=192.0.2.123",
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		m, err := Parse(test.input)
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestMagnet_String(t *testing.T) {
+	input := "magnet:?dn=debian&tr=udp%3A%2F%2Ftracker.example.org%3A1337&x.pe=192.0.2.123%3A6881&xt=urn%3Abtih%3A12d8f5ed6ae76e105392871f2f4046ffea8b9e0d"
+	m, err := Parse(input)
+	assert.Nil(t, err)
+	assert.Equal(t, input, m.String())
+}
@@ -1,20 +1,200 @@
 package main
 
 import (
+	"bittorrent-client-go/p2p"
 	"bittorrent-client-go/torrentfile"
+	"bittorrent-client-go/tracker"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	inPath := os.Args[1]
+	// Ctrl-C stops the download, flushes what was verified and announces `stopped`, or stops seeding or the tracker,
+	// a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		seed(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scrape" {
+		scrape(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tracker" {
+		serveTracker(ctx, os.Args[2:])
+		return
+	}
+	if len(os.Args) != 3 {
+		log.Fatal("usage: btclient <torrent|magnet> <path>\n       btclient seed <torrent> <path>\n       btclient scrape <torrent|magnet>...\n       btclient tracker [address]")
+	}
+	inPath := os.Args[1] // path to a .torrent file, or a magnet link
 	outPath := os.Args[2]
-	tf, err := torrentfile.Open(inPath)
+	tf, err := open(ctx, inPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tf.Monitor = &p2p.Monitor{}
+	tf.Monitor.Subscribe(logProgress(tf.Name, tf.Monitor))
+	err = tf.DownloadToFile(ctx, outPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// logProgress returns a subscriber logging what happens to the torrent `name`, with the stats of the download
+func logProgress(name string, m *p2p.Monitor) func(p2p.Event) {
+	return func(e p2p.Event) {
+		switch e.Type {
+		case p2p.DownloadStarted:
+			s := m.Stats()
+			switch {
+			case s.CompletedPieces == s.Pieces:
+				log.Printf("%s is already complete\n", name)
+			case s.CompletedPieces > 0:
+				log.Printf("resuming download for %s with %d/%d pieces\n", name, s.CompletedPieces, s.Pieces)
+			default:
+				log.Printf("starting download for %s\n", name)
+			}
+		case p2p.PieceVerified:
+			s := m.Stats()
+			percent := float64(s.CompletedPieces) / float64(s.Pieces) * 100
+			eta := "unknown"
+			if s.ETA >= 0 {
+				eta = s.ETA.Round(time.Second).String()
+			}
+			log.Printf("(%0.2f%%) downloaded piece #%d from %d peers at %.1f KiB/s, ETA %s\n", percent, e.Piece, s.Peers, s.DownloadRate/1024, eta)
+		case p2p.PieceFailed:
+			log.Printf("piece #%d from %s failed integrity check\n", e.Piece, e.Peer)
+		case p2p.Endgame:
+			s := m.Stats()
+			log.Printf("entering endgame with %d pieces left\n", s.Pieces-s.CompletedPieces)
+		case p2p.PeerConnected:
+			log.Printf("completed handshake with %s\n", e.Peer)
+		case p2p.PeerDisconnected:
+			if e.Err != nil {
+				log.Printf("disconnecting %s: %s\n", e.Peer, e.Err)
+			}
+		case p2p.PeerBanned:
+			log.Printf("banned %s after repeated failed connections\n", e.Peer)
+		case p2p.Choke:
+			if e.Err != nil {
+				log.Printf("could not update choke state of %s: %s\n", e.Peer, e.Err)
+			}
+		case p2p.TrackerWarning:
+			log.Printf("tracker %s warns: %s\n", e.Tracker, e.Warning)
+		case p2p.DHTAnnounce:
+			if e.Err != nil {
+				log.Printf("DHT: %s\n", e.Err)
+			}
+		case p2p.PeerExchange:
+			if e.Err != nil {
+				log.Printf("could not exchange peers with %s: %s\n", e.Peer, e.Err)
+			}
+		}
+	}
+}
+
+// seed uploads a completed download to other peers until interrupted
+func seed(ctx context.Context, args []string) {
+	if len(args) != 2 {
+		log.Fatal("usage: btclient seed <torrent> <path>")
+	}
+	tf, err := open(ctx, args[0])
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = tf.DownloadToFile(outPath)
+	tf.Monitor = &p2p.Monitor{}
+	tf.Monitor.Subscribe(logProgress(tf.Name, tf.Monitor))
+	err = tf.Seed(ctx, args[1])
+	if err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
+
+// scrape prints the number of seeders, leechers and completed downloads of torrents, as reported by their trackers
+func scrape(ctx context.Context, args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: btclient scrape <torrent|magnet>...")
+	}
+	failed := false
+	for _, in := range args {
+		var tf torrentfile.TorrentFile
+		var err error
+		if strings.HasPrefix(in, "magnet:") { // the trackers only need the info hash, not the metadata
+			tf, err = torrentfile.ParseMagnet(in)
+		} else {
+			tf, err = torrentfile.Open(in)
+		}
+		if err == nil {
+			var result torrentfile.ScrapeResult
+			result, err = tf.Scrape(ctx)
+			if err == nil {
+				fmt.Printf("%s: %d seeders, %d leechers, %d downloaded\n", in, result.Complete, result.Incomplete, result.Downloaded)
+				continue
+			}
+		}
+		log.Printf("%s: %v\n", in, err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// serveTracker runs a tracker over HTTP and UDP until interrupted, on :6969 unless told otherwise
+func serveTracker(ctx context.Context, args []string) {
+	if len(args) > 1 {
+		log.Fatal("usage: btclient tracker [address]")
+	}
+	addr := ":6969"
+	if len(args) == 1 {
+		addr = args[0]
+	}
+	swarms := tracker.NewSwarms() // shared by both protocols
+	udp, err := tracker.ListenUDP(addr, swarms)
 	if err != nil {
 		log.Fatal(err)
 	}
+	server := &http.Server{Addr: addr, Handler: tracker.NewHandler(swarms)}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		_ = udp.Close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second) // lets pending announces finish
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		err := udp.Serve()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("tracker announce URLs: http://%s/announce udp://%s\n", addr, addr)
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+func open(ctx context.Context, in string) (torrentfile.TorrentFile, error) {
+	if strings.HasPrefix(in, "magnet:") {
+		return torrentfile.OpenMagnet(ctx, in)
+	}
+	return torrentfile.Open(in)
 }
@@ -11,16 +11,29 @@ type ID uint8
 // the keep-alive message is a message with zero bytes, specified with the length prefix set to zero
 // keep-alive: <len=0000>
 const (
-	MsgChoke         ID = 0 // choke: <len=0001><id=0>
-	MsgUnchoke       ID = 1 // unchoke: <len=0001><id=1>
-	MsgInterested    ID = 2 // interested: <len=0001><id=2>
-	MsgNotInterested ID = 3 // not interested: <len=0001><id=3>
-	MsgHave          ID = 4 // have: <len=0005><id=4><piece index>
-	MsgBitfield      ID = 5 // bitfield: <len=0001+X><id=5><bitfield>
-	MsgRequest       ID = 6 // request: <len=0013><id=6><index><begin><length>
-	MsgPiece         ID = 7 // piece: <len=0009+X><id=7><index><begin><block>
-	MsgCancel        ID = 8 // cancel: <len=0013><id=8><index><begin><length>
-	MsgPort          ID = 9 // port: <len=0003><id=9><listen-port>
+	MsgChoke         ID = 0  // choke: <len=0001><id=0>
+	MsgUnchoke       ID = 1  // unchoke: <len=0001><id=1>
+	MsgInterested    ID = 2  // interested: <len=0001><id=2>
+	MsgNotInterested ID = 3  // not interested: <len=0001><id=3>
+	MsgHave          ID = 4  // have: <len=0005><id=4><piece index>
+	MsgBitfield      ID = 5  // bitfield: <len=0001+X><id=5><bitfield>
+	MsgRequest       ID = 6  // request: <len=0013><id=6><index><begin><length>
+	MsgPiece         ID = 7  // piece: <len=0009+X><id=7><index><begin><block>
+	MsgCancel        ID = 8  // cancel: <len=0013><id=8><index><begin><length>
+	MsgPort          ID = 9  // port: <len=0003><id=9><listen-port>
+	MsgSuggest       ID = 13 // suggest piece: <len=0005><id=13><piece index> (BEP 6)
+	MsgHaveAll       ID = 14 // have all: <len=0001><id=14> (BEP 6)
+	MsgHaveNone      ID = 15 // have none: <len=0001><id=15> (BEP 6)
+	MsgReject        ID = 16 // reject request: <len=0013><id=16><index><begin><length> (BEP 6)
+	MsgAllowedFast   ID = 17 // allowed fast: <len=0005><id=17><piece index> (BEP 6)
+	MsgExtended      ID = 20 // extended: <len=0002+X><id=20><extended message ID><payload> (BEP 10)
+)
+
+// MaxLength is the largest message Read accepts, a `piece` message with a block of 128 KiB, the most peers may request.
+// Bitfields may be larger, up to MaxBitfieldLength, that is 2^24 pieces
+const (
+	MaxLength         uint32 = 9 + 128*1024
+	MaxBitfieldLength uint32 = 1 + 1<<21
 )
 
 // Message stores ID and payload of a message
@@ -43,17 +56,71 @@ func FormatRequest(index int, begin int, length int) *Message {
 	}
 }
 
+// FormatCancel creates a `cancel` message, withdrawing a `request` made with the same arguments
+func FormatCancel(index int, begin int, length int) *Message {
+	var msg = FormatRequest(index, begin, length)
+	msg.MessageID = MsgCancel
+	return msg
+}
+
+// FormatReject creates a `reject request` message, refusing a `request` made with the same arguments
+func FormatReject(index int, begin int, length int) *Message {
+	var msg = FormatRequest(index, begin, length)
+	msg.MessageID = MsgReject
+	return msg
+}
+
 // FormatHave creates a `have` message
 func FormatHave(index int) *Message {
+	return formatIndex(MsgHave, index)
+}
+
+// FormatSuggest creates a `suggest piece` message
+func FormatSuggest(index int) *Message {
+	return formatIndex(MsgSuggest, index)
+}
+
+// FormatAllowedFast creates an `allowed fast` message
+func FormatAllowedFast(index int) *Message {
+	return formatIndex(MsgAllowedFast, index)
+}
+
+// formatIndex creates a message whose payload is a single piece index
+func formatIndex(id ID, index int) *Message {
 	var payload = make([]byte, 4)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
 	return &Message{
 		Prefix:    uint32(1 + 4),
-		MessageID: MsgHave,
+		MessageID: id,
+		Payload:   payload,
+	}
+}
+
+// FormatPiece creates a `piece` message
+func FormatPiece(index int, begin int, block []byte) *Message {
+	var payload = make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	_ = copy(payload[8:], block)
+	return &Message{
+		Prefix:    uint32(1 + len(payload)),
+		MessageID: MsgPiece,
 		Payload:   payload,
 	}
 }
 
+// FormatExtended creates an `extended` message
+func FormatExtended(extendedID uint8, payload []byte) *Message {
+	var buf = make([]byte, 1+len(payload))
+	buf[0] = extendedID
+	_ = copy(buf[1:], payload)
+	return &Message{
+		Prefix:    uint32(1 + len(buf)),
+		MessageID: MsgExtended,
+		Payload:   buf,
+	}
+}
+
 // Serialize serializes a message into a buffer of the form <length prefix><message ID><payload>
 // interprets `nil` as a keep-alive message
 func (m *Message) Serialize() []byte {
@@ -70,8 +137,23 @@ func (m *Message) Serialize() []byte {
 
 // ParseHave parses a `have` message
 func ParseHave(msg *Message) (int, error) {
-	if msg.MessageID != MsgHave {
-		return 0, fmt.Errorf("expected have (<id=%d>) message, got %d", MsgHave, msg.MessageID)
+	return parseIndex(MsgHave, "have", msg)
+}
+
+// ParseSuggest parses a `suggest piece` message
+func ParseSuggest(msg *Message) (int, error) {
+	return parseIndex(MsgSuggest, "suggest piece", msg)
+}
+
+// ParseAllowedFast parses an `allowed fast` message
+func ParseAllowedFast(msg *Message) (int, error) {
+	return parseIndex(MsgAllowedFast, "allowed fast", msg)
+}
+
+// parseIndex parses the <piece index> payload shared by `have`, `suggest piece` and `allowed fast` messages
+func parseIndex(id ID, name string, msg *Message) (int, error) {
+	if msg.MessageID != id {
+		return 0, fmt.Errorf("expected %s (<id=%d>) message, got %d", name, id, msg.MessageID)
 	}
 	if len(msg.Payload) != 5-1 {
 		return 0, fmt.Errorf("expected <piece index> length %d, got %d", 5-1, len(msg.Payload))
@@ -79,6 +161,48 @@ func ParseHave(msg *Message) (int, error) {
 	return int(binary.BigEndian.Uint32(msg.Payload[0:4])), nil
 }
 
+// ParseRequest parses a `request` message
+func ParseRequest(msg *Message) (index int, begin int, length int, err error) {
+	return parseBlockRequest(MsgRequest, "request", msg)
+}
+
+// ParseCancel parses a `cancel` message
+func ParseCancel(msg *Message) (index int, begin int, length int, err error) {
+	return parseBlockRequest(MsgCancel, "cancel", msg)
+}
+
+// ParseReject parses a `reject request` message
+func ParseReject(msg *Message) (index int, begin int, length int, err error) {
+	return parseBlockRequest(MsgReject, "reject request", msg)
+}
+
+// parseBlockRequest parses the <index><begin><length> payload shared by `request`, `cancel` and `reject request` messages
+func parseBlockRequest(id ID, name string, msg *Message) (index int, begin int, length int, err error) {
+	if msg.MessageID != id {
+		return 0, 0, 0, fmt.Errorf("expected %s (<id=%d>) message, got <id=%d>", name, id, msg.MessageID)
+	}
+	if len(msg.Payload) != 13-1 {
+		return 0, 0, 0, fmt.Errorf("expected payload length %d, got %d", 13-1, len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParseBlock parses a `piece` message into its piece index, offset and block, without copying the block
+func ParseBlock(msg *Message) (index int, begin int, block []byte, err error) {
+	if msg.MessageID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("expected piece (<id=%d>) message, got <id=%d>", MsgPiece, msg.MessageID)
+	}
+	if len(msg.Payload) < 9-1 {
+		return 0, 0, nil, fmt.Errorf("payload too short, %d < %d", len(msg.Payload), 9-1)
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
 // ParsePiece parses a `piece` message and copies its payload into a buffer
 func ParsePiece(index int, msg *Message, buf []byte) (int, error) {
 	if msg.MessageID != MsgPiece {
@@ -102,19 +226,43 @@ func ParsePiece(index int, msg *Message, buf []byte) (int, error) {
 	return copy(buf[begin:], data), nil
 }
 
-// Read parses a message from a stream
+// ParseExtended parses an `extended` message into its extended message ID and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.MessageID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended (<id=%d>) message, got <id=%d>", MsgExtended, msg.MessageID)
+	}
+	if len(msg.Payload) < 2-1 {
+		return 0, nil, fmt.Errorf("payload too short, %d < %d", len(msg.Payload), 2-1)
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// Read parses a message from a stream. Messages longer than MaxLength, or MaxBitfieldLength for bitfields,
+// are rejected before being read, so that a peer cannot make us allocate gigabytes with a single length prefix
 func Read(r io.Reader) (*Message, error) {
-	lengthBuf := make([]byte, 4)
-	_, err := io.ReadFull(r, lengthBuf)
+	headerBuf := make([]byte, 5)
+	_, err := io.ReadFull(r, headerBuf[:4])
 	if err != nil {
 		return nil, err
 	}
-	length := binary.BigEndian.Uint32(lengthBuf)
+	length := binary.BigEndian.Uint32(headerBuf)
 	if length == uint32(0) { // keep-alive message
 		return &Message{Prefix: length}, nil
 	}
+	_, err = io.ReadFull(r, headerBuf[4:])
+	if err != nil {
+		return nil, err
+	}
+	limit := MaxLength
+	if ID(headerBuf[4]) == MsgBitfield {
+		limit = MaxBitfieldLength
+	}
+	if length > limit {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d", length, limit)
+	}
 	messageBuf := make([]byte, length)
-	_, err = io.ReadFull(r, messageBuf)
+	messageBuf[0] = headerBuf[4]
+	_, err = io.ReadFull(r, messageBuf[1:])
 	if err != nil {
 		return nil, err
 	}
@@ -153,6 +301,18 @@ func (m *Message) name() string {
 		return "cancel"
 	case MsgPort:
 		return "port"
+	case MsgSuggest:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
 	default:
 		return fmt.Sprintf("unknown (<id=%d>)", m.MessageID)
 	}
@@ -2,7 +2,9 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -23,6 +25,8 @@ func TestMessage_String(t *testing.T) {
 		{input: &Message{Prefix: uint32(1 + 4 + 4 + 1), MessageID: MsgPiece, Payload: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1}}, output: "<message ID> 7 (piece), <payload> length 9"},
 		{input: &Message{Prefix: uint32(1 + 4 + 4 + 4), MessageID: MsgCancel, Payload: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4}}, output: "<message ID> 8 (cancel), <payload> length 12"},
 		{input: &Message{Prefix: uint32(1 + 2), MessageID: MsgPort, Payload: []byte{12, 34}}, output: "<message ID> 9 (port), <payload> length 2"},
+		{input: &Message{Prefix: uint32(1), MessageID: MsgHaveAll}, output: "<message ID> 14 (have all), <payload> length 0"},
+		{input: &Message{Prefix: uint32(1 + 4 + 4 + 4), MessageID: MsgReject, Payload: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4}}, output: "<message ID> 16 (reject request), <payload> length 12"},
 		{input: &Message{Prefix: uint32(99), MessageID: 88, Payload: []byte{123, 32}}, output: "<message ID> 88 (unknown (<id=88>)), <payload> length 2"},
 	}
 	for _, test := range tests {
@@ -69,6 +73,26 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestRead_oversized(t *testing.T) {
+	tests := map[string][]byte{
+		"4 GiB prefix":       {0xff, 0xff, 0xff, 0xff, byte(MsgPiece)},
+		"piece over a block": binary.BigEndian.AppendUint32(nil, MaxLength+1),
+		"bitfield":           binary.BigEndian.AppendUint32(nil, MaxBitfieldLength+1),
+	}
+	tests["piece over a block"] = append(tests["piece over a block"], byte(MsgPiece))
+	tests["bitfield"] = append(tests["bitfield"], byte(MsgBitfield))
+	for name, input := range tests {
+		_, err := Read(bytes.NewReader(input)) // rejected before the payload is allocated or read
+		assert.ErrorContains(t, err, "is longer than", name)
+	}
+
+	bf := make([]byte, 200*1024) // more than a block, for a torrent with 1638400 pieces
+	input := append(binary.BigEndian.AppendUint32(nil, uint32(1+len(bf))), byte(MsgBitfield))
+	m, err := Read(bytes.NewReader(append(input, bf...)))
+	require.Nil(t, err)
+	assert.Len(t, m.Payload, len(bf))
+}
+
 func TestFormatRequest(t *testing.T) {
 	msg := FormatRequest(4, 567, 4321)
 	expected := &Message{
@@ -83,6 +107,20 @@ func TestFormatRequest(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		MessageID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // index
+			0x00, 0x00, 0x02, 0x37, // begin
+			0x00, 0x00, 0x10, 0xe1, // length
+		},
+		Prefix: uint32(13),
+	}
+	assert.Equal(t, expected, msg)
+}
+
 func TestFormatHave(t *testing.T) {
 	msg := FormatHave(4)
 	expected := &Message{
@@ -93,6 +131,64 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatSuggest(t *testing.T) {
+	msg := FormatSuggest(4)
+	expected := &Message{
+		Prefix:    uint32(1 + 4),
+		MessageID: MsgSuggest,
+		Payload:   []byte{0x00, 0x00, 0x00, 0x04},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatAllowedFast(t *testing.T) {
+	msg := FormatAllowedFast(4)
+	expected := &Message{
+		Prefix:    uint32(1 + 4),
+		MessageID: MsgAllowedFast,
+		Payload:   []byte{0x00, 0x00, 0x00, 0x04},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatReject(t *testing.T) {
+	msg := FormatReject(4, 567, 4321)
+	expected := &Message{
+		MessageID: MsgReject,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // index
+			0x00, 0x00, 0x02, 0x37, // begin
+			0x00, 0x00, 0x10, 0xe1, // length
+		},
+		Prefix: uint32(13),
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte{0xaa, 0xbb})
+	expected := &Message{
+		Prefix:    uint32(1 + 8 + 2),
+		MessageID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x02, 0x37,
+			0xaa, 0xbb,
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatExtended(t *testing.T) {
+	msg := FormatExtended(3, []byte("d8:msg_typei0e5:piecei0ee"))
+	expected := &Message{
+		Prefix:    uint32(1 + 1 + 25),
+		MessageID: MsgExtended,
+		Payload:   append([]byte{3}, "d8:msg_typei0e5:piecei0ee"...),
+	}
+	assert.Equal(t, expected, msg)
+}
+
 func TestMessage_Serialize(t *testing.T) {
 	var tests = map[string]struct {
 		input  *Message
@@ -150,6 +246,175 @@ func TestParseHave(t *testing.T) {
 	}
 }
 
+func TestParseAllowedFast(t *testing.T) {
+	index, err := ParseAllowedFast(FormatAllowedFast(7))
+	assert.Nil(t, err)
+	assert.Equal(t, 7, index)
+	_, err = ParseAllowedFast(FormatHave(7))
+	assert.NotNil(t, err)
+	index, err = ParseSuggest(FormatSuggest(3))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, index)
+}
+
+func TestParseReject(t *testing.T) {
+	index, begin, length, err := ParseReject(FormatReject(4, 567, 16384))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 16384}, []int{index, begin, length})
+	_, _, _, err = ParseReject(FormatCancel(4, 567, 16384))
+	assert.NotNil(t, err)
+}
+
+func TestParseRequest(t *testing.T) {
+	var tests = map[string]struct {
+		input   *Message
+		index   int
+		begin   int
+		length  int
+		failure bool
+	}{
+		"valid message": {
+			input:   FormatRequest(4, 567, 16384),
+			index:   4,
+			begin:   567,
+			length:  16384,
+			failure: false,
+		},
+		"wrong message type": {
+			input:   &Message{MessageID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04}, Prefix: uint32(5)},
+			failure: true,
+		},
+		"payload too short": {
+			input:   &Message{MessageID: MsgRequest, Payload: []byte{0x00, 0x00, 0x00, 0x04}, Prefix: uint32(5)},
+			failure: true,
+		},
+	}
+	for _, test := range tests {
+		index, begin, length, err := ParseRequest(test.input)
+		if test.failure {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.index, index)
+		assert.Equal(t, test.begin, begin)
+		assert.Equal(t, test.length, length)
+	}
+}
+
+func TestParseCancel(t *testing.T) {
+	var tests = map[string]struct {
+		input   *Message
+		index   int
+		begin   int
+		length  int
+		failure bool
+	}{
+		"valid message": {
+			input:   FormatCancel(4, 567, 16384),
+			index:   4,
+			begin:   567,
+			length:  16384,
+			failure: false,
+		},
+		"request is not a cancel": {
+			input:   FormatRequest(4, 567, 16384),
+			failure: true,
+		},
+		"payload too short": {
+			input:   &Message{MessageID: MsgCancel, Payload: []byte{0x00, 0x00, 0x00, 0x04}, Prefix: uint32(5)},
+			failure: true,
+		},
+	}
+	for _, test := range tests {
+		index, begin, length, err := ParseCancel(test.input)
+		if test.failure {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.index, index)
+		assert.Equal(t, test.begin, begin)
+		assert.Equal(t, test.length, length)
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	var tests = map[string]struct {
+		input   *Message
+		index   int
+		begin   int
+		block   []byte
+		failure bool
+	}{
+		"valid message": {
+			input: FormatPiece(4, 567, []byte{0xaa, 0xbb}),
+			index: 4,
+			begin: 567,
+			block: []byte{0xaa, 0xbb},
+		},
+		"wrong message type": {
+			input:   FormatRequest(4, 567, 16384),
+			failure: true,
+		},
+		"payload too short": {
+			input:   &Message{MessageID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x04}, Prefix: uint32(5)},
+			failure: true,
+		},
+	}
+	for _, test := range tests {
+		index, begin, block, err := ParseBlock(test.input)
+		if test.failure {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.index, index)
+		assert.Equal(t, test.begin, begin)
+		assert.Equal(t, test.block, block)
+	}
+}
+
+func TestParseExtended(t *testing.T) {
+	var tests = map[string]struct {
+		input      *Message
+		extendedID uint8
+		payload    []byte
+		failure    bool
+	}{
+		"extended handshake": {
+			input:      &Message{MessageID: MsgExtended, Payload: []byte("\x00de"), Prefix: uint32(4)},
+			extendedID: 0,
+			payload:    []byte("de"),
+			failure:    false,
+		},
+		"empty payload": {
+			input:      &Message{MessageID: MsgExtended, Payload: []byte{7}, Prefix: uint32(2)},
+			extendedID: 7,
+			payload:    []byte{},
+			failure:    false,
+		},
+		"wrong message type": {
+			input:   &Message{MessageID: MsgHave, Payload: []byte{0x00, 0x00, 0x00, 0x04}, Prefix: uint32(5)},
+			failure: true,
+		},
+		"payload too short": {
+			input:   &Message{MessageID: MsgExtended, Payload: []byte{}, Prefix: uint32(1)},
+			failure: true,
+		},
+	}
+	for _, test := range tests {
+		extendedID, payload, err := ParseExtended(test.input)
+		if test.failure {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.extendedID, extendedID)
+		assert.Equal(t, test.payload, payload)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	var tests = map[string]struct {
 		inputIndex int
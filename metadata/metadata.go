@@ -0,0 +1,163 @@
+package metadata
+
+import (
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/message"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"net"
+	"time"
+)
+
+// The metadata extension (BEP 9) lets peers exchange the info dictionary over the extension protocol,
+// so that a torrent can be joined knowing only its info hash, e.g. from a magnet link.
+// The info dictionary is split into blocks of 16 KiB, each carried by an extended message whose payload
+// is a bencoded dictionary, followed by the raw block for `data` messages:
+// request: d8:msg_typei0e5:piecei0ee
+// data:    d8:msg_typei1e5:piecei0e10:total_sizei34256ee<block>
+// reject:  d8:msg_typei2e5:piecei0ee
+
+// ExtensionName is the name of the metadata extension in the `m` dictionary of the extension protocol handshake
+const ExtensionName = "ut_metadata"
+
+// BlockSize is the size of every metadata block but the last
+const BlockSize int = 16384
+
+// MaxSize is the largest info dictionary we accept from a peer
+const MaxSize int = 16 << 20
+
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+// metadataMessage is the bencoded dictionary at the start of every ut_metadata message
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"` // only in `data` messages
+}
+
+// Fetch downloads the info dictionary from a peer and verifies it against the info hash of the connection
+func Fetch(c *client.Client) ([]byte, error) {
+	if !c.SupportsExtensions() {
+		return nil, fmt.Errorf("peer %s does not support the extension protocol", c.Peer)
+	}
+	_ = c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer func(conn net.Conn) {
+		_ = conn.SetDeadline(time.Time{}) // disable the deadline
+	}(c.Conn)
+	localID := c.RegisterExtension(ExtensionName, nil) // blocks are read here rather than dispatched
+	err := c.SendExtendedHandshake(client.ExtendedHandshake{})
+	if err != nil {
+		return nil, err
+	}
+	peerID, size, err := readHandshake(c)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	for piece := 0; piece*BlockSize < size; piece++ {
+		err = requestBlock(c, peerID, piece)
+		if err != nil {
+			return nil, err
+		}
+		err = readBlock(c, localID, piece, buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sha1.Sum(buf) != c.InfoHash {
+		return nil, fmt.Errorf("metadata from %s does not match info hash %x", c.Peer, c.InfoHash)
+	}
+	return buf, nil
+}
+
+// readExtended reads messages until an extended message with the given extended message ID arrives
+func readExtended(c *client.Client, extendedID uint8) ([]byte, error) {
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Prefix == uint32(0) || msg.MessageID != message.MsgExtended { // keep-alive, have, etc.
+			continue
+		}
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if id == extendedID {
+			return payload, nil
+		}
+	}
+}
+
+// readHandshake waits for the peer's extension protocol handshake and returns its ut_metadata ID and the metadata size
+func readHandshake(c *client.Client) (uint8, int, error) {
+	payload, err := readExtended(c, client.ExtendedHandshakeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := c.HandleExtendedHandshake(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, ok := c.PeerExtensionID(ExtensionName)
+	if !ok {
+		return 0, 0, fmt.Errorf("peer %s does not support %s", c.Peer, ExtensionName)
+	}
+	if h.MetadataSize <= 0 || h.MetadataSize > MaxSize {
+		return 0, 0, fmt.Errorf("invalid metadata size %d", h.MetadataSize)
+	}
+	return id, h.MetadataSize, nil
+}
+
+// requestBlock sends a ut_metadata `request` message
+func requestBlock(c *client.Client, peerID uint8, piece int) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, metadataMessage{MsgType: msgRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(peerID, buf.Bytes())
+}
+
+// readBlock waits for the `data` message of a block, sent with our ut_metadata ID, and copies the block into `buf`
+func readBlock(c *client.Client, localID uint8, piece int, buf []byte) error {
+	begin := piece * BlockSize
+	end := begin + BlockSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	for {
+		payload, err := readExtended(c, localID)
+		if err != nil {
+			return err
+		}
+		var msg metadataMessage
+		err = bencode.Unmarshal(bytes.NewReader(payload), &msg) // only decodes the dictionary, not the block after it
+		if err != nil {
+			return err
+		}
+		switch msg.MsgType {
+		case msgReject:
+			return fmt.Errorf("peer %s rejected metadata piece #%d", c.Peer, msg.Piece)
+		case msgData:
+			if msg.Piece != piece {
+				continue // late answer to an earlier request
+			}
+			if msg.TotalSize != 0 && msg.TotalSize != len(buf) {
+				return fmt.Errorf("expected metadata size %d, got %d", len(buf), msg.TotalSize)
+			}
+			if len(payload) < end-begin {
+				return fmt.Errorf("metadata message too short, %d < %d", len(payload), end-begin)
+			}
+			copy(buf[begin:end], payload[len(payload)-(end-begin):]) // the block follows the dictionary
+			return nil
+		}
+	}
+}
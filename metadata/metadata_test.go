@@ -0,0 +1,96 @@
+package metadata
+
+import (
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/internal/peertest"
+	"bittorrent-client-go/message"
+	"bittorrent-client-go/peers"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// servePeer serves `info` over ut_metadata to a single peer, rejecting every request if `reject` is set
+func servePeer(t *testing.T, infoHash [20]byte, info []byte, reject bool) peers.Peer {
+	var hs bytes.Buffer
+	_ = bencode.Marshal(&hs, client.ExtendedHandshake{M: map[string]int{ExtensionName: 3}, MetadataSize: len(info)})
+	hello := []*message.Message{
+		{MessageID: message.MsgBitfield, Payload: []byte{0xff}, Prefix: 2},
+		message.FormatExtended(client.ExtendedHandshakeID, hs.Bytes()),
+	}
+	var ourID uint8
+	return peertest.Serve(t, infoHash, handshake.Reserved(handshake.ExtensionProtocol), hello, func(conn net.Conn, msg *message.Message) error {
+		if msg.MessageID == message.MsgExtended && msg.Payload[0] == client.ExtendedHandshakeID {
+			ours, err := client.ParseExtendedHandshake(msg.Payload[1:])
+			if err != nil {
+				return err
+			}
+			ourID = uint8(ours.M[ExtensionName])
+			return nil
+		}
+		if msg.MessageID != message.MsgExtended || msg.Payload[0] != 3 {
+			return nil
+		}
+		var req metadataMessage
+		if err := bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &req); err != nil {
+			return err
+		}
+		var resp bytes.Buffer
+		if reject {
+			_ = bencode.Marshal(&resp, metadataMessage{MsgType: msgReject, Piece: req.Piece})
+		} else {
+			_ = bencode.Marshal(&resp, metadataMessage{MsgType: msgData, Piece: req.Piece, TotalSize: len(info)})
+			end := (req.Piece + 1) * BlockSize
+			if end > len(info) {
+				end = len(info)
+			}
+			resp.Write(info[req.Piece*BlockSize : end])
+		}
+		_, err := conn.Write(message.FormatExtended(ourID, resp.Bytes()).Serialize())
+		return err
+	})
+}
+
+func TestFetch(t *testing.T) {
+	pieces := bytes.Repeat([]byte{0xab}, 20*1000) // spans two blocks
+	info := []byte(fmt.Sprintf("d6:lengthi1000e4:name6:debian12:piece lengthi16384e6:pieces%d:%se", len(pieces), pieces))
+	var tests = map[string]struct {
+		infoHash [20]byte
+		reject   bool
+		failure  bool
+	}{
+		"verified metadata": {
+			infoHash: sha1.Sum(info),
+			failure:  false,
+		},
+		"metadata does not match info hash": {
+			infoHash: [20]byte{1, 2, 3},
+			failure:  true,
+		},
+		"peer rejects requests": {
+			infoHash: sha1.Sum(info),
+			reject:   true,
+			failure:  true,
+		},
+	}
+	for name, test := range tests {
+		peer := servePeer(t, test.infoHash, info, test.reject)
+		c, err := client.New(context.Background(), peer, [20]byte{1}, test.infoHash)
+		require.Nil(t, err, name)
+		buf, err := Fetch(c)
+		_ = c.Conn.Close()
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, info, buf, name)
+		}
+	}
+}
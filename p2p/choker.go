@@ -0,0 +1,211 @@
+package p2p
+
+import (
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/pex"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUploadSlots is the number of peers unchoked for their rate when Torrent.UploadSlots is not set
+const DefaultUploadSlots int = 4
+
+// chokeInterval is how often the choker re-ranks peers, and optimisticInterval how often the optimistic unchoke rotates
+var (
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// peerConn is a connected peer, with the bytes exchanged with it since the last choke round
+type peerConn struct {
+	client     *client.Client
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	rate       int64 // bytes per second over the last round, guarded by choker.mu
+	outbound   bool  // we connected to the peer, so its address is the one it accepts connections on
+	seed       atomic.Bool
+
+	allowedFast map[int]bool    // pieces the peer lets us download while choked (BEP 6), only used by its download worker
+	pex         *pex.Exchange   // peer exchange (BEP 11), nil when the peer does not support the extension protocol
+	messages    chan readResult // read from the peer by readLoop, for its download worker
+	wake        chan struct{}   // wakes up its download worker, e.g. once another peer completed the piece in endgame
+}
+
+// choker decides which interested peers we upload to: the fastest ones, tit-for-tat,
+// plus an optimistic unchoke that rotates so that new peers get a chance to show their rate
+type choker struct {
+	slots   int
+	seeding func() bool                                     // rank peers by upload rate once there is nothing left to download from them
+	changed func(c *client.Client, choking bool, err error) // called when a decision changes the choke state of a peer or fails to, unless nil
+
+	mu         sync.Mutex
+	peers      []*peerConn
+	optimistic *peerConn
+	rotated    time.Time // when the optimistic unchoke was last picked
+	running    bool
+}
+
+// choke is a decision of the choker, applied once its lock is released as sending may block
+type choke struct {
+	client  *client.Client
+	choking bool
+}
+
+func newChoker(slots int, seeding func() bool) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{slots: slots, seeding: seeding}
+}
+
+// choker returns the choker shared by every connection of the torrent
+func (t *Torrent) choker() *choker {
+	t.chokerOnce.Do(func() {
+		t.chk = newChoker(t.UploadSlots, func() bool {
+			return t.Left() == 0
+		})
+		t.chk.changed = func(c *client.Client, choking bool, err error) {
+			t.publish(Event{Type: Choke, Peer: c.Peer, Choked: choking, Err: err})
+		}
+	})
+	return t.chk
+}
+
+// add registers a connected peer, choked until a round picks it. The first peer starts the rounds
+func (ch *choker) add(c *client.Client, outbound bool) *peerConn {
+	p := &peerConn{client: c, outbound: outbound, allowedFast: make(map[int]bool), wake: make(chan struct{}, 1)}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.peers = append(ch.peers, p)
+	if !ch.running {
+		ch.running = true
+		go ch.run()
+	}
+	return p
+}
+
+// remove forgets a disconnected peer and hands its slot to another one
+func (ch *choker) remove(p *peerConn) {
+	ch.mu.Lock()
+	for i, other := range ch.peers {
+		if other == p {
+			ch.peers = append(ch.peers[:i], ch.peers[i+1:]...)
+			break
+		}
+	}
+	if ch.optimistic == p {
+		ch.optimistic = nil
+	}
+	ch.mu.Unlock()
+	ch.rechoke()
+}
+
+// run plays a round every chokeInterval until no peer is left
+func (ch *choker) run() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for now := range ticker.C {
+		ch.mu.Lock()
+		if len(ch.peers) == 0 {
+			ch.running = false
+			ch.mu.Unlock()
+			return
+		}
+		ch.mu.Unlock()
+		ch.round(now.Sub(last), now)
+		last = now
+	}
+}
+
+// round measures the rate of every peer over `elapsed`, rotates the optimistic unchoke when due, and rechokes
+func (ch *choker) round(elapsed time.Duration, now time.Time) {
+	seeding := ch.seeding()
+	ch.mu.Lock()
+	for _, p := range ch.peers {
+		n := p.downloaded.Swap(0)
+		if up := p.uploaded.Swap(0); seeding {
+			n = up
+		}
+		p.rate = int64(float64(n) / elapsed.Seconds())
+	}
+	if now.Sub(ch.rotated) >= optimisticInterval {
+		ch.optimistic = nil
+	}
+	decisions := ch.decide(now)
+	ch.mu.Unlock()
+	ch.apply(decisions)
+}
+
+// rechoke re-applies the last rates, e.g. when a peer becomes interested or leaves
+func (ch *choker) rechoke() {
+	ch.mu.Lock()
+	decisions := ch.decide(time.Now())
+	ch.mu.Unlock()
+	ch.apply(decisions)
+}
+
+// decide unchokes the interested peers with the best rates and the optimistic unchoke, and chokes everyone else
+func (ch *choker) decide(now time.Time) []choke {
+	var interested []*peerConn
+	for _, p := range ch.peers {
+		if p.client.Info().PeerInterested {
+			interested = append(interested, p)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return interested[i].rate > interested[j].rate
+	})
+	unchoked := make(map[*peerConn]bool)
+	for _, p := range interested {
+		if len(unchoked) == ch.slots {
+			break
+		}
+		if p != ch.optimistic {
+			unchoked[p] = true
+		}
+	}
+	if ch.optimistic != nil && !ch.optimistic.client.Info().PeerInterested {
+		ch.optimistic = nil
+	}
+	if ch.optimistic == nil {
+		var candidates []*peerConn
+		for _, p := range interested {
+			if !unchoked[p] {
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+			ch.rotated = now
+		}
+	}
+	if ch.optimistic != nil {
+		unchoked[ch.optimistic] = true
+	}
+	decisions := make([]choke, 0, len(ch.peers))
+	for _, p := range ch.peers {
+		decisions = append(decisions, choke{client: p.client, choking: !unchoked[p]})
+	}
+	return decisions
+}
+
+func (ch *choker) apply(decisions []choke) {
+	for _, d := range decisions {
+		before := d.client.Info().AmChoking
+		err := d.client.SetChoking(d.choking)
+		if (err != nil || before != d.choking) && ch.changed != nil {
+			ch.changed(d.client, d.choking, err)
+		}
+	}
+}
+
+// count returns the number of connected peers
+func (ch *choker) count() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.peers)
+}
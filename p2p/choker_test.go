@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"bittorrent-client-go/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newChokedPeer returns a choked client whose messages are discarded
+func newChokedPeer(t *testing.T, interested bool) *client.Client {
+	ours, theirs := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, theirs)
+	}()
+	t.Cleanup(func() {
+		_ = ours.Close()
+		_ = theirs.Close()
+	})
+	c := &client.Client{Conn: ours}
+	require.Nil(t, c.SetChoking(true))
+	c.SetPeerInterested(interested)
+	return c
+}
+
+func TestChoker_round(t *testing.T) {
+	tests := map[string]struct {
+		seeding bool
+	}{
+		"ranked by download rate": {seeding: false},
+		"ranked by upload rate":   {seeding: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ch := &choker{slots: 2, seeding: func() bool {
+				return test.seeding
+			}}
+			rates := []int64{100, 400, 300, 200, 1000}
+			var ps []*peerConn
+			for i, rate := range rates {
+				p := &peerConn{client: newChokedPeer(t, i != 4)} // the fastest peer is not interested
+				if test.seeding {
+					p.uploaded.Store(rate)
+				} else {
+					p.downloaded.Store(rate)
+				}
+				ps = append(ps, p)
+			}
+			ch.peers = ps
+			now := time.Now()
+			ch.round(time.Second, now)
+			assert.Equal(t, int64(400), ps[1].rate)
+			assert.False(t, ps[1].client.Info().AmChoking)
+			assert.False(t, ps[2].client.Info().AmChoking)
+			assert.True(t, ps[4].client.Info().AmChoking)
+			require.NotNil(t, ch.optimistic)
+			assert.Contains(t, []*peerConn{ps[0], ps[3]}, ch.optimistic)
+			assert.False(t, ch.optimistic.client.Info().AmChoking)
+
+			optimistic := ch.optimistic
+			ch.round(time.Second, now.Add(chokeInterval)) // no traffic, but the optimistic unchoke is kept
+			assert.Equal(t, optimistic, ch.optimistic)
+			ch.round(time.Second, now.Add(optimisticInterval))
+			assert.Equal(t, now.Add(optimisticInterval), ch.rotated)
+		})
+	}
+}
+
+func TestChoker_notInterested(t *testing.T) {
+	ch := newChoker(1, func() bool {
+		return false
+	})
+	p := ch.add(newChokedPeer(t, true), false)
+	ch.rechoke()
+	assert.False(t, p.client.Info().AmChoking)
+	p.client.SetPeerInterested(false)
+	ch.rechoke()
+	assert.True(t, p.client.Info().AmChoking)
+	ch.remove(p)
+	assert.Empty(t, ch.peers)
+}
@@ -0,0 +1,107 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/internal/peertest"
+	"bittorrent-client-go/message"
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveFast serves a peer supporting the Fast extension, which has every piece,
+// never unchokes us, lets us download the allowed fast pieces and rejects every other request
+func serveFast(t *testing.T, infoHash [20]byte, data []byte, pieceLength int, allowedFast []int) peers.Peer {
+	hello := []*message.Message{{MessageID: message.MsgHaveAll, Prefix: 1}}
+	allowed := make(map[int]bool)
+	for _, index := range allowedFast {
+		allowed[index] = true
+		hello = append(hello, message.FormatAllowedFast(index))
+	}
+	return peertest.Serve(t, infoHash, handshake.Reserved(handshake.FastExtension), hello, func(conn net.Conn, msg *message.Message) error {
+		if msg.MessageID != message.MsgRequest {
+			return nil
+		}
+		index, begin, length, _ := message.ParseRequest(msg)
+		if !allowed[index] {
+			_, err := conn.Write(message.FormatReject(index, begin, length).Serialize())
+			return err
+		}
+		offset := index*pieceLength + begin
+		_, err := conn.Write(message.FormatPiece(index, begin, data[offset:offset+length]).Serialize())
+		return err
+	})
+}
+
+func TestTorrent_Download_rejectedOnce(t *testing.T) {
+	retry, reject := pickRetryInterval, rejectRetryInterval
+	pickRetryInterval, rejectRetryInterval = 10*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		pickRetryInterval, rejectRetryInterval = retry, reject
+	}()
+	data := []byte("abcdefgh")
+	infoHash := [20]byte{4, 5, 7}
+	hello := []*message.Message{{MessageID: message.MsgHaveAll, Prefix: 1}, {MessageID: message.MsgUnchoke, Prefix: 1}}
+	rejected := make(map[int]bool)
+	busy := peertest.Serve(t, infoHash, handshake.Reserved(handshake.FastExtension), hello, func(conn net.Conn, msg *message.Message) error {
+		if msg.MessageID != message.MsgRequest {
+			return nil
+		}
+		index, begin, length, _ := message.ParseRequest(msg)
+		if !rejected[index] { // as if its queue was full
+			rejected[index] = true
+			_, err := conn.Write(message.FormatReject(index, begin, length).Serialize())
+			return err
+		}
+		offset := index*4 + begin
+		_, err := conn.Write(message.FormatPiece(index, begin, data[offset:offset+length]).Serialize())
+		return err
+	})
+	leecher := &Torrent{
+		Peers:       []peers.Peer{busy},
+		PeerID:      [20]byte{'l'},
+		InfoHash:    infoHash,
+		PieceHashes: [][20]byte{sha1.Sum(data[0:4]), sha1.Sum(data[4:8])},
+		PieceLength: 4,
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+		Bitfield:    bitfield.Bitfield{0},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := leecher.Download(ctx) // the only peer rejects every piece once
+	require.Nil(t, err)
+	assert.Equal(t, data, leecher.Storage.(*memStorage).buf)
+}
+
+func TestTorrent_Download_allowedFast(t *testing.T) {
+	data := []byte("abcdefghij")
+	hashes := [][20]byte{
+		sha1.Sum(data[0:4]),
+		sha1.Sum(data[4:8]),
+		sha1.Sum(data[8:10]),
+	}
+	infoHash := [20]byte{4, 5, 6}
+	leecher := &Torrent{
+		Peers: []peers.Peer{
+			serveFast(t, infoHash, data, 4, []int{0, 2}),
+			serveFast(t, infoHash, data, 4, []int{1}),
+		},
+		PeerID:      [20]byte{'l'},
+		InfoHash:    infoHash,
+		PieceHashes: hashes,
+		PieceLength: 4,
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+		Bitfield:    bitfield.Bitfield{0},
+	}
+	err := leecher.Download(context.Background()) // only possible through the allowed fast pieces, everything else is rejected
+	require.Nil(t, err)
+	assert.Equal(t, data, leecher.Storage.(*memStorage).buf)
+}
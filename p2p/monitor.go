@@ -0,0 +1,222 @@
+package p2p
+
+import (
+	"bittorrent-client-go/peers"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateWindow is roughly the period transfer rates are averaged over
+var rateWindow = 10 * time.Second
+
+// EventType says what happened to a torrent
+type EventType int
+
+const (
+	PieceVerified    EventType = iota // Piece passed the integrity check and was written to Storage
+	PieceFailed                       // Piece from Peer failed the integrity check, and will be downloaded again
+	PeerConnected                     // handshake completed with Peer
+	PeerDisconnected                  // Peer is gone, because of Err unless it is nil, possibly before the handshake completed
+	PeerBanned                        // Peer failed to connect too many times in a row, and is no longer dialed
+	PeerChoke                         // Peer choked us when Choked is set, unchoked us otherwise
+	Choke                             // the choker choked Peer when Choked is set, unchoked it otherwise, or failed to tell it with Err
+	PeerExchange                      // Peers learned from Peer by peer exchange, or Err failing to advertise ours to it
+	BlockReceived                     // Bytes of Piece received from Peer
+	BlockSent                         // Bytes of Piece sent to Peer
+	DownloadStarted                   // Download started, or resumed when Stats tells that some pieces are already in Storage
+	Endgame                           // every missing piece is being downloaded, and now requested from every peer having it
+	TrackerAnnounce                   // Tracker answered the Announce event with Peers, or failed with Err
+	TrackerWarning                    // Tracker answered normally along with a Warning
+	DHTAnnounce                       // the DHT was announced to and returned Peers, or joining or announcing to it failed with Err
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PieceVerified:
+		return "PieceVerified"
+	case PieceFailed:
+		return "PieceFailed"
+	case PeerConnected:
+		return "PeerConnected"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	case PeerBanned:
+		return "PeerBanned"
+	case PeerChoke:
+		return "PeerChoke"
+	case Choke:
+		return "Choke"
+	case PeerExchange:
+		return "PeerExchange"
+	case BlockReceived:
+		return "BlockReceived"
+	case BlockSent:
+		return "BlockSent"
+	case DownloadStarted:
+		return "DownloadStarted"
+	case Endgame:
+		return "Endgame"
+	case TrackerAnnounce:
+		return "TrackerAnnounce"
+	case TrackerWarning:
+		return "TrackerWarning"
+	case DHTAnnounce:
+		return "DHTAnnounce"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is something that happened to a torrent, only the fields its Type mentions are set
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Piece    int
+	Peer     peers.Peer
+	Bytes    int
+	Choked   bool
+	Tracker  string // announce URL
+	Announce string // `started`, `completed`, `stopped`, or empty for a regular announce
+	Peers    int    // number of peers the tracker or the DHT returned
+	Warning  string // `warning message` of the tracker
+	Err      error
+}
+
+// Stats is a snapshot of the progress of a torrent
+type Stats struct {
+	Pieces          int
+	CompletedPieces int   // verified and in Storage
+	Left            int   // bytes still missing from Storage
+	Downloaded      int64 // bytes received from peers, wasted ones included
+	Uploaded        int64 // bytes sent to peers
+	DownloadRate    float64
+	UploadRate      float64       // in bytes per second, like DownloadRate, averaged over about rateWindow
+	ETA             time.Duration // until complete at DownloadRate, 0 once complete and -1 while nothing is downloaded
+	Peers           int           // connected, whoever initiated the connection
+}
+
+// Monitor delivers the events of a torrent to subscribers, and serves its stats.
+// The zero value is ready to use, and nothing is published while a Torrent has no Monitor
+type Monitor struct {
+	mu      sync.RWMutex
+	subs    map[int]func(Event)
+	next    int
+	torrent *Torrent // the last one attached, by Download or Server.Add
+}
+
+// Subscribe calls `fn` with every event until the returned function is called.
+// `fn` is called synchronously from the goroutine the event happens on, so it must return quickly
+func (m *Monitor) Subscribe(fn func(Event)) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[int]func(Event))
+	}
+	id := m.next
+	m.next++
+	m.subs[id] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subs, id)
+	}
+}
+
+// Publish delivers an event to every subscriber, e.g. one of trackers announced to on behalf of the torrent.
+// Its Time is set to now unless already set
+func (m *Monitor) Publish(e Event) {
+	if m == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	m.mu.RLock()
+	subs := make([]func(Event), 0, len(m.subs))
+	for _, fn := range m.subs {
+		subs = append(subs, fn)
+	}
+	m.mu.RUnlock()
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// Stats returns the stats of the torrent being downloaded or seeded, the zero Stats before it starts
+func (m *Monitor) Stats() Stats {
+	m.mu.RLock()
+	t := m.torrent
+	m.mu.RUnlock()
+	if t == nil {
+		return Stats{}
+	}
+	return t.Stats()
+}
+
+func (m *Monitor) attach(t *Torrent) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.torrent = t
+}
+
+// publish delivers an event to the subscribers of the Monitor of the torrent, if any
+func (t *Torrent) publish(e Event) {
+	t.Monitor.Publish(e)
+}
+
+// Stats returns a snapshot of the progress of the torrent
+func (t *Torrent) Stats() Stats {
+	now := time.Now()
+	t.mu.RLock()
+	completed := t.Bitfield.Count()
+	t.mu.RUnlock()
+	s := Stats{
+		Pieces:          len(t.PieceHashes),
+		CompletedPieces: completed,
+		Left:            t.Left(),
+		Downloaded:      t.Downloaded(),
+		Uploaded:        t.Uploaded(),
+		DownloadRate:    t.downRate.get(now),
+		UploadRate:      t.upRate.get(now),
+		Peers:           t.choker().count(),
+	}
+	switch {
+	case s.Left == 0:
+	case s.DownloadRate < 1: // less than a byte per second is as good as stalled
+		s.ETA = -1
+	default:
+		s.ETA = time.Duration(float64(s.Left) / s.DownloadRate * float64(time.Second))
+	}
+	return s
+}
+
+// rateMeter measures a transfer rate in bytes per second, as a moving average decaying exponentially over rateWindow
+type rateMeter struct {
+	mu   sync.Mutex
+	rate float64 // as of `at`
+	at   time.Time
+}
+
+func (r *rateMeter) add(n int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rate = r.decayed(now) + float64(n)/rateWindow.Seconds()
+	r.at = now
+}
+
+func (r *rateMeter) get(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.decayed(now)
+}
+
+func (r *rateMeter) decayed(now time.Time) float64 {
+	if r.at.IsZero() {
+		return 0
+	}
+	return r.rate * math.Exp(-now.Sub(r.at).Seconds()/rateWindow.Seconds())
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	var r rateMeter
+	now := time.Now()
+	assert.Zero(t, r.get(now))
+	for i := 0; i < 600; i++ { // 1000 bytes every 100ms for a minute
+		now = now.Add(100 * time.Millisecond)
+		r.add(1000, now)
+	}
+	assert.InDelta(t, 10000, r.get(now), 600)
+	assert.Less(t, r.get(now.Add(time.Minute)), 100.0) // nothing since
+}
+
+func TestMonitor_Subscribe(t *testing.T) {
+	var m Monitor
+	var got []EventType
+	unsubscribe := m.Subscribe(func(e Event) {
+		assert.False(t, e.Time.IsZero())
+		got = append(got, e.Type)
+	})
+	m.Publish(Event{Type: TrackerAnnounce})
+	unsubscribe()
+	m.Publish(Event{Type: PieceVerified})
+	assert.Equal(t, []EventType{TrackerAnnounce}, got)
+	assert.Equal(t, Stats{}, m.Stats()) // no torrent yet
+
+	var none *Monitor
+	none.Publish(Event{Type: PieceVerified}) // a torrent without a Monitor
+}
+
+func TestTorrent_Download_events(t *testing.T) {
+	data := make([]byte, 3*MaxBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	pieceLength := 2 * MaxBlockSize
+	hashes := [][20]byte{
+		sha1.Sum(data[:pieceLength]),
+		sha1.Sum(data[pieceLength:]),
+	}
+	monitor := &Monitor{}
+	var mu sync.Mutex
+	counts := make(map[EventType]int)
+	var received int
+	monitor.Subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[e.Type]++
+		if e.Type == BlockReceived {
+			received += e.Bytes
+		}
+	})
+	leecher := &Torrent{
+		Peers:       []peers.Peer{startSeeder(t, data, pieceLength, hashes)},
+		PeerID:      [20]byte{'l'},
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+		Bitfield:    bitfield.Bitfield{0},
+		Monitor:     monitor,
+	}
+	err := leecher.Download(context.Background())
+	require.Nil(t, err)
+
+	stats := monitor.Stats()
+	assert.Equal(t, 2, stats.Pieces)
+	assert.Equal(t, 2, stats.CompletedPieces)
+	assert.Equal(t, 0, stats.Left)
+	assert.Equal(t, int64(len(data)), stats.Downloaded)
+	assert.Positive(t, stats.DownloadRate)
+	assert.Zero(t, stats.ETA)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[PeerDisconnected] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, counts[DownloadStarted])
+	assert.Equal(t, 2, counts[PieceVerified])
+	assert.Equal(t, 1, counts[PeerConnected])
+	assert.Equal(t, 1, counts[PeerChoke]) // unchoked by the seeder
+	assert.Equal(t, len(data), received)
+}
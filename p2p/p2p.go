@@ -1,15 +1,20 @@
 package p2p
 
 import (
+	"bittorrent-client-go/bitfield"
 	"bittorrent-client-go/client"
 	"bittorrent-client-go/message"
 	"bittorrent-client-go/peers"
+	"bittorrent-client-go/storage"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,16 +24,52 @@ const MaxBlockSize int = 16384
 // MaxBlockLog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBlockLog int = 5
 
+// errRejected is returned when a peer rejects a request it could serve, so that the piece is left to other peers
+var errRejected = errors.New("request rejected")
+
+// errWoken is returned when another worker wakes up one waiting for a message, and errIdle when the wait times out
+var (
+	errWoken = errors.New("woken up")
+	errIdle  = errors.New("peer sent nothing in time")
+)
+
+// pickRetryInterval is how long a worker whose peer has no missing piece waits before picking again
+var pickRetryInterval = 5 * time.Second
+
+// rejectRetryInterval is how long the pieces a peer rejected are left to other peers before it is asked again,
+// since peers also reject requests when their queue is full
+var rejectRetryInterval = 30 * time.Second
+
 // Torrent holds data required to download a torrent from a list of peers
 type Torrent struct {
-	Peers       []peers.Peer
-	PeerID      [20]byte
-	Announce    string
-	InfoHash    [20]byte // SHA-1 hash of the entire bencoded `info` dict
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Peers        []peers.Peer
+	PeerID       [20]byte
+	Announce     string
+	InfoHash     [20]byte // SHA-1 hash of the entire bencoded `info` dict
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Storage      storage.Storage     // verified pieces are written here as soon as they arrive
+	Bitfield     bitfield.Bitfield   // pieces already in Storage, re-verified from Storage when nil
+	NewPeers     <-chan []peers.Peer // more peers discovered during the download, e.g. from the DHT
+	RequestPeers func()              // asks for more peers on NewPeers when none is connected, e.g. with an early tracker announce
+	TargetPeers  int                 // connections kept open while downloading, DefaultTargetPeers when 0
+	UploadSlots  int                 // peers unchoked for their rate besides the optimistic unchoke, DefaultUploadSlots when 0
+	Port         uint16              // TCP port we accept peers on, sent to peers supporting the extension protocol
+	Private      bool                // peers only come from Peers and NewPeers (BEP 27), peer exchange is disabled
+	Monitor      *Monitor            // receives the events of the torrent and serves its stats, nothing is published when nil
+
+	pieces     *picker      // missing pieces, set before any worker starts
+	mu         sync.RWMutex // guards Bitfield once peers are served from other goroutines
+	chokerOnce sync.Once
+	chk        *choker
+	pexOnce    sync.Once
+	pexFound   chan []peers.Peer // peers learned by peer exchange, for Download to connect to
+	uploaded   atomic.Int64      // bytes of blocks sent to peers
+	downloaded atomic.Int64      // bytes of blocks received from peers, wasted ones included
+	upRate     rateMeter
+	downRate   rateMeter
 }
 
 type pieceWork struct {
@@ -40,79 +81,408 @@ type pieceWork struct {
 type pieceResult struct {
 	index int
 	buf   []byte
+	peer  peers.Peer // the piece was completed by
+}
+
+// workerExit is the end of a connection made by Download
+type workerExit struct {
+	peer   peers.Peer
+	pieces int // verified pieces received from the peer
+}
+
+// readResult is a message read from a peer, or the error that ended the connection
+type readResult struct {
+	msg *message.Message
+	err error
 }
 
 type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlogged int
-}
-
-// Download downloads the .torrent and stores the entire file in memory
-// TODO: do not store the entire file in memory
-func (t *Torrent) Download() ([]byte, error) {
-	log.Printf("starting download for %s\n", t.Name)
-	workQueue := make(chan *pieceWork, len(t.PieceHashes)) // initialize queues for workers to retrieve work and send results
+	torrent  *Torrent
+	piece    *activePiece // nil while waiting for pieces
+	peer     *peerConn
+	client   *client.Client
+	complete bool // the last block of the piece came from this peer
+}
+
+// Download downloads the .torrent and writes each verified piece into Storage,
+// so that memory use is bounded by the pieces in flight rather than by the torrent size.
+// Cancelling `ctx` disconnects every peer, and returns ctx.Err() once the pieces already verified are written
+func (t *Torrent) Download(ctx context.Context) error {
+	if t.Storage == nil {
+		return fmt.Errorf("no storage to download %s into", t.Name)
+	}
+	if t.Bitfield == nil {
+		bf, err := t.Verify()
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.Bitfield = bf
+		t.mu.Unlock()
+	}
+	t.Monitor.attach(t)
+	t.pieces = newPicker(len(t.PieceHashes), t.Bitfield, t.calculatePieceSize) // initialize the picker for workers to retrieve work, and a queue to send results
+	t.pieces.endgameStarted = func() {
+		t.publish(Event{Type: Endgame})
+	}
+	defer t.pieces.close()
 	results := make(chan *pieceResult, 1)
-	for index, hash := range t.PieceHashes {
-		var length = t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index: index, hash: hash, length: length}
+	donePieces := t.Bitfield.Count()
+	t.publish(Event{Type: DownloadStarted})
+	if donePieces == len(t.PieceHashes) {
+		return nil
+	}
+	pool := newPeerPool(t.TargetPeers)
+	exited := make(chan workerExit)
+	ctx, cancel := context.WithCancel(ctx)
+	var workers sync.WaitGroup
+	var retry, giveUp <-chan time.Time
+	dry := false
+	update := func() { // dial up to the target, and look for more peers when none is left
+		now := time.Now()
+		for _, peer := range pool.dial(now) {
+			workers.Add(1)
+			go func(peer peers.Peer) {
+				defer workers.Done()
+				pieces, _ := t.startDownloadWorker(ctx, peer, results) // published as PeerDisconnected
+				select {
+				case exited <- workerExit{peer: peer, pieces: pieces}:
+				case <-ctx.Done():
+				}
+			}(peer)
+		}
+		retry = nil
+		if at, ok := pool.nextRetry(now); ok {
+			retry = time.After(at.Sub(now))
+		}
+		if pool.connected > 0 {
+			dry, giveUp = false, nil
+			return
+		}
+		if !dry && t.RequestPeers != nil {
+			t.RequestPeers()
+		}
+		dry = true
+		if !pool.exhausted() {
+			giveUp = nil
+		} else if giveUp == nil {
+			giveUp = time.After(exhaustedTimeout)
+		}
 	}
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	write := func(res *pieceResult) error {
+		begin, _ := t.calculateBoundsForPiece(res.index)
+		_, err := t.Storage.WriteAt(res.buf, int64(begin))
+		if err != nil {
+			return fmt.Errorf("writing piece #%d: %w", res.index, err)
+		}
+		t.mu.Lock()
+		t.Bitfield.SetPiece(res.index)
+		t.mu.Unlock()
+		t.publish(Event{Type: PieceVerified, Piece: res.index, Peer: res.peer})
+		return nil
 	}
-	var buf = make([]byte, t.Length) // collect results into a buffer until full
-	donePieces := 0
+	stop := func(keep func(*pieceResult) error) error { // disconnects every worker, handing the pieces they verified meanwhile to `keep`
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			workers.Wait()
+			close(done)
+		}()
+		var err error
+		for {
+			select {
+			case res := <-results:
+				if err == nil && keep != nil {
+					err = keep(res)
+				}
+			case <-done:
+				return err
+			}
+		}
+	}
+	defer func() {
+		_ = stop(nil)
+	}()
+	pool.add(t.Peers)
+	update()
 	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case <-ctx.Done():
+			if err := stop(write); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case res = <-results:
+		case found := <-t.NewPeers: // never ready when nil
+			if pool.add(found) > 0 {
+				update()
+			}
+			continue
+		case found := <-t.exchanged():
+			if pool.add(found) > 0 {
+				update()
+			}
+			continue
+		case e := <-exited:
+			if pool.disconnected(e.peer, e.pieces, time.Now()) {
+				t.publish(Event{Type: PeerBanned, Peer: e.peer})
+			}
+			update()
+			continue
+		case <-retry:
+			update()
+			continue
+		case <-giveUp:
+			return fmt.Errorf("%w: %d peers banned and no other peer found for %s", ErrSwarmExhausted, pool.banned(), exhaustedTimeout)
+		}
+		if err := write(res); err != nil {
+			return err
+		}
 		donePieces += 1
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
 	}
-	close(workQueue)
-	return buf, nil
+	return nil
+}
+
+// Verify hashes every piece already in Storage and returns a bitfield of the pieces that pass the integrity check
+func (t *Torrent) Verify() (bitfield.Bitfield, error) {
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	buf := make([]byte, t.PieceLength)
+	for index, hash := range t.PieceHashes {
+		begin, end := t.calculateBoundsForPiece(index)
+		_, err := t.Storage.ReadAt(buf[:end-begin], int64(begin))
+		if err == io.EOF || err == io.ErrUnexpectedEOF { // missing data, nothing to verify from here on
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if checkIntegrity(&pieceWork{index: index, hash: hash}, buf[:end-begin]) == nil {
+			bf.SetPiece(index)
+		}
+	}
+	return bf, nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+// startDownloadWorker downloads pieces from a peer until the download completes or the connection fails,
+// and returns the number of verified pieces it received
+func (t *Torrent) startDownloadWorker(ctx context.Context, peer peers.Peer, results chan *pieceResult) (received int, err error) {
+	c, err := client.New(ctx, peer, t.PeerID, t.InfoHash)
 	if err != nil {
-		log.Printf("could not complete handshake with %s, disconnecting...\n", peer.IP)
-		return
+		err = fmt.Errorf("could not complete handshake: %w", err)
+		if ctx.Err() == nil {
+			t.publish(Event{Type: PeerDisconnected, Peer: peer, Err: err})
+		}
+		return 0, err
 	}
 	defer func(Conn net.Conn) {
 		_ = Conn.Close()
 	}(c.Conn)
-	log.Printf("completed handshake with %s\n", peer.IP)
-	_ = c.SendUnchoke()
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Conn.Close() // unblocks the worker
+	})
+	defer stop()
+	if size := (len(t.PieceHashes) + 7) / 8; len(c.Bitfield) < size { // room for the pieces announced later with `have`
+		c.Bitfield = append(c.Bitfield, make(bitfield.Bitfield, size-len(c.Bitfield))...)
+	}
+	if c.HaveAll {
+		t.setAll(c.Bitfield)
+	}
+	t.pieces.addPeer(c.Bitfield)
+	defer func() {
+		t.pieces.removePeer(c.Bitfield)
+	}()
+	p := t.connect(c, true) // the choker decides when to unchoke the peer
+	defer func() {
+		if ctx.Err() != nil { // stopped rather than failed
+			t.disconnect(p, nil)
+			return
+		}
+		t.disconnect(p, err)
+	}()
+	t.updateSeed(p)
+	done := make(chan struct{})
+	defer close(done)
+	p.messages = make(chan readResult)
+	go p.readLoop(done)
+	t.startPex(p, done)
+	err = t.sendBitfield(c)
+	if err == nil {
+		err = t.extend(c)
+	}
+	if err != nil {
+		return 0, err
+	}
 	_ = c.SendInterested()
-	c.ClientInfo.AmInterested = true
-	c.ClientInfo.AmChoking = false
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // put piece back to the queue
+	rejected := make(bitfield.Bitfield, len(c.Bitfield)) // pieces the peer refused to send us
+	var rejectedAt time.Time                             // of the first piece in `rejected`
+	for {
+		if !rejectedAt.IsZero() && time.Since(rejectedAt) >= rejectRetryInterval {
+			rejected, rejectedAt = make(bitfield.Bitfield, len(c.Bitfield)), time.Time{}
+		}
+		piece, ok := t.pickFor(p, rejected)
+		if !ok {
+			if t.pieces.isClosed() {
+				return received, nil
+			}
+			err = t.waitForPieces(p) // the peer has nothing we need for now
+			if err != nil {
+				return received, err
+			}
+			continue
+		}
+		complete, err := t.attemptDownloadPiece(p, piece)
+		if errors.Is(err, errRejected) { // leave the piece to other peers
+			t.pieces.leave(piece, p)
+			rejected.SetPiece(piece.index)
+			if rejectedAt.IsZero() {
+				rejectedAt = time.Now()
+			}
 			continue
 		}
-		var buf, err = attemptDownloadPiece(c, pw)
 		if err != nil {
-			log.Printf("exiting on error: %s\n", err)
-			workQueue <- pw // put piece back to the queue
-			return
+			t.pieces.leave(piece, p) // put piece back for another peer
+			return received, err
 		}
-		err = checkIntegrity(pw, buf)
+		if !complete { // completed by another peer in endgame
+			t.pieces.leave(piece, p)
+			continue
+		}
+		pw := &pieceWork{index: piece.index, hash: t.PieceHashes[piece.index], length: len(piece.buf)}
+		err = checkIntegrity(pw, piece.buf)
+		t.pieces.finish(piece, err == nil)
+		t.pieces.leave(piece, p)
 		if err != nil {
-			log.Printf("piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw
+			t.publish(Event{Type: PieceFailed, Piece: pw.index, Peer: c.Peer, Err: err})
 			continue
 		}
 		_ = c.SendHave(pw.index)
-		results <- &pieceResult{index: pw.index, buf: buf}
+		received++
+		results <- &pieceResult{index: pw.index, buf: piece.buf, peer: c.Peer} // read until every worker returns, even when cancelled
+	}
+}
+
+// pickFor picks a piece for a peer, never one it rejected lately. While a peer supporting the Fast extension chokes us,
+// only its allowed fast pieces are picked, so that other pieces are not held by a worker that cannot request them
+func (t *Torrent) pickFor(p *peerConn, rejected bitfield.Bitfield) (*activePiece, bool) {
+	fastOnly := p.client.SupportsFast() && p.client.Info().PeerChoking
+	return t.pieces.pick(p, t.available(p, rejected, fastOnly))
+}
+
+// available returns the pieces of a peer that can be picked, only the allowed fast ones when `fastOnly` is set
+func (t *Torrent) available(p *peerConn, rejected bitfield.Bitfield, fastOnly bool) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, len(p.client.Bitfield))
+	for index := range t.PieceHashes {
+		if p.client.Bitfield.HasPiece(index) && !rejected.HasPiece(index) && (!fastOnly || p.allowedFast[index]) {
+			bf.SetPiece(index)
+		}
+	}
+	return bf
+}
+
+// setAll sets every piece of the torrent in a bitfield, leaving the spare bits of the last byte unset
+func (t *Torrent) setAll(bf bitfield.Bitfield) {
+	for index := range t.PieceHashes {
+		bf.SetPiece(index)
+	}
+}
+
+// sendBitfield tells a peer which pieces we have, with `have all` or `have none` when the Fast extension allows
+func (t *Torrent) sendBitfield(c *client.Client) error {
+	bf := t.bitfield()
+	count := bf.Count()
+	switch {
+	case c.SupportsFast() && count == len(t.PieceHashes):
+		return c.SendHaveAll()
+	case c.SupportsFast() && count == 0:
+		return c.SendHaveNone()
+	case count == 0: // the bitfield may be omitted by peers with no pieces
+		return nil
+	}
+	return c.SendBitfield(bf)
+}
+
+// extend sends our extension protocol handshake to a peer supporting it, listing the extensions registered on the connection
+func (t *Torrent) extend(c *client.Client) error {
+	if !c.SupportsExtensions() {
+		return nil
+	}
+	return c.SendExtendedHandshake(client.ExtendedHandshake{P: int(t.Port)})
+}
+
+// waitForPieces reads messages from a peer for a while, until it announces new pieces or other peers give some up.
+// The picker wakes it up rather than a read deadline, which would lose a message read halfway
+func (t *Torrent) waitForPieces(p *peerConn) error {
+	state := pieceProgress{torrent: t, peer: p, client: p.client}
+	defer t.pieces.wait(p)()
+	timeout := time.NewTimer(pickRetryInterval)
+	defer timeout.Stop()
+	err := state.readMessage(timeout.C)
+	if errors.Is(err, errIdle) || errors.Is(err, errWoken) {
+		return nil
+	}
+	return err
+}
+
+// Left returns the number of bytes still missing from Storage
+func (t *Torrent) Left() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	left := t.Length
+	for index := range t.PieceHashes {
+		if t.Bitfield.HasPiece(index) {
+			left -= t.calculatePieceSize(index)
+		}
+	}
+	return left
+}
+
+// Uploaded returns the number of bytes sent to peers so far, as reported to trackers
+func (t *Torrent) Uploaded() int64 {
+	return t.uploaded.Load()
+}
+
+// Downloaded returns the number of bytes received from peers so far, as reported to trackers
+func (t *Torrent) Downloaded() int64 {
+	return t.downloaded.Load()
+}
+
+// connect registers a connected peer with the choker, and publishes it
+func (t *Torrent) connect(c *client.Client, outbound bool) *peerConn {
+	p := t.choker().add(c, outbound)
+	t.publish(Event{Type: PeerConnected, Peer: c.Peer})
+	return p
+}
+
+// disconnect forgets a peer that left because of `err`, and publishes it
+func (t *Torrent) disconnect(p *peerConn, err error) {
+	t.choker().remove(p)
+	t.publish(Event{Type: PeerDisconnected, Peer: p.client.Peer, Err: err})
+}
+
+// peerChoking records a `choke` or `unchoke` message received from a peer, and publishes it when the state changes
+func (t *Torrent) peerChoking(c *client.Client, choking bool) {
+	if c.Info().PeerChoking == choking {
+		return
 	}
+	c.SetPeerChoking(choking)
+	t.publish(Event{Type: PeerChoke, Peer: c.Peer, Choked: choking})
+}
+
+// hasPiece reports whether a piece is verified and in Storage, so that it can be served
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Bitfield.HasPiece(index)
+}
+
+// bitfield returns a copy of the pieces in Storage to send to a peer
+func (t *Torrent) bitfield() bitfield.Bitfield {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	copy(bf, t.Bitfield)
+	return bf
 }
 
 func (t *Torrent) calculatePieceSize(index int) int {
@@ -137,45 +507,78 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+func (t *Torrent) attemptDownloadPiece(p *peerConn, piece *activePiece) (bool, error) {
+	c := p.client
 	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+		torrent: t,
+		piece:   piece,
+		peer:    p,
+		client:  c,
 	}
-	_ = c.Conn.SetDeadline(time.Now().Add(30 * time.Second)) // setting a deadline helps get unresponsive peers unstuck
-	defer func(Conn net.Conn) {                              // 30 seconds is more than enough time to download a 262KB piece
-		_ = Conn.SetDeadline(time.Time{}) // disable the deadline
-	}(c.Conn)
-	for state.downloaded < pw.length {
-		if !state.client.ClientInfo.AmChoking { // if choked, send requests until we have enough unfulfilled requests
-			for state.backlogged < MaxBlockLog && state.requested < pw.length {
-				var blockSize = MaxBlockSize
-				if pw.length-state.requested < blockSize { // last block might be shorter than the typical block
-					blockSize = pw.length - state.requested
+	timeout := time.NewTimer(30 * time.Second) // setting a timeout helps get unresponsive peers unstuck
+	defer timeout.Stop()                       // 30 seconds is more than enough time to download a 262KB piece
+	for !state.complete && !t.pieces.isDone(piece) {
+		if !state.client.ClientInfo.PeerChoking || p.allowedFast[piece.index] { // if unchoked, send requests until we have enough unfulfilled requests
+			for t.pieces.backlog(piece, p) < MaxBlockLog {
+				begin, length, ok := t.pieces.nextBlock(piece, p)
+				if !ok { // every block left is already requested from this peer
+					break
 				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
+				err := c.SendRequest(piece.index, begin, length)
 				if err != nil {
-					return nil, err
-				} else {
-					state.backlogged++
-					state.requested += blockSize
+					return false, err
 				}
 			}
 		}
-		err := state.readMessage()
+		err := state.readMessage(timeout.C)
+		if errors.Is(err, errWoken) { // maybe as another peer completed the piece
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return false, err
 		}
 	}
-	return state.buf, nil
+	return state.complete, nil
 }
 
-// readMessage validates a message format
-func (state *pieceProgress) readMessage() error {
-	var msg, err = state.client.Read() // this call blocks
-	if err != nil {
-		return err
+// readLoop reads messages from the peer until the connection fails or `done` is closed, so that its download worker
+// can wait for them along with being woken up. Waking it up with a read deadline instead would lose half-read messages
+func (p *peerConn) readLoop(done <-chan struct{}) {
+	for {
+		msg, err := p.client.Read()
+		select {
+		case p.messages <- readResult{msg: msg, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wakeUp interrupts the wait of the download worker of the peer for its next message, if any
+func (p *peerConn) wakeUp() {
+	select {
+	case p.wake <- struct{}{}:
+	default: // already woken up, or not downloading
+	}
+}
+
+// readMessage waits for a message from the peer and handles it. It returns errWoken when woken up meanwhile,
+// and errIdle once `timeout` fires
+func (state *pieceProgress) readMessage(timeout <-chan time.Time) error {
+	var msg *message.Message
+	select {
+	case r := <-state.peer.messages:
+		if r.err != nil {
+			return r.err
+		}
+		msg = r.msg
+	case <-state.peer.wake:
+		return errWoken
+	case <-timeout:
+		return errIdle
 	}
 	if msg == nil {
 		return fmt.Errorf("empty message")
@@ -185,22 +588,70 @@ func (state *pieceProgress) readMessage() error {
 	}
 	switch msg.MessageID {
 	case message.MsgUnchoke:
-		state.client.ClientInfo.AmChoking = false
+		state.torrent.peerChoking(state.client, false)
 	case message.MsgChoke:
-		state.client.ClientInfo.AmChoking = true
+		state.torrent.peerChoking(state.client, true)
+		if state.piece != nil && !state.client.SupportsFast() { // pending requests are dropped by the peer, or rejected one by one with the Fast extension
+			state.torrent.pieces.unrequest(state.piece, state.peer)
+		}
+	case message.MsgInterested:
+		state.client.SetPeerInterested(true)
+		state.torrent.choker().rechoke()
+	case message.MsgNotInterested:
+		state.client.SetPeerInterested(false)
+		state.torrent.choker().rechoke()
+	case message.MsgRequest: // peers download from us over the same connection
+		return state.torrent.serveRequest(state.peer, msg)
+	case message.MsgExtended:
+		return state.client.HandleExtended(msg)
+	case message.MsgHaveAll, message.MsgHaveNone: // only valid in place of the bitfield
+		return fmt.Errorf("unexpected %s message", msg)
+	case message.MsgAllowedFast:
+		index, err := message.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		state.peer.allowedFast[index] = true
+	case message.MsgSuggest: // advisory only, pieces are still picked rarest first
+	case message.MsgReject:
+		index, begin, _, err := message.ParseReject(msg)
+		if err != nil {
+			return err
+		}
+		if state.piece == nil || index != state.piece.index {
+			return nil
+		}
+		state.torrent.pieces.reject(state.piece, state.peer, begin)
+		if !state.client.ClientInfo.PeerChoking || state.peer.allowedFast[index] { // a refusal rather than a choke
+			return errRejected
+		}
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		if !state.client.Bitfield.HasPiece(index) {
+			state.client.Bitfield.SetPiece(index)
+			state.torrent.pieces.have(index)
+			state.torrent.updateSeed(state.peer)
+		}
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, msg, state.buf)
+		index, begin, block, err := message.ParseBlock(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlogged--
+		if state.piece == nil || index != state.piece.index { // a late block of a piece done with
+			return nil
+		}
+		state.peer.downloaded.Add(int64(len(block)))
+		state.torrent.downloaded.Add(int64(len(block)))
+		state.torrent.downRate.add(len(block), time.Now())
+		state.torrent.publish(Event{Type: BlockReceived, Piece: index, Peer: state.client.Peer, Bytes: len(block)})
+		cancel, complete := state.torrent.pieces.receive(state.piece, state.peer, begin, block)
+		for _, other := range cancel { // endgame, the block was also requested from other peers
+			_ = other.client.SendCancel(index, begin, len(block))
+		}
+		state.complete = complete
 	}
 	return nil
 }
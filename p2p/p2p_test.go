@@ -0,0 +1,152 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/internal/peertest"
+	"bittorrent-client-go/message"
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// memStorage is an in-memory storage.Storage
+type memStorage struct {
+	buf []byte
+}
+
+func (m *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memStorage) Close() error {
+	return nil
+}
+
+func TestTorrent_Verify(t *testing.T) {
+	data := []byte("abcdefghij")
+	torrent := Torrent{
+		PieceHashes: [][20]byte{
+			sha1.Sum(data[0:4]),
+			sha1.Sum(data[4:8]),
+			sha1.Sum(data[8:10]),
+		},
+		PieceLength: 4,
+		Length:      len(data),
+		Storage:     &memStorage{buf: []byte("abcdXXXXij")},
+	}
+	bf, err := torrent.Verify()
+	require.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0b10100000}, bf)
+}
+
+func TestTorrent_Download_complete(t *testing.T) {
+	data := []byte("abcdefghij")
+	torrent := Torrent{
+		PieceHashes: [][20]byte{
+			sha1.Sum(data[0:4]),
+			sha1.Sum(data[4:8]),
+			sha1.Sum(data[8:10]),
+		},
+		PieceLength: 4,
+		Length:      len(data),
+		Storage:     &memStorage{buf: data},
+	}
+	err := torrent.Download(context.Background()) // no peers are needed, every piece is already there
+	assert.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0b11100000}, torrent.Bitfield)
+}
+
+func TestTorrent_Download_exhausted(t *testing.T) {
+	retry, maxRetry, timeout := peerRetryInterval, maxPeerRetryInterval, exhaustedTimeout
+	peerRetryInterval, maxPeerRetryInterval, exhaustedTimeout = time.Millisecond, time.Millisecond, 50*time.Millisecond
+	defer func() {
+		peerRetryInterval, maxPeerRetryInterval, exhaustedTimeout = retry, maxRetry, timeout
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	_ = ln.Close() // connections are refused
+	data := []byte("abcd")
+	requested := 0
+	torrent := Torrent{
+		Peers:        []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		RequestPeers: func() { requested++ },
+		PieceHashes:  [][20]byte{sha1.Sum(data)},
+		PieceLength:  4,
+		Length:       len(data),
+		Storage:      &memStorage{buf: make([]byte, len(data))},
+	}
+	err = torrent.Download(context.Background())
+	assert.ErrorIs(t, err, ErrSwarmExhausted)
+	assert.Positive(t, requested)
+}
+
+// serveChoking serves a peer that never unchokes us although it has every piece
+func serveChoking(t *testing.T, infoHash [20]byte) peers.Peer {
+	hello := []*message.Message{{MessageID: message.MsgBitfield, Payload: []byte{0xff}, Prefix: 2}}
+	return peertest.Serve(t, infoHash, [8]byte{}, hello, nil)
+}
+
+func TestTorrent_Download_cancel(t *testing.T) {
+	data := []byte("abcd")
+	infoHash := [20]byte{7}
+	torrent := Torrent{
+		Peers:       []peers.Peer{serveChoking(t, infoHash), serveChoking(t, infoHash)},
+		InfoHash:    infoHash,
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		PieceLength: 4,
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := torrent.Download(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second) // rather than the timeouts of the workers
+}
+
+func TestPieceProgress_readMessage_woken(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer func() {
+		_ = ours.Close()
+		_ = theirs.Close()
+	}()
+	c := &client.Client{Conn: ours}
+	c.SetPeerChoking(true)
+	p := &peerConn{client: c, messages: make(chan readResult), wake: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	defer close(done)
+	go p.readLoop(done)
+	state := pieceProgress{torrent: &Torrent{}, peer: p, client: c}
+
+	unchoke := (&message.Message{MessageID: message.MsgUnchoke, Prefix: 1}).Serialize()
+	_, err := theirs.Write(unchoke[:3]) // half of the message
+	require.Nil(t, err)
+	p.wakeUp()
+	assert.ErrorIs(t, state.readMessage(nil), errWoken)
+	go func() {
+		_, _ = theirs.Write(unchoke[3:])
+	}()
+	require.Nil(t, state.readMessage(nil)) // the rest of the message is not lost
+	assert.False(t, c.Info().PeerChoking)
+	assert.ErrorIs(t, state.readMessage(time.After(time.Millisecond)), errIdle)
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/peers"
+	"bittorrent-client-go/pex"
+	"time"
+)
+
+// exchanged returns the channel of the peers learned by peer exchange, buffered so that handlers rarely drop any
+func (t *Torrent) exchanged() chan []peers.Peer {
+	t.pexOnce.Do(func() {
+		t.pexFound = make(chan []peers.Peer, 16)
+	})
+	return t.pexFound
+}
+
+// startPex registers the peer exchange extension on a connection, before our extension protocol handshake lists it.
+// Peers learned from the peer are handed to Download, and the connected peers are advertised to it every pex.Interval until `done` is closed
+func (t *Torrent) startPex(p *peerConn, done <-chan struct{}) {
+	if !p.client.SupportsExtensions() || t.Private { // not even listed in our handshake for private torrents
+		return
+	}
+	p.pex = pex.NewExchange()
+	p.client.RegisterExtension(pex.ExtensionName, func(payload []byte) error {
+		u, err := p.pex.Receive(payload, time.Now())
+		if err != nil || u == nil { // malformed, or too frequent
+			return err
+		}
+		found := make([]peers.Peer, 0, len(u.Added))
+		for _, added := range u.Added {
+			found = append(found, added.Peer)
+		}
+		t.publish(Event{Type: PeerExchange, Peer: p.client.Peer, Peers: len(found)})
+		select {
+		case t.exchanged() <- found:
+		default: // Download is busy or not running, e.g. when seeding
+		}
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(pex.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if _, ok := p.client.PeerExtensionID(pex.ExtensionName); !ok {
+				continue
+			}
+			u := p.pex.Next(t.swarm(p))
+			if len(u.Added) == 0 && len(u.Dropped) == 0 {
+				continue
+			}
+			payload, err := u.Marshal()
+			if err == nil {
+				err = p.client.SendExtension(pex.ExtensionName, payload)
+			}
+			if err != nil {
+				t.publish(Event{Type: PeerExchange, Peer: p.client.Peer, Err: err})
+				return
+			}
+		}
+	}()
+}
+
+// swarm returns the connected peers to advertise to `to`, every other one whose listen address we know
+func (t *Torrent) swarm(to *peerConn) []pex.Peer {
+	ch := t.choker()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	var swarm []pex.Peer
+	for _, p := range ch.peers {
+		if p == to {
+			continue
+		}
+		addr, ok := p.listenAddr()
+		if !ok {
+			continue
+		}
+		var flags byte
+		if p.outbound {
+			flags |= pex.FlagReachable
+		}
+		if p.seed.Load() {
+			flags |= pex.FlagSeed
+		}
+		swarm = append(swarm, pex.Peer{Peer: addr, Flags: flags})
+	}
+	return swarm
+}
+
+// listenAddr returns the address a peer accepts connections on: the one we dialed,
+// or for incoming peers the port of their extension protocol handshake
+func (p *peerConn) listenAddr() (peers.Peer, bool) {
+	if p.outbound {
+		return p.client.Peer, true
+	}
+	h := p.client.PeerHandshake()
+	if h == nil || h.P <= 0 || h.P > 65535 {
+		return peers.Peer{}, false
+	}
+	return peers.Peer{IP: p.client.Peer.IP, Port: uint16(h.P)}, true
+}
+
+// updateSeed records whether a peer has every piece, from the goroutine reading its messages
+func (t *Torrent) updateSeed(p *peerConn) {
+	p.seed.Store(complete(p.client.Bitfield, len(t.PieceHashes)))
+}
+
+func complete(bf bitfield.Bitfield, numPieces int) bool {
+	for index := 0; index < numPieces; index++ {
+		if !bf.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
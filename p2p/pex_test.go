@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/handshake"
+	"bittorrent-client-go/internal/peertest"
+	"bittorrent-client-go/message"
+	"bittorrent-client-go/peers"
+	"bittorrent-client-go/pex"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// serveExchange serves a peer that has no pieces, and advertises `swarm` to it over ut_pex
+func serveExchange(t *testing.T, infoHash [20]byte, swarm []peers.Peer) peers.Peer {
+	var hs bytes.Buffer
+	_ = bencode.Marshal(&hs, client.ExtendedHandshake{M: map[string]int{pex.ExtensionName: 1}})
+	hello := []*message.Message{
+		{MessageID: message.MsgBitfield, Payload: []byte{0}, Prefix: 2},
+		message.FormatExtended(client.ExtendedHandshakeID, hs.Bytes()),
+	}
+	return peertest.Serve(t, infoHash, handshake.Reserved(handshake.ExtensionProtocol), hello, func(conn net.Conn, msg *message.Message) error {
+		if msg.MessageID != message.MsgExtended || msg.Payload[0] != client.ExtendedHandshakeID {
+			return nil
+		}
+		ours, err := client.ParseExtendedHandshake(msg.Payload[1:])
+		if err != nil {
+			return err
+		}
+		u := pex.Update{}
+		for _, p := range swarm {
+			u.Added = append(u.Added, pex.Peer{Peer: p, Flags: pex.FlagSeed})
+		}
+		payload, _ := u.Marshal()
+		_, err = conn.Write(message.FormatExtended(uint8(ours.M[pex.ExtensionName]), payload).Serialize())
+		return err
+	})
+}
+
+func TestTorrent_Download_pex(t *testing.T) {
+	data := make([]byte, 3*MaxBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	pieceLength := 2 * MaxBlockSize
+	hashes := [][20]byte{
+		sha1.Sum(data[:pieceLength]),
+		sha1.Sum(data[pieceLength:]),
+	}
+	seeder := startSeeder(t, data, pieceLength, hashes)
+	leecher := &Torrent{
+		Peers:       []peers.Peer{serveExchange(t, [20]byte{1, 2, 3}, []peers.Peer{seeder})},
+		PeerID:      [20]byte{'l'},
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+		Bitfield:    bitfield.Bitfield{0},
+	}
+	err := leecher.Download(context.Background()) // the seeder is only known from peer exchange
+	require.Nil(t, err)
+	assert.Equal(t, data, leecher.Storage.(*memStorage).buf)
+}
+
+func TestTorrent_startPex_private(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		ours, theirs := net.Pipe()
+		c := &client.Client{Conn: ours, Reserved: handshake.Reserved(handshake.ExtensionProtocol)}
+		done := make(chan struct{})
+		torrent := &Torrent{Private: private}
+		torrent.startPex(&peerConn{client: c}, done)
+		go func() {
+			_ = torrent.extend(c)
+		}()
+		msg, err := message.Read(theirs)
+		require.Nil(t, err)
+		h, err := client.ParseExtendedHandshake(msg.Payload[1:])
+		require.Nil(t, err)
+		_, listed := h.M[pex.ExtensionName]
+		assert.Equal(t, !private, listed) // BEP 27, peers of private torrents only come from trackers
+		close(done)
+		_ = ours.Close()
+		_ = theirs.Close()
+	}
+}
@@ -0,0 +1,335 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"math/rand"
+	"sync"
+)
+
+// randomPieces is the number of first picks made at random rather than rarest first,
+// since a complete piece is needed quickly to have something to upload in exchange
+const randomPieces int = 4
+
+// picker hands out the missing pieces of a torrent, the rarest first among those a peer has.
+// Once every missing piece is being downloaded, it enters endgame and hands out the same pieces to several peers
+type picker struct {
+	pieceSize      func(index int) int
+	endgameStarted func() // called when the endgame starts, outside of the lock, unless nil
+
+	mu           sync.Mutex
+	availability []int  // number of connected peers having each piece
+	missing      []bool // pieces neither in Storage nor being downloaded
+	numMissing   int
+	active       map[int]*activePiece
+	picked       int
+	endgame      bool
+	closed       bool
+	waiting      map[*peerConn]bool // workers with nothing to pick, woken up when a piece is put back
+}
+
+// activePiece is a piece being downloaded, by a single peer until the endgame where every peer having it may join.
+// Blocks go into a buffer shared by those peers, and a block received from one of them is cancelled at the others
+type activePiece struct {
+	index     int
+	buf       []byte
+	received  []bool              // by block
+	remaining int                 // blocks not received yet
+	requested map[int][]*peerConn // peers each block not received yet was requested from, by block
+	workers   map[*peerConn]bool
+	done      bool // every block was received
+}
+
+// newPicker returns a picker for the pieces missing from `have`
+func newPicker(numPieces int, have bitfield.Bitfield, pieceSize func(index int) int) *picker {
+	p := &picker{
+		pieceSize:    pieceSize,
+		availability: make([]int, numPieces),
+		missing:      make([]bool, numPieces),
+		active:       make(map[int]*activePiece),
+		waiting:      make(map[*peerConn]bool),
+	}
+	for index := range p.missing {
+		p.missing[index] = !have.HasPiece(index)
+		if p.missing[index] {
+			p.numMissing++
+		}
+	}
+	return p
+}
+
+// addPeer counts the pieces of a newly connected peer
+func (p *picker) addPeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]++
+		}
+	}
+}
+
+// removePeer forgets the pieces of a disconnected peer
+func (p *picker) removePeer(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index]--
+		}
+	}
+}
+
+// have counts a piece announced by a peer with a `have` message
+func (p *picker) have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// pick returns a piece for `peer` to download among those `bf` has,
+// or false when there is none, for now or for good once the picker is closed
+func (p *picker) pick(peer *peerConn, bf bitfield.Bitfield) (piece *activePiece, ok bool) {
+	started := false
+	p.mu.Lock()
+	defer func() {
+		p.mu.Unlock()
+		if started && p.endgameStarted != nil {
+			p.endgameStarted()
+		}
+	}()
+	if p.closed {
+		return nil, false
+	}
+	if p.numMissing == 0 {
+		before := p.endgame
+		piece, ok = p.join(peer, bf)
+		started = !before && p.endgame
+		return piece, ok
+	}
+	var candidates []int
+	for index, missing := range p.missing {
+		if !missing || !bf.HasPiece(index) {
+			continue
+		}
+		if p.picked >= randomPieces && len(candidates) > 0 {
+			rarest := p.availability[candidates[0]]
+			if p.availability[index] > rarest {
+				continue
+			}
+			if p.availability[index] < rarest {
+				candidates = candidates[:0]
+			}
+		}
+		candidates = append(candidates, index)
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	index := candidates[rand.Intn(len(candidates))] // ties are broken at random so that peers spread out
+	p.missing[index] = false
+	p.numMissing--
+	p.picked++
+	length := p.pieceSize(index)
+	blocks := (length + MaxBlockSize - 1) / MaxBlockSize
+	piece = &activePiece{
+		index:     index,
+		buf:       make([]byte, length),
+		received:  make([]bool, blocks),
+		remaining: blocks,
+		requested: make(map[int][]*peerConn),
+		workers:   map[*peerConn]bool{peer: true},
+	}
+	p.active[index] = piece
+	return piece, true
+}
+
+// join returns the piece being downloaded by the fewest peers that `peer` can help with, in endgame
+func (p *picker) join(peer *peerConn, bf bitfield.Bitfield) (*activePiece, bool) {
+	var best *activePiece
+	for index, piece := range p.active {
+		if piece.done || piece.workers[peer] || !bf.HasPiece(index) {
+			continue
+		}
+		if best == nil || len(piece.workers) < len(best.workers) {
+			best = piece
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	p.endgame = true
+	best.workers[peer] = true
+	return best, true
+}
+
+// nextBlock returns a block of the piece to request from `peer`, one that was neither received nor requested from it yet
+func (p *picker) nextBlock(piece *activePiece, peer *peerConn) (begin int, length int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for block, received := range piece.received {
+		if received || contains(piece.requested[block], peer) {
+			continue
+		}
+		piece.requested[block] = append(piece.requested[block], peer)
+		begin = block * MaxBlockSize
+		length = MaxBlockSize
+		if len(piece.buf)-begin < length { // last block might be shorter than the typical block
+			length = len(piece.buf) - begin
+		}
+		return begin, length, true
+	}
+	return 0, 0, false
+}
+
+// backlog returns the number of blocks of the piece requested from `peer` and not received yet
+func (p *picker) backlog(piece *activePiece, peer *peerConn) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, requested := range piece.requested {
+		if contains(requested, peer) {
+			n++
+		}
+	}
+	return n
+}
+
+// receive copies a block from `peer` into the piece, and returns the other peers the block must be cancelled at,
+// and whether it completed the piece. Blocks already received from another peer are ignored
+func (p *picker) receive(piece *activePiece, peer *peerConn, begin int, data []byte) (cancel []*peerConn, complete bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	block := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || block >= len(piece.received) || piece.received[block] || begin+len(data) > len(piece.buf) {
+		return nil, false
+	}
+	copy(piece.buf[begin:], data)
+	piece.received[block] = true
+	piece.remaining--
+	for _, other := range piece.requested[block] {
+		if other != peer {
+			cancel = append(cancel, other)
+		}
+	}
+	delete(piece.requested, block)
+	if piece.remaining == 0 {
+		piece.done = true
+		for other := range piece.workers {
+			if other != peer { // wake up the other peers waiting for blocks of the piece
+				other.wakeUp()
+			}
+		}
+		return cancel, true
+	}
+	return cancel, false
+}
+
+// isDone reports whether every block of the piece was received, possibly from another peer
+func (p *picker) isDone(piece *activePiece) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return piece.done
+}
+
+// unrequest forgets the blocks requested from `peer`, which drops them when choking us
+func (p *picker) unrequest(piece *activePiece, peer *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forget(piece, peer)
+}
+
+// reject forgets a block `peer` refused to send, so that it is requested again
+func (p *picker) reject(piece *activePiece, peer *peerConn, begin int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	block := begin / MaxBlockSize
+	requested := piece.requested[block]
+	for i, other := range requested {
+		if other == peer {
+			piece.requested[block] = append(requested[:i], requested[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *picker) forget(piece *activePiece, peer *peerConn) {
+	for block, requested := range piece.requested {
+		for i, other := range requested {
+			if other == peer {
+				piece.requested[block] = append(requested[:i], requested[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// leave stops `peer` from downloading the piece, which is put back once no peer is left on it
+func (p *picker) leave(piece *activePiece, peer *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(piece.workers, peer)
+	p.forget(piece, peer)
+	if !piece.done && len(piece.workers) == 0 && p.active[piece.index] == piece {
+		delete(p.active, piece.index)
+		p.putBack(piece.index)
+	}
+}
+
+// finish ends the download of a complete piece, putting it back when it failed the integrity check
+func (p *picker) finish(piece *activePiece, verified bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, piece.index)
+	if !verified {
+		p.putBack(piece.index)
+	}
+}
+
+// putBack makes a piece missing again, and wakes up the waiting workers so that one of them picks it
+func (p *picker) putBack(index int) {
+	p.missing[index] = true
+	p.numMissing++
+	for peer := range p.waiting {
+		peer.wakeUp()
+	}
+}
+
+// wait registers `peer` as having nothing to pick, until the returned function is called
+func (p *picker) wait(peer *peerConn) (done func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiting[peer] = true
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.waiting, peer)
+	}
+}
+
+// close stops handing out pieces once the download is over
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for peer := range p.waiting { // the download is over for them too
+		peer.wakeUp()
+	}
+}
+
+// isClosed reports whether the download is over
+func (p *picker) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func contains(peers []*peerConn, peer *peerConn) bool {
+	for _, other := range peers {
+		if other == peer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// fixedSize returns pieces of two blocks and a half
+func fixedSize(int) int {
+	return 2*MaxBlockSize + MaxBlockSize/2
+}
+
+func TestPicker_pick(t *testing.T) {
+	p := newPicker(8, bitfield.Bitfield{0b10000000}, fixedSize) // piece #0 is already there
+	p.picked = randomPieces                                     // past the random first picks
+	p.addPeer(bitfield.Bitfield{0b11110000})
+	p.addPeer(bitfield.Bitfield{0b01110000})
+	p.addPeer(bitfield.Bitfield{0b00110000})
+	p.have(3)
+	peer := &peerConn{}
+
+	piece, ok := p.pick(peer, bitfield.Bitfield{0b11110000})
+	require.True(t, ok)
+	assert.Equal(t, 1, piece.index) // held by two peers, where #2 and #3 are held by three
+	_, ok = p.pick(peer, bitfield.Bitfield{0b10000000})
+	assert.False(t, ok) // only a piece we have
+	other, ok := p.pick(peer, bitfield.Bitfield{0b01110000})
+	require.True(t, ok)
+	assert.Contains(t, []int{2, 3}, other.index)
+
+	p.leave(piece, peer)
+	piece, ok = p.pick(peer, bitfield.Bitfield{0b01000000})
+	require.True(t, ok)
+	assert.Equal(t, 1, piece.index)
+
+	p.removePeer(bitfield.Bitfield{0b11110000})
+	p.close()
+	_, ok = p.pick(peer, bitfield.Bitfield{0b11111111})
+	assert.False(t, ok)
+	assert.True(t, p.isClosed())
+}
+
+func TestPicker_wait(t *testing.T) {
+	p := newPicker(1, bitfield.Bitfield{0}, fixedSize)
+	worker, idle := &peerConn{}, &peerConn{wake: make(chan struct{}, 1)}
+	piece, ok := p.pick(worker, bitfield.Bitfield{0b10000000})
+	require.True(t, ok)
+	done := p.wait(idle) // nothing left to pick
+	p.leave(piece, worker)
+	assert.Len(t, idle.wake, 1) // picks it again
+	<-idle.wake
+	done()
+	piece, _ = p.pick(worker, bitfield.Bitfield{0b10000000})
+	p.leave(piece, worker)
+	assert.Empty(t, idle.wake) // no longer waiting
+}
+
+func TestPicker_pickRandomFirst(t *testing.T) {
+	p := newPicker(16, bitfield.Bitfield{0, 0}, fixedSize)
+	all := bitfield.Bitfield{0xff, 0xff}
+	p.addPeer(all)
+	p.addPeer(bitfield.Bitfield{0b10000000, 0})
+	picked := make(map[int]bool)
+	for i := 0; i < randomPieces; i++ {
+		piece, ok := p.pick(&peerConn{}, all)
+		require.True(t, ok)
+		picked[piece.index] = true
+	}
+	assert.Len(t, picked, randomPieces)
+	piece, ok := p.pick(&peerConn{}, all)
+	require.True(t, ok)
+	assert.NotEqual(t, 0, piece.index) // piece #0 is the most common one, when not picked at random already
+}
+
+func TestPicker_endgame(t *testing.T) {
+	p := newPicker(1, bitfield.Bitfield{0}, fixedSize)
+	started := 0
+	p.endgameStarted = func() {
+		started++
+	}
+	slow := &peerConn{client: newChokedPeer(t, false), wake: make(chan struct{}, 1)}
+	fast := &peerConn{client: newChokedPeer(t, false), wake: make(chan struct{}, 1)}
+	piece, ok := p.pick(slow, bitfield.Bitfield{0b10000000})
+	require.True(t, ok)
+	for i := 0; i < 3; i++ {
+		_, _, ok = p.nextBlock(piece, slow)
+		assert.True(t, ok)
+	}
+	_, _, ok = p.nextBlock(piece, slow)
+	assert.False(t, ok) // every block is requested
+	assert.Equal(t, 3, p.backlog(piece, slow))
+
+	joined, ok := p.pick(fast, bitfield.Bitfield{0b10000000})
+	require.True(t, ok)
+	assert.Same(t, piece, joined)
+	assert.True(t, p.endgame)
+	_, ok = p.pick(fast, bitfield.Bitfield{0b10000000})
+	assert.False(t, ok) // already on it
+	assert.Equal(t, 1, started)
+
+	begin, length, ok := p.nextBlock(piece, fast)
+	require.True(t, ok)
+	assert.Equal(t, 0, begin)
+	assert.Equal(t, MaxBlockSize, length)
+	cancel, complete := p.receive(piece, fast, begin, make([]byte, length))
+	assert.Equal(t, []*peerConn{slow}, cancel)
+	assert.False(t, complete)
+	cancel, complete = p.receive(piece, slow, begin, make([]byte, length))
+	assert.Nil(t, cancel) // a duplicate is ignored
+	assert.False(t, complete)
+	assert.Equal(t, 2, p.backlog(piece, slow))
+
+	p.unrequest(piece, slow) // choked
+	assert.Equal(t, 0, p.backlog(piece, slow))
+	_, _ = p.receive(piece, fast, MaxBlockSize, make([]byte, MaxBlockSize))
+	_, complete = p.receive(piece, slow, 2*MaxBlockSize, make([]byte, MaxBlockSize/2))
+	assert.True(t, complete)
+	assert.True(t, p.isDone(piece))
+	assert.Len(t, fast.wake, 1) // its worker stops waiting for the blocks
+	assert.Empty(t, slow.wake)
+
+	p.finish(piece, false) // failed the integrity check
+	p.leave(piece, slow)
+	p.leave(piece, fast)
+	assert.Equal(t, 1, p.numMissing)
+	assert.Empty(t, p.active)
+}
+
+func TestPicker_reject(t *testing.T) {
+	p := newPicker(1, bitfield.Bitfield{0}, fixedSize)
+	peer := &peerConn{}
+	piece, ok := p.pick(peer, bitfield.Bitfield{0b10000000})
+	require.True(t, ok)
+	begin, _, _ := p.nextBlock(piece, peer)
+	_, _, _ = p.nextBlock(piece, peer)
+	p.reject(piece, peer, begin)
+	assert.Equal(t, 1, p.backlog(piece, peer))
+	again, _, ok := p.nextBlock(piece, peer)
+	assert.True(t, ok)
+	assert.Equal(t, begin, again) // requested again
+}
@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"bittorrent-client-go/peers"
+	"errors"
+	"time"
+)
+
+// DefaultTargetPeers is the number of connections Download keeps open when Torrent.TargetPeers is not set
+const DefaultTargetPeers int = 30
+
+// maxPeerFailures is the number of failed connections in a row after which a peer is banned
+const maxPeerFailures = 5
+
+// peerRetryInterval is how long a peer is left alone after its connection failed, doubled after every other failure
+// up to maxPeerRetryInterval
+var (
+	peerRetryInterval    = 15 * time.Second
+	maxPeerRetryInterval = 15 * time.Minute
+)
+
+// exhaustedTimeout is how long Download waits for new peers once every known one is banned or gone for good
+var exhaustedTimeout = 5 * time.Minute
+
+// ErrSwarmExhausted is returned by Download when no peer is left to download from, and none was found for exhaustedTimeout
+var ErrSwarmExhausted = errors.New("swarm exhausted")
+
+// candidate is a known peer of the swarm
+type candidate struct {
+	peer      peers.Peer
+	failures  int       // failed connections in a row
+	retryAt   time.Time // not dialed before then
+	connected bool      // a worker is running for it
+	banned    bool
+}
+
+// peerPool keeps up to a target number of connections to the known peers of a torrent: peers are dialed as connections
+// free up, those whose connection fails are retried with exponential backoff, and banned once they failed maxPeerFailures
+// times in a row. It is only used by the goroutine running Download
+type peerPool struct {
+	target    int
+	known     map[string]*candidate // by address
+	order     []*candidate          // dialed first come, first served
+	connected int
+}
+
+func newPeerPool(target int) *peerPool {
+	if target <= 0 {
+		target = DefaultTargetPeers
+	}
+	return &peerPool{target: target, known: make(map[string]*candidate)}
+}
+
+// add records peers found by trackers, the DHT or peer exchange, and returns how many were not known yet
+func (pp *peerPool) add(found []peers.Peer) int {
+	added := 0
+	for _, peer := range found {
+		addr := peer.String()
+		if _, ok := pp.known[addr]; ok {
+			continue
+		}
+		c := &candidate{peer: peer}
+		pp.known[addr] = c
+		pp.order = append(pp.order, c)
+		added++
+	}
+	return added
+}
+
+// dial returns the peers to connect to now to reach the target, and counts them as connected
+func (pp *peerPool) dial(now time.Time) []peers.Peer {
+	var dial []peers.Peer
+	for _, c := range pp.order {
+		if pp.connected >= pp.target {
+			break
+		}
+		if c.connected || c.banned || now.Before(c.retryAt) {
+			continue
+		}
+		c.connected = true
+		pp.connected++
+		dial = append(dial, c.peer)
+	}
+	return dial
+}
+
+// disconnected records the end of a connection: a peer that sent verified pieces is retried soon,
+// the others later and later until they are banned
+func (pp *peerPool) disconnected(peer peers.Peer, pieces int, now time.Time) (banned bool) {
+	c, ok := pp.known[peer.String()]
+	if !ok || !c.connected {
+		return false
+	}
+	c.connected = false
+	pp.connected--
+	if pieces > 0 {
+		c.failures = 0
+		c.retryAt = now.Add(peerRetryInterval)
+		return false
+	}
+	c.failures++
+	if c.failures >= maxPeerFailures {
+		c.banned = true
+		return true
+	}
+	backoff := min(peerRetryInterval<<(c.failures-1), maxPeerRetryInterval)
+	c.retryAt = now.Add(backoff)
+	return false
+}
+
+// nextRetry returns when the next peer waiting for a retry can be dialed, if a connection is free by then
+func (pp *peerPool) nextRetry(now time.Time) (time.Time, bool) {
+	var next time.Time
+	if pp.connected >= pp.target { // dialed once a connection ends instead
+		return next, false
+	}
+	for _, c := range pp.order {
+		if c.connected || c.banned || !c.retryAt.After(now) {
+			continue
+		}
+		if next.IsZero() || c.retryAt.Before(next) {
+			next = c.retryAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// exhausted tells if no peer is connected nor will be retried
+func (pp *peerPool) exhausted() bool {
+	if pp.connected > 0 {
+		return false
+	}
+	for _, c := range pp.order {
+		if !c.banned {
+			return false
+		}
+	}
+	return true
+}
+
+// banned returns the number of banned peers
+func (pp *peerPool) banned() int {
+	n := 0
+	for _, c := range pp.order {
+		if c.banned {
+			n++
+		}
+	}
+	return n
+}
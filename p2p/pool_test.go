@@ -0,0 +1,62 @@
+package p2p
+
+import (
+	"bittorrent-client-go/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerPool(t *testing.T) {
+	pp := newPeerPool(2)
+	now := time.Now()
+	a := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	b := peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 2}
+	c := peers.Peer{IP: net.IP{10, 0, 0, 3}, Port: 3}
+	assert.Equal(t, 3, pp.add([]peers.Peer{a, b, c}))
+	assert.Equal(t, 0, pp.add([]peers.Peer{a})) // already known
+
+	assert.Equal(t, []peers.Peer{a, b}, pp.dial(now))
+	assert.Empty(t, pp.dial(now)) // at the target
+	_, ok := pp.nextRetry(now)
+	assert.False(t, ok)
+
+	assert.False(t, pp.disconnected(a, 0, now))
+	assert.Equal(t, []peers.Peer{c}, pp.dial(now)) // a is backing off
+	assert.False(t, pp.disconnected(b, 3, now))    // useful, retried soon
+	at, ok := pp.nextRetry(now)
+	require.True(t, ok)
+	assert.Equal(t, now.Add(peerRetryInterval), at)
+
+	for i := 2; i <= maxPeerFailures; i++ {
+		now = now.Add(maxPeerRetryInterval)
+		assert.Contains(t, pp.dial(now), a)
+		assert.Equal(t, i == maxPeerFailures, pp.disconnected(a, 0, now), i)
+	}
+	assert.Equal(t, 1, pp.banned())
+	assert.NotContains(t, pp.dial(now.Add(maxPeerRetryInterval)), a)
+	assert.False(t, pp.exhausted())
+}
+
+func TestPeerPool_backoff(t *testing.T) {
+	pp := newPeerPool(1)
+	now := time.Now()
+	a := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}
+	pp.add([]peers.Peer{a})
+	var waits []time.Duration
+	for i := 0; i < maxPeerFailures-1; i++ {
+		require.Equal(t, []peers.Peer{a}, pp.dial(now))
+		pp.disconnected(a, 0, now)
+		at, ok := pp.nextRetry(now)
+		require.True(t, ok)
+		waits = append(waits, at.Sub(now))
+		now = at
+	}
+	assert.Equal(t, []time.Duration{peerRetryInterval, 2 * peerRetryInterval, 4 * peerRetryInterval, 8 * peerRetryInterval}, waits)
+	pp.dial(now)
+	assert.False(t, pp.exhausted()) // still connected
+	pp.disconnected(a, 0, now)
+	assert.True(t, pp.exhausted())
+}
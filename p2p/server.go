@@ -0,0 +1,232 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/message"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRequestLength is the largest block a peer may request, larger requests get the peer disconnected
+const maxRequestLength int = 128 * 1024
+
+// idleTimeout disconnects incoming peers that stay silent, peers send a keep-alive every two minutes
+var idleTimeout = 3 * time.Minute
+
+// Server accepts incoming peers and uploads the pieces of the torrents added to it
+type Server struct {
+	PeerID   [20]byte
+	listener net.Listener
+
+	mu       sync.RWMutex
+	torrents map[[20]byte]*Torrent // by info hash
+	conns    map[net.Conn]struct{} // incoming peers, disconnected on Close
+	closed   bool
+	handlers sync.WaitGroup // one per connection in conns, waited for by Close
+}
+
+// Listen starts accepting peers on a TCP address, Serve must be called to handle them.
+// An address without a host, such as ":6881", accepts peers over both IPv4 and IPv6
+func Listen(addr string, peerID [20]byte) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		PeerID:   peerID,
+		listener: listener,
+		torrents: make(map[[20]byte]*Torrent),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Add makes a torrent available to incoming peers, routed by its info hash
+func (s *Server) Add(t *Torrent) {
+	t.Monitor.attach(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[t.InfoHash] = t
+}
+
+// Remove stops accepting peers for a torrent, peers already connected are kept
+func (s *Server) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// Serve accepts peers until the server is closed, which returns nil
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting peers, disconnects the ones connected and waits for their handlers to return,
+// after which the storage of the torrents is no longer read
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+	return err
+}
+
+func (s *Server) torrent(infoHash [20]byte) *Torrent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.torrents[infoHash]
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.handlers.Done()
+	defer func(conn net.Conn) {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}(conn)
+	c, err := client.Accept(conn, s.PeerID, func(infoHash [20]byte) bool {
+		return s.torrent(infoHash) != nil
+	})
+	if err != nil { // not tied to any torrent, whose Monitor could tell
+		return
+	}
+	t := s.torrent(c.InfoHash)
+	if t == nil { // removed during the handshake
+		return
+	}
+	_ = t.seedPeer(c) // published as PeerConnected and PeerDisconnected
+}
+
+// seedPeer uploads to a peer until it disconnects, whenever the choker unchokes it
+func (t *Torrent) seedPeer(c *client.Client) (err error) {
+	p := t.connect(c, false)
+	defer func() {
+		t.disconnect(p, err)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	t.startPex(p, done)
+	err = t.sendBitfield(c)
+	if err != nil {
+		return err
+	}
+	err = t.extend(c)
+	if err != nil {
+		return err
+	}
+	for {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := c.Read()
+		if err != nil {
+			return err
+		}
+		if msg == nil || msg.Prefix == uint32(0) { // keep-alive message
+			continue
+		}
+		switch msg.MessageID {
+		case message.MsgInterested:
+			c.SetPeerInterested(true)
+			t.choker().rechoke()
+		case message.MsgNotInterested:
+			c.SetPeerInterested(false)
+			t.choker().rechoke()
+		case message.MsgChoke:
+			t.peerChoking(c, true)
+		case message.MsgUnchoke:
+			t.peerChoking(c, false)
+		case message.MsgBitfield:
+			c.Bitfield = msg.Payload
+			t.updateSeed(p)
+		case message.MsgHaveAll:
+			c.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+			t.setAll(c.Bitfield)
+			t.updateSeed(p)
+		case message.MsgHaveNone:
+			c.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+		case message.MsgHave:
+			index, parseErr := message.ParseHave(msg)
+			if parseErr != nil {
+				return parseErr
+			}
+			if c.Bitfield == nil {
+				c.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+			}
+			c.Bitfield.SetPiece(index)
+			t.updateSeed(p)
+		case message.MsgRequest:
+			err = t.serveRequest(p, msg)
+		case message.MsgExtended:
+			err = c.HandleExtended(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveRequest answers a `request` message with a block read from Storage.
+// Requests that cannot be answered are dropped, and malformed ones are reported as errors
+func (t *Torrent) serveRequest(p *peerConn, msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if index >= len(t.PieceHashes) {
+		return fmt.Errorf("request for piece #%d out of %d", index, len(t.PieceHashes))
+	}
+	if length > maxRequestLength || begin+length > t.calculatePieceSize(index) {
+		return fmt.Errorf("bad request for %d bytes at %d of piece #%d", length, begin, index)
+	}
+	if p.client.Info().AmChoking || !t.hasPiece(index) { // sent before our choke arrived, or a piece we lack
+		if p.client.SupportsFast() { // such requests are rejected explicitly with the Fast extension
+			return p.client.SendReject(index, begin, length)
+		}
+		return nil
+	}
+	pieceBegin, _ := t.calculateBoundsForPiece(index)
+	block := make([]byte, length)
+	_, err = t.Storage.ReadAt(block, int64(pieceBegin+begin))
+	if err != nil {
+		return fmt.Errorf("reading piece #%d: %w", index, err)
+	}
+	err = p.client.SendPiece(index, begin, block)
+	if err != nil {
+		return err
+	}
+	p.uploaded.Add(int64(length))
+	t.uploaded.Add(int64(length))
+	t.upRate.add(length, time.Now())
+	t.publish(Event{Type: BlockSent, Piece: index, Peer: p.client.Peer, Bytes: length})
+	return nil
+}
@@ -0,0 +1,198 @@
+package p2p
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSeeder serves a complete copy of `data` on a loopback port
+func startSeeder(t *testing.T, data []byte, pieceLength int, hashes [][20]byte) peers.Peer {
+	seeder := &Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Storage:     &memStorage{buf: data},
+		Bitfield:    bitfield.Bitfield{0b11000000},
+	}
+	server, err := Listen("127.0.0.1:0", [20]byte{'s'})
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	server.Add(seeder)
+	go func() {
+		_ = server.Serve()
+	}()
+	addr := server.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestServer_seed(t *testing.T) {
+	tests := map[string]struct {
+		seeders int
+	}{
+		"single seeder":                  {seeders: 1},
+		"endgame across several seeders": {seeders: 3},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, 3*MaxBlockSize+100) // pieces of two blocks, the last one shorter
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			pieceLength := 2 * MaxBlockSize
+			hashes := [][20]byte{
+				sha1.Sum(data[:pieceLength]),
+				sha1.Sum(data[pieceLength:]),
+			}
+			var seeders []peers.Peer
+			for i := 0; i < test.seeders; i++ {
+				seeders = append(seeders, startSeeder(t, data, pieceLength, hashes))
+			}
+			leecher := &Torrent{
+				Peers:       seeders,
+				PeerID:      [20]byte{'l'},
+				InfoHash:    [20]byte{1, 2, 3},
+				PieceHashes: hashes,
+				PieceLength: pieceLength,
+				Length:      len(data),
+				Storage:     &memStorage{buf: make([]byte, len(data))},
+				Bitfield:    bitfield.Bitfield{0},
+			}
+			err := leecher.Download(context.Background())
+			require.Nil(t, err)
+			assert.Equal(t, data, leecher.Storage.(*memStorage).buf)
+			assert.Equal(t, 0, leecher.Left())
+		})
+	}
+}
+
+func TestServer_unknownTorrent(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", [20]byte{'s'})
+	require.Nil(t, err)
+	defer func(server *Server) {
+		_ = server.Close()
+	}(server)
+	go func() {
+		_ = server.Serve()
+	}()
+	addr := server.Addr().(*net.TCPAddr)
+	_, err = client.New(context.Background(), peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, [20]byte{'l'}, [20]byte{4, 5, 6})
+	assert.NotNil(t, err)
+}
+
+func TestServer_dualStack(t *testing.T) {
+	data := []byte("abcdefghij")
+	hashes := [][20]byte{sha1.Sum(data[:8]), sha1.Sum(data[8:])}
+	server, err := Listen(":0", [20]byte{'s'})
+	require.Nil(t, err)
+	defer func(server *Server) {
+		_ = server.Close()
+	}(server)
+	server.Add(&Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: 8,
+		Length:      len(data),
+		Storage:     &memStorage{buf: data},
+		Bitfield:    bitfield.Bitfield{0b11000000},
+	})
+	go func() {
+		_ = server.Serve()
+	}()
+	port := uint16(server.Addr().(*net.TCPAddr).Port)
+	for name, ip := range map[string]net.IP{"IPv4": net.IPv4(127, 0, 0, 1), "IPv6": net.IPv6loopback} {
+		t.Run(name, func(t *testing.T) {
+			leecher := &Torrent{
+				Peers:       []peers.Peer{{IP: ip, Port: port}},
+				PeerID:      [20]byte{'l'},
+				InfoHash:    [20]byte{1, 2, 3},
+				PieceHashes: hashes,
+				PieceLength: 8,
+				Length:      len(data),
+				Storage:     &memStorage{buf: make([]byte, len(data))},
+				Bitfield:    bitfield.Bitfield{0},
+			}
+			err := leecher.Download(context.Background())
+			require.Nil(t, err)
+			assert.Equal(t, data, leecher.Storage.(*memStorage).buf)
+		})
+	}
+}
+
+// stalledStorage blocks every read until `release` is closed, telling when one starts on `reading`
+type stalledStorage struct {
+	memStorage
+	reading chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (s *stalledStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.once.Do(func() {
+		close(s.reading)
+	})
+	<-s.release
+	return s.memStorage.ReadAt(p, off)
+}
+
+func TestServer_Close_waitsForHandlers(t *testing.T) {
+	data := []byte("abcdefgh")
+	store := &stalledStorage{memStorage: memStorage{buf: data}, reading: make(chan struct{}), release: make(chan struct{})}
+	server, err := Listen("127.0.0.1:0", [20]byte{'s'})
+	require.Nil(t, err)
+	server.Add(&Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		PieceLength: len(data),
+		Length:      len(data),
+		Storage:     store,
+		Bitfield:    bitfield.Bitfield{0b10000000},
+	})
+	go func() {
+		_ = server.Serve()
+	}()
+	addr := server.Addr().(*net.TCPAddr)
+	leecher := &Torrent{
+		Peers:       []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}},
+		PeerID:      [20]byte{'l'},
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: [][20]byte{sha1.Sum(data)},
+		PieceLength: len(data),
+		Length:      len(data),
+		Storage:     &memStorage{buf: make([]byte, len(data))},
+		Bitfield:    bitfield.Bitfield{0},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = leecher.Download(ctx)
+	}()
+	<-store.reading // serving a request
+	closed := make(chan struct{})
+	go func() {
+		_ = server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a request was read from storage")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return once the request was served")
+	}
+}
@@ -1,21 +1,33 @@
 package peers
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 )
 
 // Peer encodes connection information for a peer
 type Peer struct {
-	IP   net.IP // TODO: only IPv4 is supported
+	IP   net.IP // IPv4 or IPv6
 	Port uint16
+	ID   [20]byte // peer id expected in the handshake, zero when unknown as with the binary model
 }
 
-// Unmarshal parses peer IP addresses and ports from a buffer
-func Unmarshal(peersBin []byte) ([]Peer, error) { // TODO: only works for binary model
-	const peerSize = 6 // 4 for IPv4, 2 for port
+// Unmarshal parses peer IP addresses and ports from a buffer, in the binary model
+func Unmarshal(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv4len)
+}
+
+// Unmarshal6 parses IPv6 peer addresses and ports from a buffer, 18 bytes each
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	return unmarshal(peersBin, net.IPv6len)
+}
+
+func unmarshal(peersBin []byte, ipSize int) ([]Peer, error) {
+	var peerSize = ipSize + 2 // 2 for port
 	numPeers := len(peersBin) / peerSize
 	if len(peersBin)%peerSize != 0 {
 		err := fmt.Errorf("received malformed peers")
@@ -24,12 +36,81 @@ func Unmarshal(peersBin []byte) ([]Peer, error) { // TODO: only works for binary
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i = i + 1 {
 		offset := peerSize * i
-		peers[i].IP = peersBin[offset : offset+4]
-		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+4 : offset+6])
+		peers[i].IP = peersBin[offset : offset+ipSize]
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+ipSize : offset+peerSize])
 	}
 	return peers, nil
 }
 
+// UnmarshalDicts parses peers of the dictionary model, a decoded bencoded list of dictionaries with the keys
+// `ip` (an IP address or a DNS name), `port` and `peer id`, which trackers omit when asked for `no_peer_id`.
+// DNS names are resolved concurrently, and peers whose name does not resolve are left out
+func UnmarshalDicts(ctx context.Context, list []interface{}) ([]Peer, error) {
+	peers := make([]Peer, 0, len(list))
+	hosts := make([]string, 0, len(list))
+	for _, entry := range list {
+		dict, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a peer dictionary, got %T", entry)
+		}
+		host, ok := dict["ip"].(string)
+		if !ok {
+			return nil, fmt.Errorf("peer without ip")
+		}
+		port, ok := dict["port"].(int64)
+		if !ok || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("peer %s without a valid port", host)
+		}
+		var p = Peer{IP: net.ParseIP(host), Port: uint16(port)}
+		if id, ok := dict["peer id"].(string); ok {
+			if len(id) != len(p.ID) {
+				return nil, fmt.Errorf("peer %s with a peer id of length %d", host, len(id))
+			}
+			copy(p.ID[:], id)
+		}
+		peers = append(peers, p)
+		hosts = append(hosts, host)
+	}
+	var wg sync.WaitGroup
+	for i := range peers {
+		if peers[i].IP != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(p *Peer, host string) {
+			defer wg.Done()
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err == nil && len(addrs) > 0 {
+				p.IP = addrs[0].IP
+			}
+		}(&peers[i], hosts[i])
+	}
+	wg.Wait()
+	resolved := peers[:0]
+	for _, p := range peers {
+		if p.IP == nil { // unresolvable, the others are still worth a try
+			continue
+		}
+		if ip := p.IP.To4(); ip != nil {
+			p.IP = ip
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved, nil
+}
+
+// Marshal encodes peers in the binary model, IPv4 peers into `v4` and IPv6 peers into `v6`
+func Marshal(peers []Peer) (v4 []byte, v6 []byte) {
+	for _, p := range peers {
+		if ip := p.IP.To4(); ip != nil {
+			v4 = binary.BigEndian.AppendUint16(append(v4, ip...), p.Port)
+		} else if ip := p.IP.To16(); ip != nil {
+			v6 = binary.BigEndian.AppendUint16(append(v6, ip...), p.Port)
+		}
+	}
+	return v4, v6
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
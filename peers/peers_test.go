@@ -1,6 +1,7 @@
 package peers
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"net"
 	"testing"
@@ -55,3 +56,90 @@ func TestUnmarshal(t *testing.T) {
 		assert.Equal(t, test.output, peer)
 	}
 }
+
+func TestUnmarshal6(t *testing.T) {
+	var tests = map[string]struct {
+		input   []byte
+		output  []Peer
+		failure bool
+	}{
+		"correctly parses peers": {
+			input:  append([]byte(net.ParseIP("2001:db8::1").To16()), 0x1a, 0xe1),
+			output: []Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+		},
+		"IPv4 peers": {
+			input:   []byte{127, 0, 0, 1, 0x00, 0x50},
+			failure: true,
+		},
+	}
+	for _, test := range tests {
+		peer, err := Unmarshal6(test.input)
+		if test.failure {
+			assert.NotNil(t, err) // expected error
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, test.output, peer)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	v4, v6 := Marshal([]Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IP: net.ParseIP("1.1.1.1"), Port: 443}, // 16-byte form of an IPv4 address
+	})
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}, v4)
+	assert.Equal(t, append([]byte(net.ParseIP("2001:db8::1").To16()), 0x1a, 0xe1), v6)
+}
+
+func TestUnmarshalDicts(t *testing.T) {
+	var tests = map[string]struct {
+		input   []interface{}
+		output  []Peer
+		failure bool
+	}{
+		"correctly parses peers": {
+			input: []interface{}{
+				map[string]interface{}{"ip": "127.0.0.1", "port": int64(80), "peer id": "-BT0001-abcdefghijkl"},
+				map[string]interface{}{"ip": "2001:db8::1", "port": int64(6881)}, // no_peer_id
+			},
+			output: []Peer{
+				{IP: net.IP{127, 0, 0, 1}, Port: 80, ID: [20]byte{'-', 'B', 'T', '0', '0', '0', '1', '-', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l'}},
+				{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			},
+		},
+		"skips unresolvable hosts": {
+			input: []interface{}{
+				map[string]interface{}{"ip": "127.0.0.1", "port": int64(80)},
+				map[string]interface{}{"ip": "unresolvable.invalid", "port": int64(6881)},
+				map[string]interface{}{"ip": "2001:db8::1", "port": int64(6882)},
+			},
+			output: []Peer{
+				{IP: net.IP{127, 0, 0, 1}, Port: 80},
+				{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+			},
+		},
+		"missing port": {
+			input:   []interface{}{map[string]interface{}{"ip": "127.0.0.1"}},
+			failure: true,
+		},
+		"short peer id": {
+			input:   []interface{}{map[string]interface{}{"ip": "127.0.0.1", "port": int64(80), "peer id": "short"}},
+			failure: true,
+		},
+		"not a dictionary": {
+			input:   []interface{}{"127.0.0.1"},
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		peer, err := UnmarshalDicts(context.Background(), test.input)
+		if test.failure {
+			assert.NotNil(t, err, name) // expected error
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, peer, name)
+	}
+}
@@ -0,0 +1,207 @@
+package pex
+
+import (
+	"bittorrent-client-go/peers"
+	"bytes"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"sync"
+	"time"
+)
+
+// The peer exchange extension (BEP 11) lets connected peers tell each other about the rest of the swarm.
+// Every message is an extended message whose payload is a bencoded dictionary of the peers connected
+// and disconnected since the previous message, in the binary model, with one byte of flags per added peer:
+// d5:added12:<IPv4 peers>7:added.f2:<flags>6:added618:<IPv6 peers>8:added6.f1:<flags>7:dropped6:<IPv4 peers>8:dropped60:e
+
+// ExtensionName is the name of the peer exchange extension in the `m` dictionary of the extension protocol handshake
+const ExtensionName = "ut_pex"
+
+// MaxPeers is the largest number of peers added, and of peers dropped, in a single message
+const MaxPeers int = 50
+
+// Flags of an added peer
+const (
+	FlagEncryption byte = 0x01 // prefers encrypted connections
+	FlagSeed       byte = 0x02 // is a seed
+	FlagUTP        byte = 0x04 // supports uTP
+	FlagHolepunch  byte = 0x08 // supports the holepunch extension
+	FlagReachable  byte = 0x10 // accepts incoming connections, as the sender connected to it
+)
+
+// Interval is how often messages are sent on a connection. Messages received sooner than half of it after
+// the previous one are ignored, tolerating peers whose timers drift but not peers flooding us
+var Interval = time.Minute
+
+// message is the bencoded payload of a ut_pex message
+type message struct {
+	Added    string `bencode:"added,omitempty"`
+	AddedF   string `bencode:"added.f,omitempty"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// Peer is a peer of the swarm, as advertised with its flags
+type Peer struct {
+	peers.Peer
+	Flags byte
+}
+
+// Update lists the peers connected and disconnected since the previous message
+type Update struct {
+	Added   []Peer
+	Dropped []peers.Peer
+}
+
+// Marshal encodes an update as the payload of a ut_pex message
+func (u *Update) Marshal() ([]byte, error) {
+	var msg message
+	var added4, added6 []peers.Peer
+	var flags4, flags6 []byte
+	for _, p := range u.Added {
+		if p.IP.To4() != nil {
+			added4 = append(added4, p.Peer)
+			flags4 = append(flags4, p.Flags)
+		} else {
+			added6 = append(added6, p.Peer)
+			flags6 = append(flags6, p.Flags)
+		}
+	}
+	v4, _ := peers.Marshal(added4)
+	_, v6 := peers.Marshal(added6)
+	msg.Added, msg.AddedF = string(v4), string(flags4)
+	msg.Added6, msg.Added6F = string(v6), string(flags6)
+	dropped4, dropped6 := peers.Marshal(u.Dropped)
+	msg.Dropped, msg.Dropped6 = string(dropped4), string(dropped6)
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal parses the payload of a ut_pex message. Flags are optional, and ignored when they do not match the peers.
+// The payload is decoded generically rather than into a message, so that a peer sending keys of the wrong type gets an error
+func Unmarshal(payload []byte) (*Update, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a dictionary, got %T", decoded)
+	}
+	var msg message
+	for key, field := range map[string]*string{
+		"added":    &msg.Added,
+		"added.f":  &msg.AddedF,
+		"added6":   &msg.Added6,
+		"added6.f": &msg.Added6F,
+		"dropped":  &msg.Dropped,
+		"dropped6": &msg.Dropped6,
+	} {
+		value, ok := dict[key]
+		if !ok {
+			continue
+		}
+		if *field, ok = value.(string); !ok {
+			return nil, fmt.Errorf("expected a string for %q, got %T", key, value)
+		}
+	}
+	var u Update
+	added, err := peers.Unmarshal([]byte(msg.Added))
+	if err != nil {
+		return nil, err
+	}
+	u.Added = withFlags(u.Added, added, msg.AddedF)
+	added, err = peers.Unmarshal6([]byte(msg.Added6))
+	if err != nil {
+		return nil, err
+	}
+	u.Added = withFlags(u.Added, added, msg.Added6F)
+	dropped, err := peers.Unmarshal([]byte(msg.Dropped))
+	if err != nil {
+		return nil, err
+	}
+	u.Dropped = append(u.Dropped, dropped...)
+	dropped, err = peers.Unmarshal6([]byte(msg.Dropped6))
+	if err != nil {
+		return nil, err
+	}
+	u.Dropped = append(u.Dropped, dropped...)
+	return &u, nil
+}
+
+func withFlags(added []Peer, found []peers.Peer, flags string) []Peer {
+	for i, p := range found {
+		var f byte
+		if len(flags) == len(found) {
+			f = flags[i]
+		}
+		added = append(added, Peer{Peer: p, Flags: f})
+	}
+	return added
+}
+
+// Exchange is the peer exchange over one connection: it remembers what was advertised to the peer so that
+// only changes are sent, and when the peer last sent a message so that it cannot flood us
+type Exchange struct {
+	mu       sync.Mutex
+	sent     map[string]Peer // by address
+	received time.Time       // when the last message of the peer was accepted
+}
+
+// NewExchange creates the peer exchange of a new connection, to which nothing was advertised yet
+func NewExchange() *Exchange {
+	return &Exchange{sent: make(map[string]Peer)}
+}
+
+// Next returns the update that brings the peer from what was advertised so far to `swarm`, and records it as sent.
+// At most MaxPeers are added and MaxPeers dropped, the rest is left to the following updates
+func (e *Exchange) Next(swarm []Peer) Update {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var u Update
+	current := make(map[string]bool, len(swarm))
+	for _, p := range swarm {
+		addr := p.String()
+		current[addr] = true
+		if _, ok := e.sent[addr]; ok || len(u.Added) == MaxPeers {
+			continue
+		}
+		e.sent[addr] = p
+		u.Added = append(u.Added, p)
+	}
+	for addr, p := range e.sent {
+		if len(u.Dropped) == MaxPeers {
+			break
+		}
+		if !current[addr] {
+			delete(e.sent, addr)
+			u.Dropped = append(u.Dropped, p.Peer)
+		}
+	}
+	return u
+}
+
+// Receive parses a message of the peer, and returns a nil update when it came too soon after the previous one.
+// At most MaxPeers added peers are kept
+func (e *Exchange) Receive(payload []byte, now time.Time) (*Update, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.received.IsZero() && now.Sub(e.received) < Interval/2 {
+		return nil, nil
+	}
+	u, err := Unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	e.received = now
+	if len(u.Added) > MaxPeers {
+		u.Added = u.Added[:MaxPeers]
+	}
+	return u, nil
+}
@@ -0,0 +1,130 @@
+package pex
+
+import (
+	"bittorrent-client-go/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdate_Marshal(t *testing.T) {
+	u := Update{
+		Added: []Peer{
+			{Peer: peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 80}, Flags: FlagSeed | FlagReachable},
+			{Peer: peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, Flags: FlagReachable},
+		},
+		Dropped: []peers.Peer{{IP: net.IP{1, 1, 1, 1}, Port: 443}},
+	}
+	payload, err := u.Marshal()
+	require.Nil(t, err)
+	assert.Equal(t, "d5:added6:\x7f\x00\x00\x01\x00\x507:added.f1:\x12"+
+		"6:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe18:added6.f1:\x10"+
+		"7:dropped6:\x01\x01\x01\x01\x01\xbbe", string(payload))
+
+	parsed, err := Unmarshal(payload)
+	require.Nil(t, err)
+	require.Len(t, parsed.Added, 2)
+	assert.Equal(t, "127.0.0.1:80", parsed.Added[0].String())
+	assert.Equal(t, FlagSeed|FlagReachable, parsed.Added[0].Flags)
+	assert.Equal(t, "[2001:db8::1]:6881", parsed.Added[1].String())
+	assert.Equal(t, FlagReachable, parsed.Added[1].Flags)
+	require.Len(t, parsed.Dropped, 1)
+	assert.Equal(t, "1.1.1.1:443", parsed.Dropped[0].String())
+}
+
+func TestUnmarshal(t *testing.T) {
+	var tests = map[string]struct {
+		input   string
+		added   int
+		flags   byte
+		failure bool
+	}{
+		"without flags": {
+			input: "d5:added6:\x7f\x00\x00\x01\x00\x50e",
+			added: 1,
+		},
+		"flags not matching the peers": {
+			input: "d5:added6:\x7f\x00\x00\x01\x00\x507:added.f2:\x02\x02e",
+			added: 1,
+		},
+		"empty": {
+			input: "de",
+		},
+		"malformed peers": {
+			input:   "d5:added5:\x7f\x00\x00\x01\x00e",
+			failure: true,
+		},
+		"peers of the wrong type": {
+			input:   "d5:addedi1ee",
+			failure: true,
+		},
+		"not a dictionary": {
+			input:   "i1e",
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		u, err := Unmarshal([]byte(test.input))
+		if test.failure {
+			assert.NotNil(t, err, name) // expected error
+			continue
+		}
+		require.Nil(t, err, name)
+		require.Len(t, u.Added, test.added, name)
+		for _, p := range u.Added {
+			assert.Equal(t, test.flags, p.Flags, name)
+		}
+	}
+}
+
+func TestExchange_Next(t *testing.T) {
+	e := NewExchange()
+	a := Peer{Peer: peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 1}}
+	b := Peer{Peer: peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 2}}
+
+	u := e.Next([]Peer{a, b})
+	assert.ElementsMatch(t, []Peer{a, b}, u.Added)
+	assert.Empty(t, u.Dropped)
+	u = e.Next([]Peer{b})
+	assert.Empty(t, u.Added) // already advertised
+	assert.Equal(t, []peers.Peer{a.Peer}, u.Dropped)
+
+	var swarm []Peer
+	for i := 0; i < MaxPeers+10; i++ {
+		swarm = append(swarm, Peer{Peer: peers.Peer{IP: net.IP{10, 0, 1, byte(i)}, Port: 6881}})
+	}
+	u = e.Next(swarm)
+	assert.Len(t, u.Added, MaxPeers)
+	assert.Equal(t, []peers.Peer{b.Peer}, u.Dropped)
+	u = e.Next(swarm)
+	assert.Len(t, u.Added, 10) // the rest
+}
+
+func TestExchange_Receive(t *testing.T) {
+	e := NewExchange()
+	now := time.Now()
+	payload := []byte("d5:added6:\x7f\x00\x00\x01\x00\x50e")
+
+	u, err := e.Receive(payload, now)
+	require.Nil(t, err)
+	require.NotNil(t, u)
+	assert.Len(t, u.Added, 1)
+	u, err = e.Receive(payload, now.Add(Interval/4))
+	assert.Nil(t, err)
+	assert.Nil(t, u) // too frequent
+	u, err = e.Receive(payload, now.Add(Interval))
+	assert.Nil(t, err)
+	assert.NotNil(t, u)
+
+	var many []Peer
+	for i := 0; i < 2*MaxPeers; i++ {
+		many = append(many, Peer{Peer: peers.Peer{IP: net.IP{10, 0, 0, byte(i)}, Port: 6881}})
+	}
+	payload, err = (&Update{Added: many}).Marshal()
+	require.Nil(t, err)
+	u, err = e.Receive(payload, now.Add(2*Interval))
+	require.Nil(t, err)
+	assert.Len(t, u.Added, MaxPeers)
+}
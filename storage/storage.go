@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Storage holds the torrent data addressed by absolute byte offsets,
+// as if all files of the torrent were concatenated
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Close() error
+}
+
+// File describes a file on disk backing a range of the torrent data
+type File struct {
+	Path   string
+	Length int
+}
+
+type openFile struct {
+	file   *os.File
+	offset int64 // absolute offset of the first byte of the file
+	length int64
+}
+
+// Files is a Storage spreading the torrent data over one or more files
+type Files struct {
+	files  []openFile
+	length int64
+}
+
+// NewFiles opens, or creates, the given files in order and preallocates them to their final length
+func NewFiles(files []File) (*Files, error) {
+	s := &Files{}
+	for _, f := range files {
+		if f.Length < 0 {
+			_ = s.Close()
+			return nil, fmt.Errorf("file %s has negative length %d", f.Path, f.Length)
+		}
+		err := os.MkdirAll(filepath.Dir(f.Path), 0755)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, openFile{file: file, offset: s.length, length: int64(f.Length)})
+		s.length += int64(f.Length)
+		info, err := file.Stat()
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		if info.Size() != int64(f.Length) { // sparse on most file systems, so this is cheap
+			err = file.Truncate(int64(f.Length))
+			if err != nil {
+				_ = s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// find returns the index of the file containing the absolute offset `off`
+func (s *Files) find(off int64) int {
+	return sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].offset+s.files[i].length > off
+	})
+}
+
+// WriteAt writes `p` at the absolute offset `off`, crossing file boundaries as needed
+func (s *Files) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, fmt.Errorf("write of %d bytes at offset %d out of bounds (length %d)", len(p), off, s.length)
+	}
+	written := 0
+	for i := s.find(off); written < len(p) && i < len(s.files); i++ {
+		f := s.files[i]
+		begin := off + int64(written) - f.offset
+		end := int64(len(p)-written) + begin
+		if end > f.length {
+			end = f.length
+		}
+		n, err := f.file.WriteAt(p[written:written+int(end-begin)], begin)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadAt reads len(p) bytes from the absolute offset `off`, crossing file boundaries as needed
+func (s *Files) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= s.length {
+		return 0, io.EOF
+	}
+	read := 0
+	for i := s.find(off); read < len(p) && i < len(s.files); i++ {
+		f := s.files[i]
+		begin := off + int64(read) - f.offset
+		end := int64(len(p)-read) + begin
+		if end > f.length {
+			end = f.length
+		}
+		n, err := f.file.ReadAt(p[read:read+int(end-begin)], begin)
+		read += n
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if int64(n) < end-begin { // file shorter than expected, e.g. modified on disk
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Sync commits the contents of all files to stable storage
+func (s *Files) Sync() error {
+	for _, f := range s.files {
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all files, returning the first error encountered
+func (s *Files) Close() error {
+	var first error
+	for _, f := range s.files {
+		if err := f.file.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.files = nil
+	return first
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFiles([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3},
+		{Path: filepath.Join(dir, "sub", "b"), Length: 5},
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+	info, err := os.Stat(filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), info.Size())
+	info, err = os.Stat(filepath.Join(dir, "sub", "b"))
+	require.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+}
+
+func TestFiles_WriteAtReadAt(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFiles([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3},
+		{Path: filepath.Join(dir, "empty"), Length: 0},
+		{Path: filepath.Join(dir, "b"), Length: 5},
+		{Path: filepath.Join(dir, "c"), Length: 2},
+	})
+	require.Nil(t, err)
+	defer func(s *Files) {
+		_ = s.Close()
+	}(s)
+	n, err := s.WriteAt([]byte("bcdefgh"), 1) // spans all non-empty files
+	require.Nil(t, err)
+	assert.Equal(t, 7, n)
+	n, err = s.WriteAt([]byte("hij"), 8)
+	assert.NotNil(t, err) // out of bounds
+	assert.Equal(t, 0, n)
+	_, err = s.WriteAt([]byte("a"), 0)
+	require.Nil(t, err)
+	_, err = s.WriteAt([]byte("ij"), 8)
+	require.Nil(t, err)
+	buf := make([]byte, 10)
+	n, err = s.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []byte("abcdefghij"), buf)
+	buf = make([]byte, 4)
+	n, err = s.ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("ij"), buf[:n])
+	a, err := os.ReadFile(filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abc"), a)
+	b, err := os.ReadFile(filepath.Join(dir, "b"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("defgh"), b)
+}
+
+func TestNewFiles_keepsExistingData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a")
+	require.Nil(t, os.WriteFile(path, []byte("abc"), 0644))
+	s, err := NewFiles([]File{{Path: path, Length: 5}})
+	require.Nil(t, err)
+	defer func(s *Files) {
+		_ = s.Close()
+	}(s)
+	buf := make([]byte, 5)
+	_, err = s.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte{'a', 'b', 'c', 0, 0}, buf)
+}
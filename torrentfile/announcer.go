@@ -0,0 +1,276 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/peers"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// announceInterval is how often trackers are announced to when they do not say,
+// and announceRetryInterval how soon an announce is retried once every tracker failed
+var (
+	announceInterval      = 30 * time.Minute
+	announceRetryInterval = time.Minute
+)
+
+// stoppedTimeout is how long shutting down waits for the `stopped` announce
+var stoppedTimeout = 5 * time.Second
+
+// transfer is the progress reported to trackers, as kept by p2p.Torrent
+type transfer interface {
+	Left() int
+	Uploaded() int64
+	Downloaded() int64
+}
+
+// announcer keeps the trackers of a torrent informed for as long as it is downloaded or seeded:
+// `started` first, then a regular announce every interval the trackers ask for, `completed` once the
+// download completes, and `stopped` on shutdown
+type announcer struct {
+	t        *TorrentFile
+	tiers    *trackerTiers
+	peerID   [20]byte
+	port     uint16
+	transfer transfer
+
+	mu          sync.Mutex
+	trackerIDs  map[string]string    // `tracker id` by announce URL, echoed back to the same tracker
+	interval    time.Duration        // between regular announces, as asked by the last tracker that answered
+	minInterval time.Duration        // regular announces are never sent sooner than this after the previous one
+	retryAt     map[string]time.Time // trackers that failed asking not to be announced to before then, the zero time for never
+	last        time.Time            // when the last announce was sent
+
+	started      bool // a tracker answered the `started` event, guarded by mu
+	completed    chan struct{}
+	completeOnce sync.Once
+	wake         chan struct{} // asks for an announce as soon as the min interval allows
+	stop         chan struct{}
+	done         chan struct{} // closed once run returns
+}
+
+func (t *TorrentFile) newAnnouncer(peerID [20]byte, port uint16, progress transfer) *announcer {
+	return &announcer{
+		t:          t,
+		tiers:      t.trackers(),
+		peerID:     peerID,
+		port:       port,
+		transfer:   progress,
+		trackerIDs: make(map[string]string),
+		retryAt:    make(map[string]time.Time),
+		interval:   announceInterval,
+		completed:  make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// announce sends an event with the current progress, failing over between trackers as requestPeers does,
+// and returns the peers of the tracker that answered
+func (a *announcer) announce(ctx context.Context, event string) ([]peers.Peer, error) {
+	params := announceParams{
+		peerID:     a.peerID,
+		port:       a.port,
+		left:       a.transfer.Left(),
+		uploaded:   a.transfer.Uploaded(),
+		downloaded: a.transfer.Downloaded(),
+		event:      event,
+	}
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+	var found []peers.Peer
+	err := a.tiers.try(func(announce string) error {
+		a.mu.Lock()
+		params.trackerID = a.trackerIDs[announce]
+		retryAt, backingOff := a.retryAt[announce]
+		a.mu.Unlock()
+		if backingOff && retryAt.IsZero() {
+			return fmt.Errorf("tracker asked never to retry")
+		}
+		if backingOff && time.Now().Before(retryAt) {
+			return fmt.Errorf("tracker asked to retry at %s", retryAt.Format(time.TimeOnly))
+		}
+		trackerResp, err := a.t.announceTo(ctx, announce, params)
+		var trackerErr *TrackerError
+		if errors.As(err, &trackerErr) {
+			a.backOff(announce, trackerErr.RetryIn)
+		}
+		if err != nil {
+			a.t.Monitor.Publish(p2p.Event{Type: p2p.TrackerAnnounce, Tracker: announce, Announce: event, Err: err})
+			return err
+		}
+		a.update(announce, trackerResp)
+		found, _ = trackerResp.peers(ctx) // a tracker without peers still answered
+		a.t.Monitor.Publish(p2p.Event{Type: p2p.TrackerAnnounce, Tracker: announce, Announce: event, Peers: len(found)})
+		return nil
+	})
+	return found, err
+}
+
+// update records the intervals and the tracker id of a response
+func (a *announcer) update(announce string, trackerResp *trackerResponse) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.retryAt, announce)
+	if trackerResp.TrackerID != "" {
+		a.trackerIDs[announce] = trackerResp.TrackerID
+	}
+	a.interval = announceInterval
+	if trackerResp.Interval > 0 {
+		a.interval = time.Duration(trackerResp.Interval) * time.Second
+	}
+	a.minInterval = time.Duration(trackerResp.MinInterval) * time.Second
+}
+
+// backOff records the `retry in` of a tracker failure, so that the tracker is skipped meanwhile
+func (a *announcer) backOff(announce string, retryIn time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case retryIn == RetryNever:
+		a.retryAt[announce] = time.Time{}
+	case retryIn > 0:
+		a.retryAt[announce] = time.Now().Add(retryIn)
+	default:
+		delete(a.retryAt, announce)
+	}
+}
+
+// next returns how long to wait before the next regular announce, sooner when the last one failed
+func (a *announcer) next(failed bool) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	wait := a.interval
+	if failed {
+		wait = announceRetryInterval
+	}
+	if wait < a.minInterval {
+		wait = a.minInterval
+	}
+	return wait
+}
+
+// sooner returns how long to wait before an early announce, so that it is not sent before the min interval
+func (a *announcer) sooner() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return max(a.minInterval-time.Since(a.last), 0)
+}
+
+// start sends the `started` event and returns the peers of the tracker that answered
+func (a *announcer) start(ctx context.Context) ([]peers.Peer, error) {
+	found, err := a.announce(ctx, eventStarted)
+	if err == nil {
+		a.mu.Lock()
+		a.started = true
+		a.mu.Unlock()
+	}
+	return found, err
+}
+
+// isStarted tells if a tracker answered the `started` event
+func (a *announcer) isStarted() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.started
+}
+
+// run announces regularly until close is called or `ctx` is done, sending the peers found to `found` unless it is nil.
+// It starts with the `started` event unless start was called, so that callers do not wait for slow trackers
+func (a *announcer) run(ctx context.Context, found chan<- []peers.Peer) {
+	defer close(a.done)
+	if a.tiers.empty() { // e.g. a trackerless magnet link
+		return
+	}
+	completed := a.completed
+	failed := false
+	next := time.After(a.next(failed))
+	if !a.isStarted() {
+		next = time.After(0)
+	}
+	for {
+		var err error
+		select {
+		case <-a.wake:
+			next = time.After(a.sooner())
+			continue
+		case <-a.stop:
+			a.shutdown(completed)
+			return
+		case <-ctx.Done():
+			a.shutdown(completed)
+			return
+		case <-completed:
+			completed = nil
+			_, err = a.announce(ctx, eventCompleted)
+		case <-next:
+			var ps []peers.Peer
+			if a.isStarted() {
+				ps, err = a.announce(ctx, eventNone)
+			} else {
+				ps, err = a.start(ctx)
+			}
+			if len(ps) > 0 && found != nil {
+				select {
+				case found <- ps:
+				case <-a.stop:
+				case <-ctx.Done():
+				}
+			}
+		}
+		failed = err != nil
+		if failed {
+			log.Printf("could not announce to trackers: %v\n", err)
+		}
+		next = time.After(a.next(failed))
+	}
+}
+
+// shutdown sends the `stopped` event, after `completed` when the download completed right before,
+// with a context of its own as the one of run is usually cancelled by then. Trackers never started with are left alone
+func (a *announcer) shutdown(completed <-chan struct{}) {
+	if !a.isStarted() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	select {
+	case <-completed: // still worth counting
+		_, _ = a.announce(ctx, eventCompleted)
+	default:
+	}
+	_, err := a.announce(ctx, eventStopped)
+	if err != nil {
+		log.Printf("could not announce to trackers: %v\n", err)
+	}
+}
+
+// more asks run for more peers with an early announce, without waiting for it
+func (a *announcer) more() {
+	select {
+	case a.wake <- struct{}{}:
+	default: // already asked
+	}
+}
+
+// complete sends the `completed` event, once
+func (a *announcer) complete() {
+	a.completeOnce.Do(func() {
+		close(a.completed)
+	})
+}
+
+// close stops run, which sends the `stopped` event, and waits for it at most stoppedTimeout
+func (a *announcer) close() {
+	close(a.stop)
+	select {
+	case <-a.done:
+	case <-time.After(stoppedTimeout):
+	}
+}
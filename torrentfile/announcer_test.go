@@ -0,0 +1,195 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/peers"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixedTransfer is a transfer that does not progress
+type fixedTransfer struct {
+	left             int
+	uploaded, downld int64
+}
+
+func (f *fixedTransfer) Left() int         { return f.left }
+func (f *fixedTransfer) Uploaded() int64   { return f.uploaded }
+func (f *fixedTransfer) Downloaded() int64 { return f.downld }
+
+func TestAnnouncer_lifecycle(t *testing.T) {
+	interval := announceInterval
+	announceInterval = 20 * time.Millisecond // the tracker does not say
+	defer func() {
+		announceInterval = interval
+	}()
+	requests := make(chan url.Values, 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Query()
+		_, _ = w.Write([]byte("d10:tracker id3:abc5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, InfoHash: [20]byte{1, 2, 3}}
+	a := tf.newAnnouncer([20]byte{'p'}, 6882, &fixedTransfer{left: 100, uploaded: 5, downld: 7})
+
+	found, err := a.start(context.Background())
+	require.Nil(t, err)
+	assert.Len(t, found, 1)
+	q := <-requests
+	assert.Equal(t, eventStarted, q.Get("event"))
+	assert.Equal(t, "100", q.Get("left"))
+	assert.Equal(t, "5", q.Get("uploaded"))
+	assert.Equal(t, "7", q.Get("downloaded"))
+	assert.False(t, q.Has("trackerid"))
+
+	foundCh := make(chan []peers.Peer)
+	go a.run(context.Background(), foundCh)
+	assert.Len(t, <-foundCh, 1) // a regular announce
+	go func() {
+		for range foundCh {
+		}
+	}()
+	q = <-requests
+	assert.False(t, q.Has("event"))
+	assert.Equal(t, "abc", q.Get("trackerid")) // echoed
+
+	a.complete()
+	a.close()
+	close(foundCh)
+	var events []string
+	for len(requests) > 0 {
+		if q := <-requests; q.Has("event") {
+			events = append(events, q.Get("event"))
+		}
+	}
+	assert.Equal(t, []string{eventCompleted, eventStopped}, events)
+}
+
+func TestAnnouncer_retryIn(t *testing.T) {
+	var announces atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces.Add(1)
+		_, _ = w.Write([]byte("d14:failure reason4:busy8:retry ini60ee"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, Monitor: &p2p.Monitor{}}
+	var events []p2p.Event
+	tf.Monitor.Subscribe(func(e p2p.Event) {
+		events = append(events, e)
+	})
+	a := tf.newAnnouncer([20]byte{}, 6882, &fixedTransfer{})
+	_, err := a.start(context.Background())
+	var trackerErr *TrackerError
+	require.ErrorAs(t, err, &trackerErr)
+	assert.Equal(t, time.Hour, trackerErr.RetryIn)
+	require.Len(t, events, 1)
+	assert.Equal(t, p2p.TrackerAnnounce, events[0].Type)
+	assert.Equal(t, ts.URL, events[0].Tracker)
+	assert.Equal(t, eventStarted, events[0].Announce)
+	assert.ErrorAs(t, events[0].Err, &trackerErr)
+	_, err = a.announce(context.Background(), eventNone)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), announces.Load()) // not hammered
+
+	a.backOff(ts.URL, 0) // the hour has passed
+	_, _ = a.announce(context.Background(), eventNone)
+	assert.Equal(t, int32(2), announces.Load())
+}
+
+func TestAnnouncer_more(t *testing.T) {
+	requests := make(chan url.Values, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Query()
+		_, _ = w.Write([]byte("d8:intervali1800e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL}
+	a := tf.newAnnouncer([20]byte{}, 6882, &fixedTransfer{})
+	_, err := a.start(context.Background())
+	require.Nil(t, err)
+	<-requests
+	found := make(chan []peers.Peer)
+	go a.run(context.Background(), found)
+	defer a.close()
+	a.more()
+	a.more() // already asked
+	select {
+	case ps := <-found:
+		assert.Len(t, ps, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no early announce")
+	}
+	assert.False(t, (<-requests).Has("event"))
+}
+
+func TestAnnouncer_cancel(t *testing.T) {
+	requests := make(chan url.Values, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Query()
+		_, _ = w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL}
+	a := tf.newAnnouncer([20]byte{}, 6882, &fixedTransfer{})
+	_, err := a.start(context.Background())
+	require.Nil(t, err)
+	<-requests
+	ctx, cancel := context.WithCancel(context.Background())
+	go a.run(ctx, nil)
+	cancel() // still announces `stopped`, although its context is done
+	select {
+	case <-a.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return")
+	}
+	require.Len(t, requests, 1)
+	assert.Equal(t, eventStopped, (<-requests).Get("event"))
+	a.close()
+}
+
+func TestAnnouncer_runStarts(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("event") == eventStarted {
+			<-release // a slow tracker
+		}
+		_, _ = w.Write([]byte("d8:intervali1800e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL}
+	a := tf.newAnnouncer([20]byte{}, 6882, &fixedTransfer{})
+	found := make(chan []peers.Peer)
+	go a.run(context.Background(), found) // returns right away, the `started` event is sent from run
+	assert.Eventually(t, func() bool {
+		return requests.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	assert.Len(t, <-found, 1)
+	assert.True(t, a.isStarted())
+	a.close()
+	assert.Equal(t, int32(2), requests.Load()) // then `stopped`
+}
+
+func TestAnnouncer_next(t *testing.T) {
+	a := (&TorrentFile{Announce: "http://tracker.example/announce"}).newAnnouncer([20]byte{}, 6882, &fixedTransfer{})
+	assert.Equal(t, announceInterval, a.next(false))
+
+	a.update("http://tracker.example/announce", &trackerResponse{Interval: 1800, MinInterval: 900})
+	assert.Equal(t, 30*time.Minute, a.next(false))
+	assert.Equal(t, 15*time.Minute, a.next(true)) // a retry still waits for the min interval
+
+	a.update("http://tracker.example/announce", &trackerResponse{Interval: 60, MinInterval: 120})
+	assert.Equal(t, 2*time.Minute, a.next(false))
+	a.update("http://tracker.example/announce", &trackerResponse{})
+	assert.Equal(t, announceInterval, a.next(false))
+	assert.Equal(t, announceRetryInterval, a.next(true))
+}
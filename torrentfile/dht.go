@@ -0,0 +1,96 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/dht"
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/peers"
+	"context"
+	"fmt"
+	"time"
+)
+
+// DHTBootstrapNodes are the nodes used to join the Mainline DHT, peer discovery through the DHT is disabled when empty
+var DHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// dhtInterval is how often the DHT is asked for more peers during a download
+var dhtInterval = 5 * time.Minute
+
+// joinDHT starts a node on `port`, or on any port if it is taken, and joins the DHT through DHTBootstrapNodes.
+// It returns a nil node and no error if the DHT is disabled
+func joinDHT(ctx context.Context, port uint16) (*dht.Node, error) {
+	if len(DHTBootstrapNodes) == 0 {
+		return nil, nil
+	}
+	config := dht.Config{Addr: fmt.Sprintf(":%d", port), Bootstrap: DHTBootstrapNodes}
+	node, err := dht.New(config)
+	if err != nil {
+		config.Addr = ":0"
+		node, err = dht.New(config)
+		if err != nil {
+			return nil, fmt.Errorf("could not start DHT node: %w", err)
+		}
+	}
+	err = node.Bootstrap(ctx)
+	if err != nil {
+		_ = node.Close()
+		return nil, fmt.Errorf("could not join the DHT: %w", err)
+	}
+	return node, nil
+}
+
+// discover runs discoverPeers in the background, the returned function stops it and waits for the DHT node to close
+func (t *TorrentFile) discover(ctx context.Context, port uint16, found chan<- []peers.Peer) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.discoverPeers(ctx, port, found)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// discoverPeers joins the DHT, unless the torrent is private (BEP 27), then announces the torrent every dhtInterval
+// and sends the peers found along the way, until `ctx` is done. Every announce is published to the Monitor
+func (t *TorrentFile) discoverPeers(ctx context.Context, port uint16, found chan<- []peers.Peer) {
+	if t.Private {
+		return
+	}
+	node, err := joinDHT(ctx, port)
+	if err != nil && ctx.Err() == nil {
+		t.Monitor.Publish(p2p.Event{Type: p2p.DHTAnnounce, Err: err})
+	}
+	if node == nil {
+		return
+	}
+	defer func(node *dht.Node) {
+		_ = node.Close()
+	}(node)
+	ticker := time.NewTicker(dhtInterval)
+	defer ticker.Stop()
+	for {
+		ps, err := node.Announce(ctx, t.InfoHash, port)
+		if ctx.Err() != nil {
+			return
+		}
+		t.Monitor.Publish(p2p.Event{Type: p2p.DHTAnnounce, Peers: len(ps), Err: err})
+		if len(ps) > 0 && found != nil { // nil when only announcing, e.g. while seeding
+			select {
+			case found <- ps:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/dht"
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/peers"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// useDHT points DHTBootstrapNodes to a local DHT node for the duration of a test
+func useDHT(t *testing.T) *dht.Node {
+	root, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	nodes := DHTBootstrapNodes
+	DHTBootstrapNodes = []string{root.Addr().String()}
+	t.Cleanup(func() {
+		DHTBootstrapNodes = nodes
+		_ = root.Close()
+	})
+	return root
+}
+
+func TestJoinDHT(t *testing.T) {
+	nodes := DHTBootstrapNodes
+	DHTBootstrapNodes = nil
+	node, err := joinDHT(context.Background(), 0) // disabled
+	assert.Nil(t, node)
+	assert.Nil(t, err)
+	DHTBootstrapNodes = nodes
+	useDHT(t)
+	node, err = joinDHT(context.Background(), 0)
+	require.Nil(t, err)
+	assert.Equal(t, 1, node.Nodes())
+	_ = node.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	node, err = joinDHT(ctx, 0)
+	assert.Nil(t, node)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTorrentFile_discoverPeers(t *testing.T) {
+	root := useDHT(t)
+	infoHash := [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+	seeder, err := dht.New(dht.Config{Addr: "127.0.0.1:0", Bootstrap: []string{root.Addr().String()}})
+	require.Nil(t, err)
+	defer func(seeder *dht.Node) {
+		_ = seeder.Close()
+	}(seeder)
+	require.Nil(t, seeder.Bootstrap(context.Background()))
+	_, err = seeder.Announce(context.Background(), infoHash, 6881)
+	require.Nil(t, err)
+
+	tf := TorrentFile{InfoHash: infoHash, Monitor: &p2p.Monitor{}}
+	events := make(chan p2p.Event, 1)
+	tf.Monitor.Subscribe(func(e p2p.Event) {
+		events <- e
+	})
+	found := make(chan []peers.Peer)
+	stop := tf.discover(context.Background(), 6882, found)
+	select {
+	case ps := <-found:
+		require.Len(t, ps, 1)
+		assert.True(t, ps[0].IP.Equal(net.IP{127, 0, 0, 1}))
+		assert.Equal(t, uint16(6881), ps[0].Port)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peer discovered")
+	}
+	stop()
+	e := <-events
+	assert.Equal(t, p2p.DHTAnnounce, e.Type)
+	assert.Equal(t, 1, e.Peers)
+	assert.Nil(t, e.Err)
+
+	known := root.Nodes()
+	tf.Private = true // never joins the DHT (BEP 27)
+	stop = tf.discover(context.Background(), 6882, found)
+	stop()
+	assert.Equal(t, known, root.Nodes())
+}
@@ -0,0 +1,185 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/client"
+	"bittorrent-client-go/magnet"
+	"bittorrent-client-go/metadata"
+	"bittorrent-client-go/peers"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"log"
+	"net"
+	"strconv"
+)
+
+// maxMetadataPeers is the largest number of peers asked for the metadata at the same time
+const maxMetadataPeers = 30
+
+// ParseMagnet returns the torrent of a magnet link without fetching its metadata,
+// which is enough to scrape its trackers but not to download it
+func ParseMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return fromMagnet(m), nil
+}
+
+// fromMagnet returns what a magnet link tells about its torrent: the info hash, the name and the trackers
+func fromMagnet(m *magnet.Magnet) TorrentFile {
+	tf := TorrentFile{
+		InfoHash: m.InfoHash,
+		Name:     m.Name,
+	}
+	for _, tracker := range m.Trackers { // one tier per tracker, so that they are tried in the given order
+		tf.AnnounceList = append(tf.AnnounceList, []string{tracker})
+	}
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+	}
+	tf.tiers = newTrackerTiers(tf.Announce, tf.AnnounceList)
+	return tf
+}
+
+// OpenMagnet fetches the info dictionary of a magnet link from peers (BEP 9),
+// found in the link itself or through its trackers, and returns the torrent it describes
+func OpenMagnet(ctx context.Context, uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf := fromMagnet(m)
+	var peerID [20]byte
+	_, err = rand.Read(peerID[:]) // randomly generated peer ID
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	candidates, err := magnetPeers(ctx, m.Peers)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if len(tf.AnnounceList) > 0 {
+		found, err := tf.requestPeers(ctx, announceParams{peerID: peerID, port: Port})
+		if ctx.Err() != nil {
+			return TorrentFile{}, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("could not get peers from trackers: %v\n", err)
+		}
+		candidates = append(candidates, found...)
+	}
+	if len(candidates) == 0 { // trackerless magnet, or dead trackers
+		node, err := joinDHT(ctx, Port)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("%v\n", err)
+		}
+		if node != nil {
+			found, err := node.GetPeers(ctx, m.InfoHash)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("could not get peers from the DHT: %v\n", err)
+			}
+			candidates = append(candidates, found...)
+			_ = node.Close()
+		}
+	}
+	raw, err := fetchMetadata(ctx, candidates, peerID, m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return tf.withInfo(raw)
+}
+
+// magnetPeers resolves the `x.pe` peer addresses of a magnet link, leaving out the invalid or unresolvable ones.
+// It returns ctx.Err() if `ctx` is done before they are resolved
+func magnetPeers(ctx context.Context, addrs []string) ([]peers.Peer, error) {
+	dicts := make([]interface{}, 0, len(addrs))
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			log.Printf("invalid peer %s: %v\n", addr, err)
+			continue
+		}
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || number == 0 {
+			log.Printf("invalid peer %s: port %q\n", addr, port)
+			continue
+		}
+		dicts = append(dicts, map[string]interface{}{"ip": host, "port": int64(number)})
+	}
+	found, err := peers.UnmarshalDicts(ctx, dicts)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return found, err
+}
+
+// fetchMetadata asks several peers at once for the info dictionary and returns the first verified one.
+// The other peers are disconnected once it returns
+func fetchMetadata(ctx context.Context, candidates []peers.Peer, peerID [20]byte, infoHash [20]byte) ([]byte, error) {
+	if len(candidates) > maxMetadataPeers {
+		candidates = candidates[:maxMetadataPeers]
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no peer found")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan []byte, len(candidates))
+	for _, peer := range candidates {
+		go func(peer peers.Peer) {
+			c, err := client.New(ctx, peer, peerID, infoHash)
+			if err != nil {
+				results <- nil
+				return
+			}
+			defer func(Conn net.Conn) {
+				_ = Conn.Close()
+			}(c.Conn)
+			stop := context.AfterFunc(ctx, func() {
+				_ = c.Conn.Close()
+			})
+			defer stop()
+			raw, err := metadata.Fetch(c)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("could not fetch metadata from %s: %v\n", peer, err)
+			}
+			results <- raw
+		}(peer)
+	}
+	for range candidates {
+		select {
+		case raw := <-results:
+			if raw != nil {
+				return raw, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("could not fetch metadata from any of %d peers", len(candidates))
+}
+
+// withInfo completes a torrent known only by its info hash with its verified info dictionary
+func (t *TorrentFile) withInfo(raw []byte) (TorrentFile, error) {
+	bto := BencodeTorrent{
+		Announce:     t.Announce,
+		AnnounceList: t.AnnounceList,
+		rawInfo:      raw,
+	}
+	err := bencode.Unmarshal(bytes.NewReader(raw), &bto.Info)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	tf, err := bto.toTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	if tf.InfoHash != t.InfoHash {
+		return TorrentFile{}, fmt.Errorf("expected info hash %x, got %x", t.InfoHash, tf.InfoHash)
+	}
+	tf.tiers = t.trackers() // same trackers, as promoted while looking for peers
+	return tf, nil
+}
@@ -0,0 +1,78 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/peers"
+	"context"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestTorrentFile_withInfo(t *testing.T) {
+	info := []byte("d6:lengthi300e4:name6:debian12:piece lengthi262144e6:pieces20:1234567890abcdefghij7:privatei1ee")
+	tf := TorrentFile{
+		Announce:     "udp://tracker.example.org:1337",
+		AnnounceList: [][]string{{"udp://tracker.example.org:1337"}},
+		InfoHash:     sha1.Sum(info),
+		Name:         "display name",
+	}
+	full, err := tf.withInfo(info)
+	assert.Nil(t, err)
+	assert.Same(t, tf.trackers(), full.tiers)
+	full.tiers = nil
+	assert.Equal(t, TorrentFile{
+		Announce:     "udp://tracker.example.org:1337",
+		AnnounceList: [][]string{{"udp://tracker.example.org:1337"}},
+		InfoHash:     sha1.Sum(info),
+		PieceHashes:  [][20]byte{{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106}},
+		PieceLength:  262144,
+		Length:       300,
+		Name:         "debian",
+		Private:      true,
+	}, full)
+	tf.InfoHash = [20]byte{1}
+	_, err = tf.withInfo(info)
+	assert.NotNil(t, err)
+	_, err = tf.withInfo([]byte("not bencoded"))
+	assert.NotNil(t, err)
+}
+
+func TestParseMagnet(t *testing.T) {
+	tf, err := ParseMagnet("magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0d&dn=debian&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A6969")
+	require.Nil(t, err)
+	assert.NotNil(t, tf.tiers)
+	tf.tiers = nil
+	assert.Equal(t, TorrentFile{
+		Announce:     "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce"}, {"udp://b:6969"}},
+		InfoHash:     [20]byte{0x12, 0xd8, 0xf5, 0xed, 0x6a, 0xe7, 0x6e, 0x10, 0x53, 0x92, 0x87, 0x1f, 0x2f, 0x40, 0x46, 0xff, 0xea, 0x8b, 0x9e, 0x0d},
+		Name:         "debian",
+	}, tf)
+	_, err = ParseMagnet("magnet:?dn=no+info+hash")
+	assert.NotNil(t, err)
+}
+
+func TestMagnetPeers(t *testing.T) {
+	found, err := magnetPeers(context.Background(), []string{"10.0.0.1:6881", "[::1]:6882", "no port", "10.0.0.2:0", "10.0.0.3:65536"})
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{
+		{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+		{IP: net.ParseIP("::1"), Port: 6882},
+	}, found)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = magnetPeers(ctx, []string{"peer.example.org:6881"})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = OpenMagnet(ctx, "magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0d&x.pe=peer.example.org%3A6881")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestOpenMagnet_noPeers(t *testing.T) {
+	useDHT(t) // knows no peer either
+	_, err := OpenMagnet(context.Background(), "magnet:?xt=urn:btih:12d8f5ed6ae76e105392871f2f4046ffea8b9e0d")
+	assert.NotNil(t, err)
+	_, err = OpenMagnet(context.Background(), "magnet:?dn=no+info+hash")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,99 @@
+package torrentfile
+
+import (
+	"fmt"
+)
+
+// maxDepth bounds the nesting of lists and dictionaries accepted by scanValue
+const maxDepth = 64
+
+// rawInfo returns the exact bytes of the `info` value of a bencoded .torrent file,
+// so that the info hash covers every key, including the ones bencodeInfo does not model
+func rawInfo(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != 'd' {
+		return nil, fmt.Errorf("expected a bencoded dictionary")
+	}
+	pos := 1
+	for pos < len(buf) && buf[pos] != 'e' {
+		keyEnd, err := scanValue(buf, pos, 0)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseString(buf[pos:keyEnd])
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := scanValue(buf, keyEnd, 0)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			if buf[keyEnd] != 'd' {
+				return nil, fmt.Errorf("expected <info> to be a dictionary")
+			}
+			return buf[keyEnd:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("no <info> dictionary found")
+}
+
+// scanValue returns the offset right after the bencoded value starting at buf[pos]
+func scanValue(buf []byte, pos int, depth int) (int, error) {
+	if depth > maxDepth {
+		return 0, fmt.Errorf("bencoded value nested too deeply")
+	}
+	if pos >= len(buf) {
+		return 0, fmt.Errorf("unexpected end of data at offset %d", pos)
+	}
+	switch c := buf[pos]; {
+	case c == 'i':
+		for end := pos + 1; end < len(buf); end++ {
+			if buf[end] == 'e' {
+				return end + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated integer at offset %d", pos)
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(buf) && buf[pos] != 'e' {
+			end, err := scanValue(buf, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = end
+		}
+		if pos >= len(buf) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		length := 0
+		for pos < len(buf) && buf[pos] >= '0' && buf[pos] <= '9' {
+			length = length*10 + int(buf[pos]-'0')
+			if length > len(buf) {
+				return 0, fmt.Errorf("string length exceeds data at offset %d", pos)
+			}
+			pos++
+		}
+		if pos >= len(buf) || buf[pos] != ':' {
+			return 0, fmt.Errorf("expected ':' at offset %d", pos)
+		}
+		if pos+1+length > len(buf) {
+			return 0, fmt.Errorf("string length exceeds data at offset %d", pos)
+		}
+		return pos + 1 + length, nil
+	default:
+		return 0, fmt.Errorf("unexpected byte %q at offset %d", c, pos)
+	}
+}
+
+// parseString returns the contents of a bencoded string such as `4:info`
+func parseString(buf []byte) (string, error) {
+	for i, c := range buf {
+		if c == ':' {
+			return string(buf[i+1:]), nil
+		}
+	}
+	return "", fmt.Errorf("expected a bencoded string as dictionary key")
+}
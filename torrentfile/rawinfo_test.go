@@ -0,0 +1,54 @@
+package torrentfile
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRawInfo(t *testing.T) {
+	var tests = map[string]struct {
+		input   string
+		output  string
+		failure bool
+	}{
+		"info after other keys": {
+			input:   "d8:announce3:url4:infod4:name1:a7:privatei1eee",
+			output:  "d4:name1:a7:privatei1ee",
+			failure: false,
+		},
+		"nested values before info": {
+			input:   "d13:announce-listll1:a1:bel1:cee4:infod6:lengthi-3eee",
+			output:  "d6:lengthi-3ee",
+			failure: false,
+		},
+		"no info": {
+			input:   "d8:announce3:urle",
+			failure: true,
+		},
+		"info is not a dictionary": {
+			input:   "d4:info3:abce",
+			failure: true,
+		},
+		"truncated string": {
+			input:   "d4:infod4:name10:abcee",
+			failure: true,
+		},
+		"unterminated dictionary": {
+			input:   "d4:infod4:name1:a",
+			failure: true,
+		},
+		"not a dictionary": {
+			input:   "l4:infoe",
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		raw, err := rawInfo([]byte(test.input))
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, string(raw), name)
+		}
+	}
+}
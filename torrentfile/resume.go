@@ -0,0 +1,94 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/storage"
+	"bytes"
+	"github.com/jackpal/bencode-go"
+	"os"
+	"path/filepath"
+)
+
+// resumeFile records the state of a data file when the fast-resume sidecar was written
+type resumeFile struct {
+	Path  string `bencode:"path"`
+	Size  int64  `bencode:"size"`
+	MTime int64  `bencode:"mtime"` // in nanoseconds since UNIX epoch
+}
+
+// resumeData is the fast-resume sidecar, stored next to the downloaded data,
+// that lets us skip re-hashing every piece when the data files are unchanged
+type resumeData struct {
+	InfoHash string       `bencode:"info hash"`
+	Bitfield string       `bencode:"bitfield"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+// resumePath returns the path of the fast-resume sidecar for a download to `path`
+func (t *TorrentFile) resumePath(path string) string {
+	if len(t.Files) == 0 {
+		return path + ".resume"
+	}
+	return filepath.Join(path, t.Name) + ".resume"
+}
+
+// loadResume returns the pieces recorded in the fast-resume sidecar,
+// or nil if there is no sidecar or any data file changed since it was written
+func (t *TorrentFile) loadResume(path string, files []storage.File) bitfield.Bitfield {
+	buf, err := os.ReadFile(t.resumePath(path))
+	if err != nil {
+		return nil
+	}
+	var rd resumeData
+	err = bencode.Unmarshal(bytes.NewReader(buf), &rd)
+	if err != nil {
+		return nil
+	}
+	if rd.InfoHash != string(t.InfoHash[:]) || len(rd.Bitfield) != (len(t.PieceHashes)+7)/8 || len(rd.Files) != len(files) {
+		return nil
+	}
+	for i, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return nil
+		}
+		recorded := rd.Files[i]
+		if recorded.Path != f.Path || recorded.Size != info.Size() || recorded.MTime != info.ModTime().UnixNano() {
+			return nil
+		}
+	}
+	return bitfield.Bitfield(rd.Bitfield)
+}
+
+// saveResume writes the fast-resume sidecar, it must be called once all data has been written
+func (t *TorrentFile) saveResume(path string, files []storage.File, bf bitfield.Bitfield) error {
+	rd := resumeData{
+		InfoHash: string(t.InfoHash[:]),
+		Bitfield: string(bf),
+		Files:    make([]resumeFile, len(files)),
+	}
+	for i, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return err
+		}
+		rd.Files[i] = resumeFile{Path: f.Path, Size: info.Size(), MTime: info.ModTime().UnixNano()}
+	}
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, rd)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.resumePath(path), buf.Bytes(), 0644)
+}
+
+// hasExistingData tells if any data file already exists, otherwise there is nothing to re-verify
+func hasExistingData(files []storage.File) bool {
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTorrentFile_resume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "debian.iso")
+	tf := TorrentFile{
+		InfoHash:    [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PieceHashes: make([][20]byte, 10),
+		PieceLength: 1,
+		Length:      10,
+		Name:        "debian.iso",
+	}
+	files := tf.storageFiles(path)
+	assert.False(t, hasExistingData(files))
+	assert.Nil(t, tf.loadResume(path, files)) // no sidecar yet
+	require.Nil(t, os.WriteFile(path, []byte("0123456789"), 0644))
+	assert.True(t, hasExistingData(files))
+	bf := bitfield.Bitfield{0b10100000, 0b01000000}
+	require.Nil(t, tf.saveResume(path, files, bf))
+	assert.Equal(t, bf, tf.loadResume(path, files))
+
+	other := tf
+	other.InfoHash = [20]byte{1}
+	assert.Nil(t, other.loadResume(path, files)) // sidecar of another torrent
+
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+	assert.Nil(t, tf.loadResume(path, files)) // data modified since the sidecar was written
+}
+
+func TestTorrentFile_resumePath(t *testing.T) {
+	single := TorrentFile{Name: "debian.iso"}
+	assert.Equal(t, filepath.Join("out", "debian.iso.resume"), single.resumePath(filepath.Join("out", "debian.iso")))
+	multiple := TorrentFile{Name: "debian", Files: []File{{Path: []string{"a"}, Length: 1}}}
+	assert.Equal(t, filepath.Join("out", "debian.resume"), multiple.resumePath("out"))
+}
@@ -0,0 +1,166 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Scraping asks a tracker for the state of swarms without announcing to them.
+// HTTP trackers are scraped at the scrape URL derived from the announce URL, with one `info_hash` per torrent:
+// http://example.com/announce?x=1 -> http://example.com/scrape?x=1&info_hash=...&info_hash=...
+// and answer with a bencoded dictionary of the swarms by info hash:
+// d5:filesd20:<info hash>d8:completei5e10:downloadedi50e10:incompletei10eeee
+
+// ScrapeResult is the state of the swarm of one torrent, as reported by a tracker
+type ScrapeResult struct {
+	Complete   int // number of peers with the entire file, i.e. seeders
+	Downloaded int // total number of times the tracker has registered a completion
+	Incomplete int // number of non-seeder peers, aka "leechers"
+}
+
+// Scrape requests the state of the swarms of several torrents from a single tracker, over HTTP or UDP.
+// Torrents the tracker does not know are missing from the results
+func Scrape(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("no info hash to scrape")
+	}
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, announce, infoHashes)
+	case "udp":
+		return scrapeUDP(ctx, u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// Scrape requests the state of the swarm of the torrent from its trackers, failing over as announces do
+func (t *TorrentFile) Scrape(ctx context.Context) (ScrapeResult, error) {
+	var result ScrapeResult
+	err := t.trackers().try(func(announce string) error {
+		results, err := Scrape(ctx, announce, [][20]byte{t.InfoHash})
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if result, ok = results[t.InfoHash]; !ok {
+			return fmt.Errorf("tracker does not know the torrent")
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return ScrapeResult{}, ctx.Err()
+	}
+	return result, err
+}
+
+// scrapeURL derives the scrape URL of an HTTP tracker from its announce URL, by convention:
+// the last element of the path must start with "announce", which is replaced with "scrape"
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scraping", announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// scrapeHTTP scrapes an HTTP tracker, all info hashes in a single request
+func scrapeHTTP(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrape, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(scrape)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(resp *http.Response) {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("error closing response body: %v", err)
+		}
+	}(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &TrackerError{Reason: resp.Status, Status: resp.StatusCode}
+	}
+	return parseScrapeResponse(resp.Body)
+}
+
+// parseScrapeResponse parses the bencoded response of an HTTP tracker to a scrape.
+// It is decoded generically, as info hashes are the keys of the `files` dictionary
+func parseScrapeResponse(r io.Reader) (map[[20]byte]ScrapeResult, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a dictionary, got %T", decoded)
+	}
+	if failure, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Reason: failure, Status: http.StatusOK}
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a dictionary of files, got %T", dict["files"])
+	}
+	results := make(map[[20]byte]ScrapeResult, len(files))
+	for key, value := range files {
+		if len(key) != 20 {
+			return nil, fmt.Errorf("expected an info hash of length 20, got %d", len(key))
+		}
+		file, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a dictionary for a file, got %T", value)
+		}
+		var result ScrapeResult
+		for name, field := range map[string]*int{
+			"complete":   &result.Complete,
+			"downloaded": &result.Downloaded,
+			"incomplete": &result.Incomplete,
+		} {
+			if n, ok := file[name].(int64); ok {
+				*field = int(n)
+			}
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		results[infoHash] = result
+	}
+	return results, nil
+}
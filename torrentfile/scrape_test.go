@@ -0,0 +1,122 @@
+package torrentfile
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	var tests = map[string]struct {
+		input   string
+		output  string
+		failure bool
+	}{
+		"announce": {
+			input:  "http://example.com/announce",
+			output: "http://example.com/scrape",
+		},
+		"with a suffix": {
+			input:  "http://example.com/x/announce.php",
+			output: "http://example.com/x/scrape.php",
+		},
+		"with a query": {
+			input:  "http://example.com/announce?x2%0644",
+			output: "http://example.com/scrape?x2%0644",
+		},
+		"not announce": {
+			input:   "http://example.com/a",
+			failure: true,
+		},
+		"announce not last": {
+			input:  "http://example.com/announce?x=2/4",
+			output: "http://example.com/scrape?x=2/4",
+		},
+		"announce in the middle": {
+			input:   "http://example.com/announce/x",
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		output, err := scrapeURL(test.input)
+		if test.failure {
+			assert.NotNil(t, err, name) // expected error
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, output, name)
+	}
+}
+
+func TestScrape_HTTP(t *testing.T) {
+	known, unknown := [20]byte{'a'}, [20]byte{'b'}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || len(r.URL.Query()["info_hash"]) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("d5:filesd20:" + string(known[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer ts.Close()
+	results, err := Scrape(context.Background(), ts.URL+"/announce", [][20]byte{known, unknown})
+	require.Nil(t, err)
+	assert.Equal(t, map[[20]byte]ScrapeResult{
+		known: {Complete: 5, Downloaded: 50, Incomplete: 10},
+	}, results)
+
+	tf := TorrentFile{Announce: ts.URL + "/announce", InfoHash: unknown}
+	_, err = tf.Scrape(context.Background())
+	assert.NotNil(t, err) // a single info hash is not found
+}
+
+func TestParseScrapeResponse(t *testing.T) {
+	var tests = map[string]struct {
+		input   string
+		failure bool
+	}{
+		"empty": {
+			input: "d5:filesdee",
+		},
+		"failure": {
+			input:   "d14:failure reason9:forbiddene",
+			failure: true,
+		},
+		"not an info hash": {
+			input:   "d5:filesd3:abcdeee",
+			failure: true,
+		},
+		"files of the wrong type": {
+			input:   "d5:filesi1ee",
+			failure: true,
+		},
+	}
+	for name, test := range tests {
+		_, err := parseScrapeResponse(strings.NewReader(test.input))
+		if test.failure {
+			assert.NotNil(t, err, name) // expected error
+			continue
+		}
+		assert.Nil(t, err, name)
+	}
+}
+
+func TestTorrentFile_ScrapeUDP(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	tf := TorrentFile{Announce: s.url(), InfoHash: [20]byte{7}}
+	result, err := tf.Scrape(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Complete: 7, Downloaded: 42, Incomplete: 1}, result)
+
+	infoHashes := make([][20]byte, udpMaxScrape+1) // two requests
+	for i := range infoHashes {
+		infoHashes[i] = [20]byte{byte(i)}
+	}
+	results, err := Scrape(context.Background(), s.url(), infoHashes)
+	require.Nil(t, err)
+	assert.Len(t, results, udpMaxScrape+1)
+	assert.Equal(t, udpMaxScrape, results[[20]byte{udpMaxScrape}].Complete)
+}
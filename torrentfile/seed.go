@@ -0,0 +1,58 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/storage"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+)
+
+// Seed uploads a completed download at `path` to other peers until `ctx` is done, which returns ctx.Err(), or the listener fails.
+// `path` is laid out as by DownloadToFile, and every piece must pass the integrity check
+func (t *TorrentFile) Seed(ctx context.Context, path string) error {
+	var peerID [20]byte
+	_, err := rand.Read(peerID[:]) // randomly generated peer ID
+	if err != nil {
+		return err
+	}
+	files := t.storageFiles(path)
+	if !hasExistingData(files) { // do not let storage create empty files for a missing download
+		return fmt.Errorf("nothing to seed at %s", path)
+	}
+	torrent, store, err := t.openTorrent(files, t.loadResume(path, files), peerID)
+	if err != nil {
+		return err
+	}
+	defer func(store *storage.Files) {
+		_ = store.Close()
+	}(store)
+	if done := torrent.Bitfield.Count(); done != len(t.PieceHashes) {
+		return fmt.Errorf("%s is incomplete with %d/%d pieces, download it first", t.Name, done, len(t.PieceHashes))
+	}
+	server, err := p2p.Listen(fmt.Sprintf(":%d", Port), peerID)
+	if err != nil {
+		return err
+	}
+	defer func(server *p2p.Server) {
+		_ = server.Close()
+	}(server)
+	server.Add(torrent)
+	trackers := t.newAnnouncer(peerID, Port, torrent)
+	go trackers.run(ctx, nil) // peers find us, rather than the other way around
+	defer trackers.close()
+	stopDHT := t.discover(ctx, Port, nil)
+	defer stopDHT()
+	log.Printf("seeding %s on %s\n", t.Name, server.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	select {
+	case err = <-served:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package torrentfile
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// trackerTiers implements the announce-list of BEP 12: trackers within a tier are shuffled once,
+// then tried in order, tier after tier, and the first tracker that answers is moved to the front of its tier
+type trackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// newTrackerTiers builds the tiers from `announce-list`, falling back to `announce` when there is none
+func newTrackerTiers(announce string, announceList [][]string) *trackerTiers {
+	tt := &trackerTiers{}
+	for _, tier := range announceList {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tt.tiers = append(tt.tiers, shuffled)
+	}
+	if len(tt.tiers) == 0 && announce != "" { // clients must ignore `announce` when `announce-list` is present
+		tt.tiers = [][]string{{announce}}
+	}
+	return tt
+}
+
+// trackers returns the tiers of the torrent, shared by its announces and scrapes
+// so that the tracker that answered last stays in front of its tier (BEP 12).
+// A TorrentFile built by hand rather than opened gets them on first use, which must not race with another
+func (t *TorrentFile) trackers() *trackerTiers {
+	if t.tiers == nil {
+		t.tiers = newTrackerTiers(t.Announce, t.AnnounceList)
+	}
+	return t.tiers
+}
+
+// try calls `fn` with each tracker in order until one succeeds, and promotes it to the front of its tier
+func (tt *trackerTiers) try(fn func(announce string) error) error {
+	var errs []error
+	for i := 0; ; i++ {
+		tt.mu.Lock()
+		if i >= len(tt.tiers) {
+			tt.mu.Unlock()
+			break
+		}
+		tier := append([]string(nil), tt.tiers[i]...) // do not hold the lock while talking to trackers
+		tt.mu.Unlock()
+		for _, announce := range tier {
+			err := fn(announce)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", announce, err))
+				continue
+			}
+			tt.promote(i, announce)
+			return nil
+		}
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no tracker to announce to")
+	}
+	return fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+}
+
+// empty tells if there is no tracker at all
+func (tt *trackerTiers) empty() bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return len(tt.tiers) == 0
+}
+
+// promote moves a tracker to the front of its tier
+func (tt *trackerTiers) promote(i int, announce string) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tier := tt.tiers[i]
+	for j, a := range tier {
+		if a == announce {
+			copy(tier[1:j+1], tier[0:j])
+			tier[0] = announce
+			return
+		}
+	}
+}
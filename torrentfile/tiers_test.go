@@ -0,0 +1,96 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/peers"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewTrackerTiers(t *testing.T) {
+	tt := newTrackerTiers("http://a", nil)
+	assert.Equal(t, [][]string{{"http://a"}}, tt.tiers)
+	tt = newTrackerTiers("http://a", [][]string{{"http://b", "http://c", "http://d"}, {}, {"http://e"}})
+	require.Len(t, tt.tiers, 2) // `announce` is ignored, empty tiers are dropped
+	assert.ElementsMatch(t, []string{"http://b", "http://c", "http://d"}, tt.tiers[0])
+	assert.Equal(t, []string{"http://e"}, tt.tiers[1])
+	assert.Empty(t, newTrackerTiers("", nil).tiers)
+}
+
+func TestTrackerTiers_try(t *testing.T) {
+	tt := &trackerTiers{tiers: [][]string{{"a", "b", "c"}, {"d", "e"}}}
+	var tried []string
+	err := tt.try(func(announce string) error {
+		tried = append(tried, announce)
+		if announce == "c" {
+			return nil
+		}
+		return fmt.Errorf("unreachable")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, tried)
+	assert.Equal(t, [][]string{{"c", "a", "b"}, {"d", "e"}}, tt.tiers)
+
+	tried = nil
+	err = tt.try(func(announce string) error {
+		tried = append(tried, announce)
+		if announce == "e" {
+			return nil
+		}
+		return fmt.Errorf("unreachable")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c", "a", "b", "d", "e"}, tried) // falls back to the next tier
+	assert.Equal(t, [][]string{{"c", "a", "b"}, {"e", "d"}}, tt.tiers)
+
+	err = tt.try(func(announce string) error {
+		return fmt.Errorf("unreachable")
+	})
+	assert.NotNil(t, err)
+	assert.NotNil(t, (&trackerTiers{}).try(func(string) error { return nil }))
+}
+
+func TestTorrentFile_RequestPeers_failover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+	}))
+	defer up.Close()
+	tf := TorrentFile{
+		Announce:     "http://ignored.invalid/announce",
+		AnnounceList: [][]string{{down.URL}, {up.URL}},
+		Length:       1,
+	}
+	p, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
+	assert.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6889}}, p)
+}
+
+func TestTorrentFile_trackers_shared(t *testing.T) {
+	var downHits atomic.Int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE9}) + "e"))
+	}))
+	defer up.Close()
+	tf := TorrentFile{AnnounceList: [][]string{{down.URL, up.URL}}, Length: 1}
+	for i := 0; i < 3; i++ {
+		_, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
+		require.Nil(t, err)
+	}
+	assert.LessOrEqual(t, downHits.Load(), int32(1)) // tried before `up` at most once, then `up` stays in front
+	assert.Same(t, tf.trackers(), tf.newAnnouncer([20]byte{}, 6882, &fixedTransfer{}).tiers)
+}
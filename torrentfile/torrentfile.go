@@ -1,22 +1,40 @@
 package torrentfile
 
 import (
+	"bittorrent-client-go/bitfield"
+	"bittorrent-client-go/p2p"
+	"bittorrent-client-go/peers"
+	"bittorrent-client-go/storage"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"github.com/jackpal/bencode-go"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-// bencodeInfo represents Info Dictionary in Single File Mode
-type bencodeInfo struct { // TODO: Multiple File Mode to be supported
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-	//Private     int    `bencode:"private"` // optional, for PT (Private Tracker)
-	Name   string `bencode:"name"`
-	Length int    `bencode:"length"`
+// Port to listen on
+const Port uint16 = 6881
+
+// bencodeFile represents one entry of the `files` list in Multiple File Mode
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"` // one or more strings, the last one being the actual file name
+	//MD5Sum string   `bencode:"md5sum"` // optional
+}
+
+// bencodeInfo represents Info Dictionary in both Single File Mode and Multiple File Mode
+type bencodeInfo struct {
+	PieceLength int           `bencode:"piece length"`
+	Pieces      string        `bencode:"pieces"`
+	Private     int           `bencode:"private,omitempty"` // optional, for PT (Private Tracker), see BEP 27
+	Name        string        `bencode:"name"`              // file name in Single File Mode, directory name in Multiple File Mode
+	Length      int           `bencode:"length,omitempty"`  // Single File Mode only
+	Files       []bencodeFile `bencode:"files,omitempty"`   // Multiple File Mode only
 	//MD5Sum      string `bencode:"md5sum"` // optional
 }
 
@@ -29,19 +47,33 @@ type BencodeTorrent struct {
 	Comment      string      `bencode:"comment"`       // optional
 	CreatedBy    string      `bencode:"created by"`    // optional
 	Encoding     string      `bencode:"encoding"`      // optional
+	rawInfo      []byte      // exact bytes of the `info` value as found in the .torrent file, if known
+}
+
+// File describes a single file of a Multiple File Mode torrent
+type File struct {
+	Path   []string // path segments relative to the torrent directory
+	Length int
+	Offset int // absolute byte offset of the file in the concatenated torrent data
 }
 
 // TorrentFile represents actual file information we need
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte // SHA-1 hash of the entire bencoded `info` dict
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string // tiers of trackers (BEP 12), takes precedence over Announce when present
+	InfoHash     [20]byte   // SHA-1 hash of the entire bencoded `info` dict
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int // total length, the sum of all files in Multiple File Mode
+	Name         string
+	Files        []File        // empty in Single File Mode
+	Private      bool          // peers only come from the trackers (BEP 27), neither from the DHT nor from peer exchange
+	tiers        *trackerTiers // built from Announce and AnnounceList when opened, see trackers
+	Monitor      *p2p.Monitor  `json:"-"` // receives the events of DownloadToFile and Seed and serves their stats, unless nil
 }
 
-// hash returns SHA-1 of the bencoded `info` dict
+// hash returns SHA-1 of the bencoded `info` dict re-encoded from its decoded fields,
+// which only matches the original when every key of the dict is modeled by bencodeInfo
 func (i *bencodeInfo) hash() ([20]byte, error) {
 	var buf bytes.Buffer
 	err := bencode.Marshal(&buf, *i)
@@ -67,9 +99,42 @@ func (i *bencodeInfo) splitHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// layout returns the files in Multiple File Mode with their absolute offsets, and the total length
+func (i *bencodeInfo) layout() ([]File, int, error) {
+	if len(i.Files) == 0 {
+		return nil, i.Length, nil
+	}
+	files := make([]File, len(i.Files))
+	offset := 0
+	for index, f := range i.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file #%d has negative length %d", index, f.Length)
+		}
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file #%d has an empty path", index)
+		}
+		for _, segment := range f.Path { // never let a torrent escape its directory
+			if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, `/\`) {
+				return nil, 0, fmt.Errorf("file #%d has invalid path segment %q", index, segment)
+			}
+		}
+		files[index] = File{Path: f.Path, Length: f.Length, Offset: offset}
+		offset += f.Length
+	}
+	return files, offset, nil
+}
+
+// infoHash returns SHA-1 of the original `info` bytes when available, falling back to re-encoding
+func (bto *BencodeTorrent) infoHash() ([20]byte, error) {
+	if bto.rawInfo != nil {
+		return sha1.Sum(bto.rawInfo), nil
+	}
+	return bto.Info.hash()
+}
+
 // toTorrentFile saves useful fields in BencodeTorrent into TorrentFile
 func (bto *BencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
+	infoHash, err := bto.infoHash()
 	if err != nil {
 		return TorrentFile{}, err
 	}
@@ -77,74 +142,146 @@ func (bto *BencodeTorrent) toTorrentFile() (TorrentFile, error) {
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	files, length, err := bto.Info.layout()
+	if err != nil {
+		return TorrentFile{}, err
+	}
 	return TorrentFile{
-		Announce:    bto.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		Announce:     bto.Announce,
+		AnnounceList: bto.AnnounceList,
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  bto.Info.PieceLength,
+		Length:       length,
+		Name:         bto.Info.Name,
+		Files:        files,
+		Private:      bto.Info.Private == 1,
+		tiers:        newTrackerTiers(bto.Announce, bto.AnnounceList),
 	}, nil
 }
 
 // Open parses a torrent file
 func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+	buf, err := os.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	defer func(file *os.File) {
-		if err := file.Close(); err != nil {
-			log.Printf("error closing file: %v", file)
-		}
-	}(file)
 	var bto BencodeTorrent
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(buf), &bto)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	bto.rawInfo, err = rawInfo(buf)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	return bto.toTorrentFile()
 }
 
-// DownloadToFile downloads a torrent and writes it to a file
-func (t *TorrentFile) DownloadToFile(path string) error {
+// DownloadToFile downloads a torrent and writes it to a file,
+// or to a directory named after the torrent under `path` in Multiple File Mode.
+// Data already at `path` is kept, and only the missing pieces are downloaded.
+// Cancelling `ctx` stops the download, with the pieces verified so far flushed to disk, and returns ctx.Err()
+func (t *TorrentFile) DownloadToFile(ctx context.Context, path string) (err error) {
 	var peerID [20]byte
-<<<<<<< HEAD
-	_, err := rand.Read(peerID[:]) // randomly generated peer ID
+	_, err = rand.Read(peerID[:]) // randomly generated peer ID
+	if err != nil {
+		return err
+	}
+	files := t.storageFiles(path)
+	torrent, store, err := t.openTorrent(files, t.loadResume(path, files), peerID)
 	if err != nil {
 		return err
 	}
-	peers, err := t.requestPeers(peerID, Port)
+	defer func() { // persist progress even when the download fails
+		closeErr := store.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if closeErr == nil {
+			if resumeErr := t.saveResume(path, files, torrent.Bitfield); resumeErr != nil {
+				log.Printf("error saving fast-resume data: %v", resumeErr)
+			}
+		}
+	}()
+	if torrent.Bitfield.Count() == len(t.PieceHashes) {
+		return nil
+	}
+	if server, err := p2p.Listen(fmt.Sprintf(":%d", Port), peerID); err != nil { // upload to others while downloading
+		log.Printf("could not accept incoming peers: %v\n", err)
+	} else {
+		defer func(server *p2p.Server) {
+			_ = server.Close()
+		}(server)
+		server.Add(torrent)
+		go func() {
+			_ = server.Serve()
+		}()
+	}
+	found := make(chan []peers.Peer) // more peers from trackers and the DHT
+	torrent.NewPeers = found
+	trackers := t.newAnnouncer(peerID, Port, torrent)
+	torrent.RequestPeers = trackers.more
+	go trackers.run(ctx, found) // peers from the `started` announce arrive on `found`, rather than holding up the download
+	defer trackers.close()
+	stopDHT := t.discover(ctx, Port, found) // more peers, and the only source when trackers are dead
+	defer stopDHT()
+	err = torrent.Download(ctx)
+	if syncErr := store.Sync(); err == nil { // also what was verified before a failure or cancellation
+		err = syncErr
+	}
 	if err != nil {
 		return err
 	}
-	torrent := p2p.Torrent{
-		Peers:       peers,
+	trackers.complete()
+	return nil
+}
+
+// openTorrent opens the storage for `files` and returns the torrent to download into or seed from it.
+// Pieces already on disk are verified unless `have` is known from fast-resume data
+func (t *TorrentFile) openTorrent(files []storage.File, have bitfield.Bitfield, peerID [20]byte) (*p2p.Torrent, *storage.Files, error) {
+	if have == nil && !hasExistingData(files) {
+		have = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	}
+	store, err := storage.NewFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	torrent := &p2p.Torrent{
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		Name:        t.Name,
 		Length:      t.Length,
 		PieceLength: t.PieceLength,
+		Storage:     store,
+		Bitfield:    have,
+		Port:        Port,
+		Private:     t.Private,
+		Monitor:     t.Monitor,
 	}
-	buf, err := torrent.Download()
-	if err != nil {
-		return err
+	if torrent.Bitfield == nil {
+		torrent.Bitfield, err = torrent.Verify()
+		if err != nil {
+			_ = store.Close()
+			return nil, nil, err
+		}
 	}
-	output, err := os.Create(path)
-	if err != nil {
-		return err
+	return torrent, store, nil
+}
+
+// storageFiles returns the files on disk backing the torrent data when downloaded to `path`
+func (t *TorrentFile) storageFiles(path string) []storage.File {
+	if len(t.Files) == 0 {
+		return []storage.File{{Path: path, Length: t.Length}}
 	}
-	defer func(output *os.File) {
-		_ = output.Close()
-	}(output)
-	_, err = output.Write(buf)
-=======
-	_, err := rand.Read(peerID[:]) // randomly generated
->>>>>>> parent of 910f03c (test torrentfile)
-	if err != nil {
-		return err
+	root := filepath.Join(path, t.Name)
+	files := make([]storage.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = storage.File{
+			Path:   filepath.Join(append([]string{root}, f.Path...)...),
+			Length: f.Length,
+		}
 	}
-	// TODO: to be implemented later
-	return nil
+	return files
 }
@@ -1,11 +1,14 @@
 package torrentfile
 
 import (
+	"bittorrent-client-go/storage"
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,6 +17,8 @@ var update = flag.Bool("update", false, "update .golden.json files")
 func TestOpen(t *testing.T) {
 	var torrent, err = Open("testdata/debian-edu-12.6.0-amd64-netinst.iso.torrent") // note that some .torrent files may not contain an `announce`
 	require.Nil(t, err)
+	assert.NotNil(t, torrent.tiers)
+	torrent.tiers = nil // not part of the golden file
 	var goldenPath = "testdata/debian-edu-12.6.0-amd64-netinst.iso.torrent.golden.json"
 	if !*update { // switch
 		serialized, err := json.MarshalIndent(torrent, "", "  ")
@@ -28,6 +33,27 @@ func TestOpen(t *testing.T) {
 	assert.Equal(t, expected, torrent)
 }
 
+func TestOpen_unmodeledInfoKeys(t *testing.T) {
+	info := "d" +
+		"6:lengthi300e" +
+		"6:md5sum32:0123456789abcdef0123456789abcdef" +
+		"4:name6:debian" +
+		"10:name.utf-86:debian" +
+		"12:piece lengthi262144e" +
+		"6:pieces20:1234567890abcdefghij" +
+		"7:privatei1e" +
+		"6:source6:debian" +
+		"e"
+	path := filepath.Join(t.TempDir(), "private.torrent")
+	err := os.WriteFile(path, []byte("d8:announce9:http://tr4:info"+info+"e"), 0644)
+	require.Nil(t, err)
+	torrent, err := Open(path)
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), torrent.InfoHash)
+	assert.Equal(t, 300, torrent.Length)
+	assert.Equal(t, "debian", torrent.Name)
+}
+
 func TestBencodeTorrent_toTorrentFile(t *testing.T) {
 	var tests = map[string]struct {
 		input   *BencodeTorrent
@@ -36,7 +62,8 @@ func TestBencodeTorrent_toTorrentFile(t *testing.T) {
 	}{
 		"correct conversion": {
 			input: &BencodeTorrent{
-				Announce: "http://bttracker.debian.org:6969/announce",
+				Announce:     "http://bttracker.debian.org:6969/announce",
+				AnnounceList: [][]string{{"http://bttracker.debian.org:6969/announce"}, {"udp://tracker.example.org:1337"}},
 				Info: bencodeInfo{
 					Pieces:      "1234567890abcdefghijabcdefghij1234567890",
 					PieceLength: 262144,
@@ -45,8 +72,9 @@ func TestBencodeTorrent_toTorrentFile(t *testing.T) {
 				},
 			},
 			output: TorrentFile{
-				Announce: "http://bttracker.debian.org:6969/announce",
-				InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+				Announce:     "http://bttracker.debian.org:6969/announce",
+				AnnounceList: [][]string{{"http://bttracker.debian.org:6969/announce"}, {"udp://tracker.example.org:1337"}},
+				InfoHash:     [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
 				PieceHashes: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
@@ -70,6 +98,50 @@ func TestBencodeTorrent_toTorrentFile(t *testing.T) {
 			output:  TorrentFile{},
 			failure: true,
 		},
+		"multiple file mode": {
+			input: &BencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Name:        "debian",
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"README"}},
+						{Length: 200, Path: []string{"images", "netinst.iso"}},
+					},
+				},
+			},
+			output: TorrentFile{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				InfoHash: [20]byte{51, 63, 82, 206, 8, 252, 4, 159, 166, 172, 105, 238, 82, 75, 224, 190, 181, 166, 243, 249},
+				PieceHashes: [][20]byte{
+					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+				},
+				PieceLength: 262144,
+				Length:      300,
+				Name:        "debian",
+				Files: []File{
+					{Path: []string{"README"}, Length: 100, Offset: 0},
+					{Path: []string{"images", "netinst.iso"}, Length: 200, Offset: 100},
+				},
+			},
+			failure: false,
+		},
+		"path escaping the torrent directory": {
+			input: &BencodeTorrent{
+				Announce: "http://bttracker.debian.org:6969/announce",
+				Info: bencodeInfo{
+					Pieces:      "1234567890abcdefghij",
+					PieceLength: 262144,
+					Name:        "debian",
+					Files: []bencodeFile{
+						{Length: 100, Path: []string{"..", "passwd"}},
+					},
+				},
+			},
+			output:  TorrentFile{},
+			failure: true,
+		},
 	}
 	for _, test := range tests {
 		to, err := test.input.toTorrentFile()
@@ -77,7 +149,27 @@ func TestBencodeTorrent_toTorrentFile(t *testing.T) {
 			assert.NotNil(t, err)
 		} else {
 			assert.Nil(t, err)
+			assert.NotNil(t, to.tiers)
+			to.tiers = nil
 		}
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestTorrentFile_storageFiles(t *testing.T) {
+	single := TorrentFile{Length: 6, Name: "debian.iso"}
+	assert.Equal(t, []storage.File{{Path: filepath.Join("out", "debian.iso"), Length: 6}}, single.storageFiles(filepath.Join("out", "debian.iso")))
+	multiple := TorrentFile{
+		Length: 6,
+		Name:   "debian",
+		Files: []File{
+			{Path: []string{"a"}, Length: 2, Offset: 0},
+			{Path: []string{"b", "c"}, Length: 4, Offset: 2},
+		},
+	}
+	expected := []storage.File{
+		{Path: filepath.Join("out", "debian", "a"), Length: 2},
+		{Path: filepath.Join("out", "debian", "b", "c"), Length: 4},
+	}
+	assert.Equal(t, expected, multiple.storageFiles("out"))
+}
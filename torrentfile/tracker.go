@@ -1,10 +1,15 @@
 package torrentfile
 
 import (
+	"bittorrent-client-go/p2p"
 	"bittorrent-client-go/peers"
+	"bittorrent-client-go/tracker"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/google/go-querystring/query"
 	"github.com/jackpal/bencode-go"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -12,16 +17,99 @@ import (
 	"time"
 )
 
-// trackerResponse is the tracker response with "text/plain" document consisting of a bencoded dictionary
-type trackerResponse struct {
-	Failure     string `bencode:"failure reason"`  // if present, then no other keys may be present
-	Warning     string `bencode:"warning message"` // optional, new
-	Interval    int    `bencode:"interval"`        // in seconds
-	MinInterval int    `bencode:"min interval"`    // optional, minimum announce interval
-	TrackerID   string `bencode:"tracker id"`      // a string that the client should send back on its next announcements
-	Complete    int    `bencode:"complete"`        // number of peers with the entire file, i.e. seeders
-	Incomplete  int    `bencode:"incomplete"`      // number of non-seeder peers, aka "leechers"
-	Peers       string `bencode:"peers"`           // list of peers (binary model), TODO: only binary model is supported
+// trackerResponse is the tracker response with "text/plain" document consisting of a bencoded dictionary,
+// in the shape served by the tracker package
+type trackerResponse tracker.Response
+
+// parseTrackerResponse parses the bencoded response of an HTTP tracker.
+// bencode.Unmarshal leaves `peers` unset in the dictionary model, which is then decoded on its own
+func parseTrackerResponse(r io.Reader) (*trackerResponse, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var trackerResp trackerResponse
+	err = bencode.Unmarshal(bytes.NewReader(body), &trackerResp)
+	if err != nil {
+		return nil, err
+	}
+	if trackerResp.Peers == nil {
+		decoded, err := bencode.Decode(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if dict, ok := decoded.(map[string]interface{}); ok {
+			trackerResp.Peers = dict["peers"]
+		}
+	}
+	return &trackerResp, nil
+}
+
+// TrackerError is a tracker refusing a request, with its `failure reason`
+type TrackerError struct {
+	Reason  string        // `failure reason`, or the HTTP status when there is none
+	Status  int           // HTTP status code, 0 for UDP trackers
+	RetryIn time.Duration // how long the tracker asks to wait before announcing again (BEP 31), 0 when it does not say or RetryNever
+}
+
+// RetryNever is TrackerError.RetryIn when the tracker asks never to announce again
+const RetryNever time.Duration = -1
+
+func (e *TrackerError) Error() string {
+	msg := fmt.Sprintf("tracker error: %s", e.Reason)
+	switch {
+	case e.RetryIn == RetryNever:
+		msg += ", never retry"
+	case e.RetryIn > 0:
+		msg += fmt.Sprintf(", retry in %s", e.RetryIn)
+	}
+	return msg
+}
+
+// err returns the failure of the response as a TrackerError, nil when there is none
+func (r *trackerResponse) err(status int) error {
+	if r.Failure == "" {
+		return nil
+	}
+	e := &TrackerError{Reason: r.Failure, Status: status}
+	switch retryIn := r.RetryIn.(type) {
+	case int64:
+		if retryIn > 0 {
+			e.RetryIn = time.Duration(retryIn) * time.Minute
+		}
+	case string:
+		if retryIn == "never" {
+			e.RetryIn = RetryNever
+		}
+	}
+	return e
+}
+
+// peers returns the IPv4 and IPv6 peers of the response, in either model
+func (r *trackerResponse) peers(ctx context.Context) ([]peers.Peer, error) {
+	var found []peers.Peer
+	var err error
+	switch p := r.Peers.(type) {
+	case nil: // only IPv6 peers
+	case string:
+		found, err = peers.Unmarshal([]byte(p))
+	case []interface{}:
+		found, err = peers.UnmarshalDicts(ctx, p)
+	default:
+		err = fmt.Errorf("expected peers as a string or a list, got %T", r.Peers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	found6, err := peers.Unmarshal6([]byte(r.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	found = append(found, found6...)
+	if len(found) <= 0 {
+		return nil, fmt.Errorf("no peer found")
+	}
+	return found, nil
 }
 
 // trackerRequest is the parameters used in the client->tracker GET request
@@ -41,22 +129,47 @@ type trackerRequest struct {
 	TrackerID  []string `url:"trackerid,omitempty"`  // optional, if a previous `announce` contained a tracker id it should be set here
 }
 
+// Announce events, sent once each at the matching point of the lifecycle of a download
+const (
+	eventNone      = tracker.EventNone      // a regular announce
+	eventStarted   = tracker.EventStarted   // the first announce
+	eventCompleted = tracker.EventCompleted // the download completed, not sent when it was already complete on start
+	eventStopped   = tracker.EventStopped   // the client is shutting down gracefully
+)
+
+// announceParams is what the client tells a tracker about itself on each announce
+type announceParams struct {
+	peerID     [20]byte
+	port       uint16
+	left       int    // bytes still to download, 0 when seeding
+	uploaded   int64  // bytes sent to peers since the `started` event
+	downloaded int64  // bytes received from peers since the `started` event
+	event      string // one of the announce events
+	trackerID  string // `tracker id` of the previous response of the same tracker
+}
+
 // buildTrackerURL builds initial tracker URL
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(t.Announce)
+func (t *TorrentFile) buildTrackerURL(announce string, params announceParams) (string, error) {
+	base, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
-	params := trackerRequest{
+	req := trackerRequest{
 		InfoHash:   []string{string(t.InfoHash[:])},
-		PeerID:     []string{string(peerID[:])},
-		Port:       []string{strconv.Itoa(int(port))},
-		Uploaded:   []string{"0"},
-		Downloaded: []string{"0"},
-		Left:       []string{strconv.Itoa(t.Length)},
+		PeerID:     []string{string(params.peerID[:])},
+		Port:       []string{strconv.Itoa(int(params.port))},
+		Uploaded:   []string{strconv.FormatInt(params.uploaded, 10)},
+		Downloaded: []string{strconv.FormatInt(params.downloaded, 10)},
+		Left:       []string{strconv.Itoa(params.left)},
 		Compact:    []string{"1"}, // currently set to 1
 	}
-	request, err := query.Values(params)
+	if params.event != eventNone {
+		req.Event = []string{params.event}
+	}
+	if params.trackerID != "" {
+		req.TrackerID = []string{params.trackerID}
+	}
+	request, err := query.Values(req)
 	if err != nil {
 		return "", err
 	}
@@ -64,36 +177,80 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 	return base.String(), nil
 }
 
-// requestPeers requests a list of peers from tracker
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	trackerURL, err := t.buildTrackerURL(peerID, port)
+// requestPeers requests a list of peers from the trackers of the torrent, failing over as described in BEP 12
+func (t *TorrentFile) requestPeers(ctx context.Context, params announceParams) ([]peers.Peer, error) {
+	var found []peers.Peer
+	err := t.trackers().try(func(announce string) error {
+		var err error
+		found, err = t.requestPeersFrom(ctx, announce, params)
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return found, err
+}
+
+// requestPeersFrom requests a list of peers from a single tracker
+func (t *TorrentFile) requestPeersFrom(ctx context.Context, announce string, params announceParams) ([]peers.Peer, error) {
+	trackerResp, err := t.announceTo(ctx, announce, params)
 	if err != nil {
 		return nil, err
 	}
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(trackerURL)
+	return trackerResp.peers(ctx)
+}
+
+// announceTo announces to a single tracker, over HTTP or UDP depending on the announce URL
+func (t *TorrentFile) announceTo(ctx context.Context, announce string, params announceParams) (*trackerResponse, error) {
+	u, err := url.Parse(announce)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	switch u.Scheme {
+	case "http", "https":
+		return t.announceHTTP(ctx, announce, params)
+	case "udp":
+		return t.announceUDP(ctx, u, params)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// announceHTTP announces to an HTTP tracker
+func (t *TorrentFile) announceHTTP(ctx context.Context, announce string, params announceParams) (*trackerResponse, error) {
+	trackerURL, err := t.buildTrackerURL(announce, params)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer func(resp *http.Response) {
 		if err := resp.Body.Close(); err != nil {
 			log.Printf("error closing response body: %v", err)
 		}
 	}(resp)
-	trackerResp := trackerResponse{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
+	trackerResp, err := parseTrackerResponse(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && trackerResp.Failure != "" { // some trackers explain themselves along with an error status
+			return nil, trackerResp.err(resp.StatusCode)
+		}
+		return nil, &TrackerError{Reason: resp.Status, Status: resp.StatusCode}
+	}
 	if err != nil {
 		return nil, err
 	}
-	peersBin, err := peers.Unmarshal([]byte(trackerResp.Peers))
-	if err != nil {
+	if err := trackerResp.err(resp.StatusCode); err != nil {
 		return nil, err
 	}
-	if len(peersBin) <= 0 {
-		return nil, fmt.Errorf("no peer found")
+	if trackerResp.Warning != "" {
+		t.Monitor.Publish(p2p.Event{Type: p2p.TrackerWarning, Tracker: announce, Warning: trackerResp.Warning})
 	}
-	return peersBin, nil
+	return trackerResp, nil
 }
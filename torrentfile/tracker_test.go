@@ -1,13 +1,16 @@
 package torrentfile
 
 import (
+	"bittorrent-client-go/p2p"
 	"bittorrent-client-go/peers"
+	"context"
+	"github.com/stretchr/testify/assert"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
-
-	"github.com/stretchr/testify/assert"
+	"time"
 )
 
 func TestTorrentFile_BuildTrackerURL(t *testing.T) {
@@ -24,43 +27,152 @@ func TestTorrentFile_BuildTrackerURL(t *testing.T) {
 	}
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6882
-	url, err := to.buildTrackerURL(peerID, port)
+	url, err := to.buildTrackerURL(to.Announce, announceParams{peerID: peerID, port: port, left: to.Length})
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&uploaded=0"
 	assert.Nil(t, err)
 	assert.Equal(t, url, expected)
 }
 
 func TestTorrentFile_RequestPeers(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		response := []byte(
-			"d" +
+	var tests = map[string]struct {
+		response string
+		output   []peers.Peer
+		failure  bool
+	}{
+		"binary model": {
+			response: "d" +
 				"8:interval" + "i900e" +
 				"5:peers" + "12:" +
 				string([]byte{
 					192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
 					127, 0, 0, 1, 0x1A, 0xE9, // 0x1AE9 = 6889
-				}) + "e")
-		_, _ = w.Write(response)
-	}))
-	defer ts.Close()
-	tf := TorrentFile{
-		Announce: ts.URL,
-		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
-		PieceHashes: [][20]byte{
-			{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
-			{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+				}) +
+				"6:peers6" + "18:" +
+				string(append([]byte(net.IPv6loopback), 0x1A, 0xE1)) + "e",
+			output: []peers.Peer{
+				{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+				{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+				{IP: net.IPv6loopback, Port: 6881},
+			},
+		},
+		"dictionary model": {
+			response: "d" +
+				"8:interval" + "i900e" +
+				"5:peers" + "l" +
+				"d2:ip11:192.0.2.1237:peer id20:-XX0001-aaaaaaaaaaaa4:porti6881ee" +
+				"d2:ip3:::14:porti6889ee" + // no_peer_id
+				"e" + "e",
+			output: []peers.Peer{
+				{IP: net.IP{192, 0, 2, 123}, Port: 6881, ID: [20]byte{'-', 'X', 'X', '0', '0', '0', '1', '-', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}},
+				{IP: net.IPv6loopback, Port: 6889},
+			},
+		},
+		"malformed dictionary model": {
+			response: "d8:intervali900e5:peersld2:ip9:127.0.0.1eee",
+			failure:  true,
+		},
+		"no peer": {
+			response: "d8:intervali900e5:peers0:e",
+			failure:  true,
 		},
-		PieceLength: 262144,
-		Length:      351272960,
-		Name:        "debian-10.2.0-amd64-netinst.iso",
 	}
-	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
-	const port uint16 = 6882
-	expected := []peers.Peer{
-		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
-		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+	for name, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(test.response))
+		}))
+		tf := TorrentFile{
+			Announce: ts.URL,
+			InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+			PieceHashes: [][20]byte{
+				{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
+				{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
+			},
+			PieceLength: 262144,
+			Length:      351272960,
+			Name:        "debian-10.2.0-amd64-netinst.iso",
+		}
+		peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+		const port uint16 = 6882
+		p, err := tf.requestPeers(context.Background(), announceParams{peerID: peerID, port: port, left: tf.Length})
+		if test.failure {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, p, name)
+		}
+		ts.Close()
+	}
+}
+
+func TestTorrentFile_AnnounceHTTP_failure(t *testing.T) {
+	var tests = map[string]struct {
+		status   int
+		response string
+		output   TrackerError
+	}{
+		"failure reason": {
+			status:   http.StatusOK,
+			response: "d14:failure reason12:unregisterede",
+			output:   TrackerError{Reason: "unregistered", Status: http.StatusOK},
+		},
+		"retry in minutes": {
+			status:   http.StatusOK,
+			response: "d14:failure reason4:busy8:retry ini5ee",
+			output:   TrackerError{Reason: "busy", Status: http.StatusOK, RetryIn: 5 * time.Minute},
+		},
+		"retry never": {
+			status:   http.StatusOK,
+			response: "d14:failure reason6:banned8:retry in5:nevere",
+			output:   TrackerError{Reason: "banned", Status: http.StatusOK, RetryIn: RetryNever},
+		},
+		"bad status with a reason": {
+			status:   http.StatusForbidden,
+			response: "d14:failure reason9:forbiddene",
+			output:   TrackerError{Reason: "forbidden", Status: http.StatusForbidden},
+		},
+		"bad status": {
+			status:   http.StatusBadGateway,
+			response: "<html>",
+			output:   TrackerError{Reason: "502 Bad Gateway", Status: http.StatusBadGateway},
+		},
 	}
-	p, err := tf.requestPeers(peerID, port)
+	for name, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(test.response))
+		}))
+		tf := TorrentFile{Announce: ts.URL, Length: 1}
+		_, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
+		var trackerErr *TrackerError
+		if assert.ErrorAs(t, err, &trackerErr, name) {
+			assert.Equal(t, test.output, *trackerErr, name)
+		}
+		ts.Close()
+	}
+}
+
+func TestTorrentFile_AnnounceHTTP_warning(t *testing.T) {
+	var warnings []string
+	monitor := &p2p.Monitor{}
+	monitor.Subscribe(func(e p2p.Event) {
+		if e.Type == p2p.TrackerWarning {
+			warnings = append(warnings, e.Warning)
+		}
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("d15:warning message11:update soon5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, Length: 1, Monitor: monitor}
+	_, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
 	assert.Nil(t, err)
-	assert.Equal(t, expected, p)
+	assert.Equal(t, []string{"update soon"}, warnings)
+}
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
 }
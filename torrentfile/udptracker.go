@@ -0,0 +1,300 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15), all integers are big-endian
+// connect request:  <protocol_id 8><action 4><transaction_id 4>
+// connect response: <action 4><transaction_id 4><connection_id 8>
+// announce request: <connection_id 8><action 4><transaction_id 4><info_hash 20><peer_id 20><downloaded 8><left 8><uploaded 8>
+//                   <event 4><IP address 4><key 4><num_want 4><port 2>
+// announce response: <action 4><transaction_id 4><interval 4><leechers 4><seeders 4>(<IP address 4><TCP port 2>)*,
+//                    with IPv6 addresses of 16 bytes when the tracker is contacted over IPv6
+// scrape request:   <connection_id 8><action 4><transaction_id 4>(<info_hash 20>)*
+// scrape response:  <action 4><transaction_id 4>(<seeders 4><completed 4><leechers 4>)*
+// error response:   <action 4><transaction_id 4><message>
+
+const udpProtocolID uint64 = 0x41727101980 // magic constant
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+const (
+	udpEventNone      uint32 = 0
+	udpEventCompleted uint32 = 1
+	udpEventStarted   uint32 = 2
+	udpEventStopped   uint32 = 3
+)
+
+// udpMaxRetries is the largest `n` of the 15 * 2 ^ n seconds retransmission timeout. BEP 15 goes up to 8,
+// but that is over two hours before failing over to the next tracker, so a tracker gets under two minutes instead
+const udpMaxRetries = 2
+
+// udpMaxScrape is the largest number of info hashes a single scrape request can carry
+const udpMaxScrape = 74
+
+// udpTimeout is the base timeout before a request is retransmitted, doubled after every retransmission
+var udpTimeout = 15 * time.Second
+
+// udpConnectionTTL is how long a client may use a connection ID once it has been received
+var udpConnectionTTL = time.Minute
+
+// udpConnections caches connection IDs by tracker address, so that announces do not connect every time
+var udpConnections = struct {
+	sync.Mutex
+	ids map[string]udpConnection
+}{ids: make(map[string]udpConnection)}
+
+type udpConnection struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpTracker talks to a single UDP tracker
+type udpTracker struct {
+	addr string
+	conn net.Conn
+	ctx  context.Context
+	stop func() bool // stops closing conn once ctx is done
+}
+
+// dialUDPTracker opens a socket to the tracker of a `udp://host:port` announce URL, closed as soon as `ctx` is done
+func dialUDPTracker(ctx context.Context, u *url.URL) (*udpTracker, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("udp tracker %s has no port", u.Host)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close() // unblocks requests waiting for their retransmission timeout
+	})
+	return &udpTracker{addr: u.Host, conn: conn, ctx: ctx, stop: stop}, nil
+}
+
+func (u *udpTracker) Close() error {
+	u.stop()
+	return u.conn.Close()
+}
+
+// connectionID returns the cached connection ID, connecting to the tracker when there is none or it has expired
+func (u *udpTracker) connectionID() (uint64, error) {
+	udpConnections.Lock()
+	c, ok := udpConnections.ids[u.addr]
+	udpConnections.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.id, nil
+	}
+	resp, err := u.roundTrip(udpActionConnect, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("connect response too short, %d < %d", len(resp), 8)
+	}
+	id := binary.BigEndian.Uint64(resp[0:8])
+	udpConnections.Lock()
+	udpConnections.ids[u.addr] = udpConnection{id: id, expires: time.Now().Add(udpConnectionTTL)}
+	udpConnections.Unlock()
+	return id, nil
+}
+
+// forgetConnection drops the cached connection ID, e.g. after the tracker rejected it
+func (u *udpTracker) forgetConnection() {
+	udpConnections.Lock()
+	delete(udpConnections.ids, u.addr)
+	udpConnections.Unlock()
+}
+
+// roundTrip sends a request and returns the payload of the matching response, after <action><transaction_id>.
+// Requests are retransmitted after 15 * 2 ^ n seconds, and a fresh connection ID is requested when it expires meanwhile
+func (u *udpTracker) roundTrip(action uint32, body []byte) ([]byte, error) {
+	for n := 0; n <= udpMaxRetries; n++ {
+		connectionID := udpProtocolID
+		if action != udpActionConnect {
+			id, err := u.connectionID()
+			if err != nil {
+				return nil, err
+			}
+			connectionID = id
+		}
+		var tid [4]byte
+		_, err := rand.Read(tid[:])
+		if err != nil {
+			return nil, err
+		}
+		req := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(req[0:8], connectionID)
+		binary.BigEndian.PutUint32(req[8:12], action)
+		copy(req[12:16], tid[:])
+		copy(req[16:], body)
+		_, err = u.conn.Write(req)
+		if err == nil {
+			var resp []byte
+			resp, err = u.readResponse(action, binary.BigEndian.Uint32(tid[:]), time.Now().Add(udpTimeout<<n))
+			if err == nil {
+				return resp, nil
+			}
+		}
+		if u.ctx.Err() != nil {
+			return nil, u.ctx.Err()
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue // retransmit
+		}
+		return nil, err
+	}
+	return nil, fmt.Errorf("udp tracker %s did not respond", u.addr)
+}
+
+// readResponse reads datagrams until one matches the transaction ID, discarding the others
+func (u *udpTracker) readResponse(action uint32, tid uint32, deadline time.Time) ([]byte, error) {
+	_ = u.conn.SetReadDeadline(deadline)
+	defer func(conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Time{})
+	}(u.conn)
+	buf := make([]byte, 65536)
+	for {
+		n, err := u.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+			continue // stray or late datagram
+		}
+		switch got := binary.BigEndian.Uint32(buf[0:4]); got {
+		case action:
+			return append([]byte(nil), buf[8:n]...), nil
+		case udpActionError:
+			if action != udpActionConnect {
+				u.forgetConnection() // the connection ID might be what the tracker did not like
+			}
+			return nil, &TrackerError{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("expected action %d, got %d", action, got)
+		}
+	}
+}
+
+// announce sends an announce request and returns its response in the same shape as an HTTP tracker response
+func (u *udpTracker) announce(infoHash [20]byte, peerID [20]byte, port uint16, downloaded, left, uploaded int64, event uint32) (*trackerResponse, error) {
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash[:])
+	copy(body[20:40], peerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(uploaded))
+	binary.BigEndian.PutUint32(body[64:68], event)
+	binary.BigEndian.PutUint32(body[68:72], 0) // IP address, 0 to use the sender's
+	_, err := rand.Read(body[72:76])           // key
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(body[76:80], ^uint32(0)) // num_want, -1 for default
+	binary.BigEndian.PutUint16(body[80:82], port)
+	resp, err := u.roundTrip(udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("announce response too short, %d < %d", len(resp), 12)
+	}
+	trackerResp := &trackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:12])),
+	}
+	if addr, ok := u.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		trackerResp.Peers6 = string(resp[12:])
+	} else {
+		trackerResp.Peers = string(resp[12:])
+	}
+	return trackerResp, nil
+}
+
+// scrape requests the swarm state of up to udpMaxScrape info hashes at once
+func (u *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > udpMaxScrape {
+		return nil, fmt.Errorf("expected 1 to %d info hashes, got %d", udpMaxScrape, len(infoHashes))
+	}
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash[:]...)
+	}
+	resp, err := u.roundTrip(udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("expected scrape response of length %d, got %d", 12*len(infoHashes), len(resp))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		entry := resp[12*i : 12*(i+1)]
+		results[i] = ScrapeResult{
+			Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return results, nil
+}
+
+// udpEvents maps announce events to their UDP tracker codes
+var udpEvents = map[string]uint32{
+	eventNone:      udpEventNone,
+	eventCompleted: udpEventCompleted,
+	eventStarted:   udpEventStarted,
+	eventStopped:   udpEventStopped,
+}
+
+// announceUDP announces to a UDP tracker
+func (t *TorrentFile) announceUDP(ctx context.Context, announce *url.URL, params announceParams) (*trackerResponse, error) {
+	tracker, err := dialUDPTracker(ctx, announce)
+	if err != nil {
+		return nil, err
+	}
+	defer func(tracker *udpTracker) {
+		_ = tracker.Close()
+	}(tracker)
+	return tracker.announce(t.InfoHash, params.peerID, params.port, params.downloaded, int64(params.left), params.uploaded, udpEvents[params.event])
+}
+
+// scrapeUDP scrapes a UDP tracker, udpMaxScrape info hashes per request
+func scrapeUDP(ctx context.Context, announce *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	tracker, err := dialUDPTracker(ctx, announce)
+	if err != nil {
+		return nil, err
+	}
+	defer func(tracker *udpTracker) {
+		_ = tracker.Close()
+	}(tracker)
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrape {
+		batch := infoHashes[start:min(start+udpMaxScrape, len(infoHashes))]
+		scraped, err := tracker.scrape(batch)
+		if err != nil {
+			return nil, err
+		}
+		for i, infoHash := range batch {
+			results[infoHash] = scraped[i]
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,207 @@
+package torrentfile
+
+import (
+	"bittorrent-client-go/peers"
+	"bittorrent-client-go/tracker"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpStandIn is a minimal local UDP tracker
+type udpStandIn struct {
+	conn      *net.UDPConn
+	connects  atomic.Int32
+	announces atomic.Int32
+	drop      atomic.Int32 // number of announce requests to ignore, to exercise retransmission
+	failure   string       // if set, every announce gets an error response
+}
+
+func newUDPStandIn(t *testing.T, failure string) *udpStandIn {
+	return newUDPStandInOn(t, net.IPv4(127, 0, 0, 1), failure)
+}
+
+// newUDPStandInOn starts the stand-in on a loopback address, IPv6 ones answering announces with 18-byte peers
+func newUDPStandInOn(t *testing.T, ip net.IP, failure string) *udpStandIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	require.Nil(t, err)
+	s := &udpStandIn{conn: conn, failure: failure}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	timeout, ttl := udpTimeout, udpConnectionTTL
+	udpTimeout, udpConnectionTTL = 50*time.Millisecond, time.Minute
+	t.Cleanup(func() {
+		udpTimeout, udpConnectionTTL = timeout, ttl
+	})
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpStandIn) serve() {
+	const connectionID uint64 = 0x1122334455667788
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		action, tid := binary.BigEndian.Uint32(req[8:12]), req[12:16]
+		resp := binary.BigEndian.AppendUint32(nil, action)
+		resp = append(resp, tid...)
+		switch action {
+		case udpActionConnect:
+			s.connects.Add(1)
+			resp = binary.BigEndian.AppendUint64(resp, connectionID)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(req[0:8]) != connectionID || len(req) != 98 {
+				continue
+			}
+			if s.drop.Add(-1) >= 0 {
+				continue
+			}
+			s.announces.Add(1)
+			if s.failure != "" {
+				resp = binary.BigEndian.AppendUint32(nil, udpActionError)
+				resp = append(resp, tid...)
+				resp = append(resp, s.failure...)
+				break
+			}
+			resp = binary.BigEndian.AppendUint32(resp, 1800) // interval
+			resp = binary.BigEndian.AppendUint32(resp, 3)    // leechers
+			resp = binary.BigEndian.AppendUint32(resp, 7)    // seeders
+			if s.conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+				resp = append(append(resp, net.IPv6loopback...), 0x1A, 0xE1)
+				break
+			}
+			resp = append(resp, 192, 0, 2, 123, 0x1A, 0xE1, 127, 0, 0, 1, 0x1A, 0xE9)
+		case udpActionScrape:
+			for i := 16; i+20 <= len(req); i += 20 {
+				resp = binary.BigEndian.AppendUint32(resp, uint32(req[i])) // seeders
+				resp = binary.BigEndian.AppendUint32(resp, 42)             // completed
+				resp = binary.BigEndian.AppendUint32(resp, 1)              // leechers
+			}
+		}
+		_, _ = s.conn.WriteToUDP([]byte("late datagram"), addr)
+		_, _ = s.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestTorrentFile_RequestPeersUDP(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	s.drop.Store(1)
+	tf := TorrentFile{
+		Announce: s.url(),
+		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		Length:   351272960,
+	}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	expected := []peers.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+	}
+	p, err := tf.requestPeers(context.Background(), announceParams{peerID: peerID, port: 6882, left: tf.Length})
+	require.Nil(t, err)
+	assert.Equal(t, expected, p)
+	p, err = tf.requestPeers(context.Background(), announceParams{peerID: peerID, port: 6882, left: tf.Length})
+	require.Nil(t, err)
+	assert.Equal(t, expected, p)
+	assert.Equal(t, int32(1), s.connects.Load()) // connection ID is cached
+	assert.Equal(t, int32(2), s.announces.Load())
+}
+
+func TestTorrentFile_RequestPeersUDP_IPv6(t *testing.T) {
+	s := newUDPStandInOn(t, net.IPv6loopback, "")
+	tf := TorrentFile{Announce: s.url(), Length: 1}
+	p, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IPv6loopback, Port: 6881}}, p)
+}
+
+func TestTorrentFile_RequestPeersUDP_failure(t *testing.T) {
+	s := newUDPStandIn(t, "unregistered torrent")
+	tf := TorrentFile{Announce: s.url(), Length: 1}
+	_, err := tf.requestPeers(context.Background(), announceParams{port: 6882, left: tf.Length})
+	var trackerErr *TrackerError
+	require.ErrorAs(t, err, &trackerErr)
+	assert.Equal(t, "unregistered torrent", trackerErr.Reason)
+}
+
+func TestUDPTracker_scrape(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	u, err := dialUDPTracker(context.Background(), mustParseURL(t, s.url()))
+	require.Nil(t, err)
+	defer func(u *udpTracker) {
+		_ = u.Close()
+	}(u)
+	results, err := u.scrape([][20]byte{{5}, {9}})
+	require.Nil(t, err)
+	assert.Equal(t, []ScrapeResult{
+		{Complete: 5, Downloaded: 42, Incomplete: 1},
+		{Complete: 9, Downloaded: 42, Incomplete: 1},
+	}, results)
+	_, err = u.scrape(nil)
+	assert.NotNil(t, err)
+}
+
+func TestTorrentFile_UDPTrackerServer(t *testing.T) {
+	s, err := tracker.ListenUDP("127.0.0.1:0", tracker.NewSwarms())
+	require.Nil(t, err)
+	defer func(s *tracker.UDPServer) {
+		_ = s.Close()
+	}(s)
+	go func() {
+		_ = s.Serve()
+	}()
+	tf := TorrentFile{Announce: "udp://" + s.Addr().String(), InfoHash: [20]byte{4, 2}, Length: 10}
+
+	seed := tf.newAnnouncer([20]byte{'s'}, 6881, &fixedTransfer{})
+	found, err := seed.start(context.Background())
+	require.Nil(t, err)
+	assert.Empty(t, found) // alone
+	leecher := tf.newAnnouncer([20]byte{'l'}, 6882, &fixedTransfer{left: tf.Length})
+	found, err = leecher.start(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, found)
+
+	result, err := tf.Scrape(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Complete: 1, Incomplete: 1}, result)
+	_, err = leecher.announce(context.Background(), eventCompleted)
+	require.Nil(t, err)
+	_, err = seed.announce(context.Background(), eventStopped)
+	require.Nil(t, err)
+	result, err = tf.Scrape(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Complete: 0, Downloaded: 1, Incomplete: 1}, result)
+}
+
+func TestUDPTracker_timeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}) // never answers
+	require.Nil(t, err)
+	defer func(conn *net.UDPConn) {
+		_ = conn.Close()
+	}(conn)
+	timeout := udpTimeout
+	udpTimeout = time.Millisecond
+	defer func() {
+		udpTimeout = timeout
+	}()
+	u, err := dialUDPTracker(context.Background(), mustParseURL(t, "udp://"+conn.LocalAddr().String()))
+	require.Nil(t, err)
+	defer func(u *udpTracker) {
+		_ = u.Close()
+	}(u)
+	_, err = u.connectionID()
+	assert.NotNil(t, err)
+}
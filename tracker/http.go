@@ -0,0 +1,128 @@
+package tracker
+
+import (
+	"bittorrent-client-go/peers"
+	"fmt"
+	"github.com/jackpal/bencode-go"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// HTTP trackers answer GET requests at /announce and /scrape with bencoded dictionaries, see Response and ScrapeResponse.
+// Failures are reported in `failure reason` with a 200 status, as clients expect
+
+// NewHandler returns the HTTP tracker serving the swarms of `swarms`
+func NewHandler(swarms *Swarms) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
+		write(w, announce(swarms, r))
+	})
+	mux.HandleFunc("/scrape", func(w http.ResponseWriter, r *http.Request) {
+		write(w, scrape(swarms, r))
+	})
+	return mux
+}
+
+// announce answers an announce request
+func announce(swarms *Swarms, r *http.Request) Response {
+	params := r.URL.Query()
+	a, err := parseAnnounce(params, r.RemoteAddr)
+	if err != nil {
+		return Response{Failure: err.Error()}
+	}
+	sw := swarms.Announce(a, time.Now())
+	resp := Response{
+		Interval:    int(interval / time.Second),
+		MinInterval: int(minInterval / time.Second),
+		Complete:    sw.Complete,
+		Incomplete:  sw.Incomplete,
+	}
+	if params.Get("compact") == "0" { // the binary model otherwise, as most clients ask for it
+		noPeerID := params.Get("no_peer_id") == "1"
+		dicts := make([]interface{}, 0, len(sw.Peers))
+		for _, p := range sw.Peers {
+			dict := map[string]interface{}{"ip": p.IP.String(), "port": int(p.Port)}
+			if !noPeerID {
+				dict["peer id"] = string(p.ID[:])
+			}
+			dicts = append(dicts, dict)
+		}
+		resp.Peers = dicts
+		return resp
+	}
+	v4, v6 := peers.Marshal(sw.Peers)
+	resp.Peers, resp.Peers6 = string(v4), string(v6)
+	return resp
+}
+
+// parseAnnounce reads an announce from the query of the request, and the address of the peer from the connection
+func parseAnnounce(params url.Values, remoteAddr string) (Announce, error) {
+	a := Announce{Event: params.Get("event"), NumWant: -1}
+	infoHash, peerID := params.Get("info_hash"), params.Get("peer_id")
+	if len(infoHash) != 20 {
+		return Announce{}, fmt.Errorf("invalid info_hash")
+	}
+	if len(peerID) != 20 {
+		return Announce{}, fmt.Errorf("invalid peer_id")
+	}
+	copy(a.InfoHash[:], infoHash)
+	copy(a.Peer.ID[:], peerID)
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return Announce{}, fmt.Errorf("invalid port")
+	}
+	a.Peer.Port = uint16(port)
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return Announce{}, err
+	}
+	a.Peer.IP = net.ParseIP(host)
+	if ip4 := a.Peer.IP.To4(); ip4 != nil {
+		a.Peer.IP = ip4
+	}
+	a.Left, err = strconv.ParseInt(params.Get("left"), 10, 64)
+	if err != nil || a.Left < 0 {
+		return Announce{}, fmt.Errorf("invalid left")
+	}
+	switch a.Event {
+	case EventNone, EventStarted, EventCompleted, EventStopped:
+	default:
+		return Announce{}, fmt.Errorf("invalid event")
+	}
+	if numWant := params.Get("numwant"); numWant != "" {
+		a.NumWant, err = strconv.Atoi(numWant)
+		if err != nil || a.NumWant < 0 {
+			return Announce{}, fmt.Errorf("invalid numwant")
+		}
+	}
+	return a, nil
+}
+
+// scrape answers a scrape request, of every swarm when it has no `info_hash`
+func scrape(swarms *Swarms, r *http.Request) ScrapeResponse {
+	var infoHashes [][20]byte
+	for _, infoHash := range r.URL.Query()["info_hash"] {
+		if len(infoHash) != 20 {
+			return ScrapeResponse{Failure: "invalid info_hash"}
+		}
+		infoHashes = append(infoHashes, [20]byte([]byte(infoHash)))
+	}
+	files := swarms.Scrape(infoHashes, time.Now())
+	resp := ScrapeResponse{Files: make(map[string]File, len(files))}
+	for infoHash, file := range files {
+		resp.Files[string(infoHash[:])] = file
+	}
+	return resp
+}
+
+func write(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "text/plain")
+	err := bencode.Marshal(w, resp)
+	if err != nil {
+		log.Printf("error writing tracker response: %v\n", err)
+	}
+}
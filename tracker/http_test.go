@@ -0,0 +1,96 @@
+package tracker_test
+
+import (
+	"bittorrent-client-go/peers"
+	"bittorrent-client-go/torrentfile"
+	"bittorrent-client-go/tracker"
+	"context"
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// get announces to the tracker, as a client
+func get(t *testing.T, base string, params url.Values) map[string]interface{} {
+	resp, err := http.Get(base + "/announce?" + params.Encode())
+	require.Nil(t, err)
+	defer func(resp *http.Response) {
+		_ = resp.Body.Close()
+	}(resp)
+	decoded, err := bencode.Decode(resp.Body)
+	require.Nil(t, err)
+	dict, ok := decoded.(map[string]interface{})
+	require.True(t, ok)
+	return dict
+}
+
+func announceParams(infoHash [20]byte, peerID byte, port string) url.Values {
+	return url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {string([]byte{peerID, 19: 0})},
+		"port":      {port},
+		"left":      {"10"},
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ts := httptest.NewServer(tracker.NewHandler(tracker.NewSwarms()))
+	defer ts.Close()
+	infoHash := [20]byte{1, 2, 3}
+
+	resp := get(t, ts.URL, announceParams(infoHash, 'a', "6881"))
+	assert.Nil(t, resp["failure reason"])
+	assert.Equal(t, int64(1800), resp["interval"])
+
+	params := announceParams(infoHash, 'b', "6882")
+	params.Set("compact", "1")
+	resp = get(t, ts.URL, params)
+	assert.Equal(t, int64(2), resp["incomplete"])
+	found, err := peers.Unmarshal([]byte(resp["peers"].(string)))
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}}, found)
+
+	params.Set("compact", "0")
+	resp = get(t, ts.URL, params)
+	list, ok := resp["peers"].([]interface{})
+	require.True(t, ok)
+	found, err = peers.UnmarshalDicts(context.Background(), list)
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881, ID: [20]byte{'a'}}}, found)
+
+	params.Set("numwant", "0")
+	resp = get(t, ts.URL, params)
+	assert.Empty(t, resp["peers"])
+
+	params = announceParams(infoHash, 'c', "0")
+	resp = get(t, ts.URL, params)
+	assert.Equal(t, "invalid port", resp["failure reason"])
+
+	results, err := torrentfile.Scrape(context.Background(), ts.URL+"/announce", [][20]byte{infoHash, {9}})
+	require.Nil(t, err)
+	assert.Equal(t, map[[20]byte]torrentfile.ScrapeResult{
+		infoHash: {Incomplete: 2},
+	}, results)
+}
+
+func TestHandler_IPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	require.Nil(t, err)
+	ts := httptest.NewUnstartedServer(tracker.NewHandler(tracker.NewSwarms()))
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+	infoHash := [20]byte{1, 2, 3}
+
+	_ = get(t, ts.URL, announceParams(infoHash, 'a', "6881"))
+	resp := get(t, ts.URL, announceParams(infoHash, 'b', "6882"))
+	assert.Empty(t, resp["peers"])
+	found, err := peers.Unmarshal6([]byte(resp["peers6"].(string)))
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IPv6loopback, Port: 6881}}, found)
+}
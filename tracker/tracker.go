@@ -0,0 +1,215 @@
+package tracker
+
+import (
+	"bittorrent-client-go/peers"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A tracker keeps the swarm of every torrent announced to it: peers announce themselves regularly and get other
+// peers of the swarm in return, and are forgotten when they stop or once they have not announced for peerTTL
+
+// interval is how often peers are asked to announce, and minInterval how often they may
+var (
+	interval    = 30 * time.Minute
+	minInterval = time.Minute
+)
+
+// peerTTL is how long a peer is kept without announcing again
+var peerTTL = time.Hour
+
+// defaultNumWant is the number of peers returned when a peer does not say how many it wants, maxNumWant the largest
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+// Announce events
+const (
+	EventNone      = ""          // a regular announce
+	EventStarted   = "started"   // the first announce of a peer
+	EventCompleted = "completed" // the peer completed the download
+	EventStopped   = "stopped"   // the peer leaves the swarm
+)
+
+// Response is the bencoded response to an announce, as sent by trackers and parsed by clients
+type Response struct {
+	Failure     string      `bencode:"failure reason,omitempty"`  // if present, then no other keys may be present but `retry in`
+	RetryIn     interface{} `bencode:"retry in,omitempty"`        // optional with a failure, minutes before announcing again or "never" (BEP 31)
+	Warning     string      `bencode:"warning message,omitempty"` // optional, new
+	Interval    int         `bencode:"interval,omitempty"`        // in seconds
+	MinInterval int         `bencode:"min interval,omitempty"`    // optional, minimum announce interval
+	TrackerID   string      `bencode:"tracker id,omitempty"`      // a string that the client should send back on its next announcements
+	Complete    int         `bencode:"complete,omitempty"`        // number of peers with the entire file, i.e. seeders
+	Incomplete  int         `bencode:"incomplete,omitempty"`      // number of non-seeder peers, aka "leechers"
+	Peers       interface{} `bencode:"peers,omitempty"`           // list of peers, a string in the binary model or a list of dictionaries in the dictionary model
+	Peers6      string      `bencode:"peers6,omitempty"`          // list of IPv6 peers (binary model), 18 bytes each (BEP 7)
+}
+
+// ScrapeResponse is the bencoded response to a scrape
+type ScrapeResponse struct {
+	Failure string          `bencode:"failure reason,omitempty"`
+	Files   map[string]File `bencode:"files"` // by info hash
+}
+
+// File is the state of the swarm of one torrent, in a scrape response
+type File struct {
+	Complete   int `bencode:"complete"`   // number of peers with the entire file, i.e. seeders
+	Downloaded int `bencode:"downloaded"` // total number of times the tracker has registered a completion
+	Incomplete int `bencode:"incomplete"` // number of non-seeder peers, aka "leechers"
+}
+
+// Announce is what a peer tells the tracker about itself
+type Announce struct {
+	InfoHash [20]byte
+	Peer     peers.Peer // the address the peer accepts connections on, and its peer id
+	Left     int64      // bytes the peer still has to download, 0 for seeds
+	Event    string     // one of the announce events
+	NumWant  int        // number of peers wanted, defaultNumWant when negative
+	Family   string     // "ip4" or "ip6" to only return peers of one address family, as UDP responses carry, "" for both
+}
+
+// Swarm is the answer to an announce: other peers of the swarm, and its size
+type Swarm struct {
+	Peers      []peers.Peer
+	Complete   int
+	Incomplete int
+}
+
+// Swarms stores the peers of every torrent announced to, by info hash. It is safe for concurrent use,
+// so that trackers over several protocols can share it
+type Swarms struct {
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	nextSweep time.Time
+}
+
+type swarm struct {
+	peers      map[[20]byte]*member // by peer id
+	downloaded int
+}
+
+type member struct {
+	peer peers.Peer
+	left int64
+	seen time.Time // last announce
+}
+
+// NewSwarms creates an empty store
+func NewSwarms() *Swarms {
+	return &Swarms{swarms: make(map[[20]byte]*swarm)}
+}
+
+// Announce records an announce, and returns up to `NumWant` other peers of the swarm in random order
+func (s *Swarms) Announce(a Announce, now time.Time) Swarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	sw, ok := s.swarms[a.InfoHash]
+	if !ok {
+		if a.Event == EventStopped {
+			return Swarm{}
+		}
+		sw = &swarm{peers: make(map[[20]byte]*member)}
+		s.swarms[a.InfoHash] = sw
+	}
+	m, known := sw.peers[a.Peer.ID]
+	switch {
+	case a.Event == EventStopped:
+		delete(sw.peers, a.Peer.ID)
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, a.InfoHash)
+		}
+		return Swarm{}
+	case !known:
+		m = &member{}
+		sw.peers[a.Peer.ID] = m
+	}
+	if a.Event == EventCompleted && (!known || m.left > 0) { // counted once per peer
+		sw.downloaded++
+	}
+	m.peer, m.left, m.seen = a.Peer, a.Left, now
+
+	numWant := a.NumWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+	var result Swarm
+	others := make([]peers.Peer, 0, len(sw.peers))
+	for id, other := range sw.peers {
+		if other.left == 0 {
+			result.Complete++
+		} else {
+			result.Incomplete++
+		}
+		if id != a.Peer.ID && inFamily(other.peer, a.Family) {
+			others = append(others, other.peer)
+		}
+	}
+	rand.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+	result.Peers = others[:min(numWant, len(others))]
+	return result
+}
+
+func inFamily(p peers.Peer, family string) bool {
+	switch family {
+	case "ip4":
+		return p.IP.To4() != nil
+	case "ip6":
+		return p.IP.To4() == nil
+	default:
+		return true
+	}
+}
+
+// Scrape returns the state of the swarms of `infoHashes`, or of every swarm when there is none.
+// Unknown torrents are missing from the result
+func (s *Swarms) Scrape(infoHashes [][20]byte, now time.Time) map[[20]byte]File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	files := make(map[[20]byte]File, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		sw, ok := s.swarms[infoHash]
+		if !ok {
+			continue
+		}
+		file := File{Downloaded: sw.downloaded}
+		for _, m := range sw.peers {
+			if m.left == 0 {
+				file.Complete++
+			} else {
+				file.Incomplete++
+			}
+		}
+		files[infoHash] = file
+	}
+	return files
+}
+
+// sweep forgets the peers that did not announce for peerTTL, at most once every minInterval
+func (s *Swarms) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(minInterval)
+	for infoHash, sw := range s.swarms {
+		for id, m := range sw.peers {
+			if now.Sub(m.seen) > peerTTL {
+				delete(sw.peers, id)
+			}
+		}
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
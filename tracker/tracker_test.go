@@ -0,0 +1,58 @@
+package tracker
+
+import (
+	"bittorrent-client-go/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func peerAt(i byte) peers.Peer {
+	return peers.Peer{IP: net.IP{10, 0, 0, i}, Port: 6881, ID: [20]byte{i}}
+}
+
+func TestSwarms_Announce(t *testing.T) {
+	s := NewSwarms()
+	now := time.Now()
+	infoHash := [20]byte{1}
+
+	sw := s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(1), Left: 0, Event: EventStarted, NumWant: -1}, now)
+	assert.Empty(t, sw.Peers) // alone
+	assert.Equal(t, 1, sw.Complete)
+	for i := byte(2); i < 10; i++ {
+		s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(i), Left: 100, Event: EventStarted, NumWant: -1}, now)
+	}
+	sw = s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(2), Left: 100, NumWant: 3}, now)
+	assert.Len(t, sw.Peers, 3)
+	assert.NotContains(t, sw.Peers, peerAt(2)) // not itself
+	assert.Equal(t, 1, sw.Complete)
+	assert.Equal(t, 8, sw.Incomplete)
+	sw = s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(2), Left: 100, NumWant: -1}, now)
+	assert.Len(t, sw.Peers, 8)
+
+	s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(3), Left: 0, Event: EventCompleted}, now)
+	s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(3), Left: 0, Event: EventCompleted}, now) // counted once
+	s.Announce(Announce{InfoHash: infoHash, Peer: peerAt(4), Event: EventStopped}, now)
+	assert.Equal(t, map[[20]byte]File{
+		infoHash: {Complete: 2, Downloaded: 1, Incomplete: 6},
+	}, s.Scrape(nil, now))
+	assert.Empty(t, s.Scrape([][20]byte{{2}}, now)) // unknown
+}
+
+func TestSwarms_expiry(t *testing.T) {
+	s := NewSwarms()
+	now := time.Now()
+	s.Announce(Announce{InfoHash: [20]byte{1}, Peer: peerAt(1), Left: 1}, now)
+	s.Announce(Announce{InfoHash: [20]byte{2}, Peer: peerAt(1), Left: 1}, now)
+	sw := s.Announce(Announce{InfoHash: [20]byte{1}, Peer: peerAt(2), Left: 1, NumWant: -1}, now.Add(peerTTL/2))
+	assert.Len(t, sw.Peers, 1)
+
+	later := now.Add(peerTTL + minInterval)
+	sw = s.Announce(Announce{InfoHash: [20]byte{1}, Peer: peerAt(2), Left: 1, NumWant: -1}, later)
+	assert.Empty(t, sw.Peers) // peer #1 did not announce again
+	files := s.Scrape(nil, later)
+	require.Len(t, files, 1) // nor to the other swarm
+	assert.Equal(t, 1, files[[20]byte{1}].Incomplete)
+}
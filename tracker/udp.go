@@ -0,0 +1,183 @@
+package tracker
+
+import (
+	"bittorrent-client-go/peers"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// UDP trackers (BEP 15) answer datagrams, all integers are big-endian:
+// connect request:  <protocol_id 8><action 4><transaction_id 4>
+// connect response: <action 4><transaction_id 4><connection_id 8>
+// announce request: <connection_id 8><action 4><transaction_id 4><info_hash 20><peer_id 20><downloaded 8><left 8><uploaded 8>
+//                   <event 4><IP address 4><key 4><num_want 4><port 2>
+// announce response: <action 4><transaction_id 4><interval 4><leechers 4><seeders 4>(<IP address 4><TCP port 2>)*,
+//                    with IPv6 addresses of 16 bytes when the tracker is contacted over IPv6
+// scrape request:   <connection_id 8><action 4><transaction_id 4>(<info_hash 20>)*
+// scrape response:  <action 4><transaction_id 4>(<seeders 4><completed 4><leechers 4>)*
+// error response:   <action 4><transaction_id 4><message>
+// Connection IDs are not stored: they are derived from the IP address of the client, a secret and the current time window.
+// The port is left out, as clients reuse the connection ID across sockets
+
+const udpProtocolID uint64 = 0x41727101980 // magic constant
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+// udpEvents maps UDP event codes to announce events
+var udpEvents = map[uint32]string{
+	0: EventNone,
+	1: EventCompleted,
+	2: EventStarted,
+	3: EventStopped,
+}
+
+// udpMaxScrape is the largest number of info hashes answered in a single scrape response
+const udpMaxScrape = 74
+
+// connectionWindow is how long a connection ID is handed out for. IDs are accepted for one more window,
+// so that clients can use them for a minute as BEP 15 says, and the server accepts them for up to two
+var connectionWindow = time.Minute
+
+// UDPServer is a UDP tracker serving swarms that can be shared with an HTTP tracker
+type UDPServer struct {
+	conn   *net.UDPConn
+	swarms *Swarms
+	secret []byte
+}
+
+// ListenUDP starts listening for UDP tracker requests, Serve must be called to answer them.
+// An address without a host, such as ":6969", serves clients over both IPv4 and IPv6
+func ListenUDP(addr string, swarms *Swarms) (*UDPServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 20)
+	_, _ = rand.Read(secret)
+	return &UDPServer{conn: conn, swarms: swarms, secret: secret}, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *UDPServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Serve answers requests until the server is closed, which returns nil
+func (s *UDPServer) Serve() error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp := s.handle(buf[:n], addr, time.Now())
+		if resp != nil {
+			_, _ = s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// Close stops answering requests
+func (s *UDPServer) Close() error {
+	return s.conn.Close()
+}
+
+// handle returns the response to a request, nil when it does not deserve one
+func (s *UDPServer) handle(req []byte, addr *net.UDPAddr, now time.Time) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(req[0:8])
+	action, tid := binary.BigEndian.Uint32(req[8:12]), req[12:16]
+	resp := binary.BigEndian.AppendUint32(nil, action)
+	resp = append(resp, tid...)
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64(resp, s.connectionID(addr, now, 0))
+	}
+	if connectionID != s.connectionID(addr, now, 0) && connectionID != s.connectionID(addr, now, 1) {
+		return udpError(tid, "invalid connection id")
+	}
+	switch action {
+	case udpActionAnnounce:
+		if len(req) < 98 {
+			return udpError(tid, "announce too short")
+		}
+		event, ok := udpEvents[binary.BigEndian.Uint32(req[80:84])]
+		if !ok {
+			return udpError(tid, "invalid event")
+		}
+		a := Announce{
+			Peer:    peers.Peer{IP: addr.IP, Port: binary.BigEndian.Uint16(req[96:98])},
+			Left:    int64(binary.BigEndian.Uint64(req[64:72])),
+			Event:   event,
+			NumWant: int(int32(binary.BigEndian.Uint32(req[92:96]))),
+			Family:  "ip6",
+		}
+		copy(a.InfoHash[:], req[16:36])
+		copy(a.Peer.ID[:], req[36:56])
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			a.Peer.IP, a.Family = ip4, "ip4"
+		}
+		if a.Peer.Port == 0 || a.Left < 0 {
+			return udpError(tid, "invalid announce")
+		}
+		sw := s.swarms.Announce(a, now)
+		resp = binary.BigEndian.AppendUint32(resp, uint32(interval/time.Second))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(sw.Incomplete))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(sw.Complete))
+		v4, v6 := peers.Marshal(sw.Peers)
+		return append(append(resp, v4...), v6...) // only one of them, per Family
+	case udpActionScrape:
+		var infoHashes [][20]byte
+		for i := 16; i+20 <= len(req) && len(infoHashes) < udpMaxScrape; i += 20 {
+			infoHashes = append(infoHashes, [20]byte(req[i:i+20]))
+		}
+		if len(infoHashes) == 0 {
+			return udpError(tid, "no info hash")
+		}
+		files := s.swarms.Scrape(infoHashes, now)
+		for _, infoHash := range infoHashes {
+			file := files[infoHash] // zeros for unknown torrents, as entries are matched by position
+			resp = binary.BigEndian.AppendUint32(resp, uint32(file.Complete))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(file.Downloaded))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(file.Incomplete))
+		}
+		return resp
+	default:
+		return udpError(tid, "unknown action")
+	}
+}
+
+// connectionID returns the connection ID of an address, in the current (0) or previous (1) time window
+func (s *UDPServer) connectionID(addr *net.UDPAddr, now time.Time, window int64) uint64 {
+	h := sha1.New()
+	h.Write(s.secret)
+	h.Write(addr.IP.To16())
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()/int64(connectionWindow)-window)))
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+func udpError(tid []byte, message string) []byte {
+	resp := binary.BigEndian.AppendUint32(nil, udpActionError)
+	resp = append(resp, tid...)
+	return append(resp, message...)
+}
@@ -0,0 +1,68 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func request(connectionID uint64, action uint32, body []byte) []byte {
+	req := binary.BigEndian.AppendUint64(nil, connectionID)
+	req = binary.BigEndian.AppendUint32(req, action)
+	req = append(req, 0xCA, 0xFE, 0xBA, 0xBE) // transaction ID
+	return append(req, body...)
+}
+
+func announceBody(infoHash [20]byte, peerID byte, left uint64, port uint16) []byte {
+	body := make([]byte, 82)
+	copy(body[0:20], infoHash[:])
+	body[20] = peerID
+	binary.BigEndian.PutUint64(body[48:56], left)
+	binary.BigEndian.PutUint32(body[64:68], 2)          // started
+	binary.BigEndian.PutUint32(body[76:80], ^uint32(0)) // num_want, -1 for default
+	binary.BigEndian.PutUint16(body[80:82], port)
+	return body
+}
+
+func TestUDPServer_handle(t *testing.T) {
+	s := &UDPServer{swarms: NewSwarms(), secret: []byte("secret")}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	now := time.Now()
+	infoHash := [20]byte{1}
+
+	resp := s.handle(request(udpProtocolID, udpActionConnect, nil), addr, now)
+	require.Len(t, resp, 16)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0xCA, 0xFE, 0xBA, 0xBE}, resp[:8])
+	id := binary.BigEndian.Uint64(resp[8:16])
+	assert.Nil(t, s.handle(request(0, udpActionConnect, nil), addr, now)) // not the protocol ID
+
+	resp = s.handle(request(id, udpActionAnnounce, announceBody(infoHash, 'a', 0, 6881)), addr, now)
+	require.Len(t, resp, 20)
+	assert.Equal(t, udpActionAnnounce, binary.BigEndian.Uint32(resp[0:4]))
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(resp[16:20])) // one seeder, itself
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4000}
+	otherID := s.connectionID(other, now, 0)
+	resp = s.handle(request(otherID, udpActionAnnounce, announceBody(infoHash, 'b', 10, 6882)), other, now)
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x1A, 0xE1}, resp[20:])
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 4000}
+	resp = s.handle(request(s.connectionID(v6, now, 0), udpActionAnnounce, announceBody(infoHash, 'c', 10, 6883)), v6, now)
+	assert.Len(t, resp, 20) // no IPv4 peer in an IPv6 response
+
+	scrape := append(append([]byte(nil), infoHash[:]...), make([]byte, 20)...)
+	resp = s.handle(request(id, udpActionScrape, scrape), addr, now)
+	assert.Equal(t, []byte{
+		0, 0, 0, 2, 0xCA, 0xFE, 0xBA, 0xBE,
+		0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, // seeders, completed, leechers
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // unknown
+	}, resp)
+
+	resp = s.handle(request(id, udpActionScrape, nil), addr, now.Add(connectionWindow))
+	assert.Equal(t, udpActionError, binary.BigEndian.Uint32(resp[0:4])) // the ID is still valid, but not the request
+	resp = s.handle(request(id, udpActionScrape, scrape), addr, now.Add(2*connectionWindow))
+	assert.Equal(t, []byte("invalid connection id"), resp[8:]) // expired
+	resp = s.handle(request(id, udpActionScrape, scrape), other, now)
+	assert.Equal(t, []byte("invalid connection id"), resp[8:]) // not handed out to that address
+}